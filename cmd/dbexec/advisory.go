@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errLockHeld is the cause of a run failing, with --lock-wait=false, on a lock
+// another run holds.
+var errLockHeld = errors.New("not waiting with --lock-wait=false")
+
+// validateLockKey checks a query's lock_key.
+func validateLockKey(q QueryDefinition) error {
+	if q.LockKey != "" && strings.TrimSpace(q.LockKey) == "" {
+		return fmt.Errorf("query %s: lock_key cannot be blank", q.ID)
+	}
+	return nil
+}
+
+// runLocks returns the locks a run takes besides the lock_keys of its
+// queries, each with what declared it: the --lock flag and the lock of the
+// runbook being run.
+func runLocks(lock, runbook string) map[string]string {
+	locks := map[string]string{}
+	if lock != "" {
+		locks[lock] = "--lock"
+	}
+	if key := runbookLocks[runbook]; runbook != "" && key != "" {
+		if _, seen := locks[key]; !seen {
+			locks[key] = "runbook " + runbook
+		}
+	}
+	return locks
+}
+
+// lockKeys returns the lock keys of the queries ids and the run's locks,
+// sorted so concurrent runs take them in the same order, each with what
+// declared it first.
+func lockKeys(ids []string, locks map[string]string) (keys []string, owners map[string]string) {
+	owners = map[string]string{}
+	for key, owner := range locks {
+		owners[key] = owner
+		keys = append(keys, key)
+	}
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok || qdef.LockKey == "" {
+			continue
+		}
+		if _, seen := owners[qdef.LockKey]; !seen {
+			owners[qdef.LockKey] = qdef.ID
+			keys = append(keys, qdef.LockKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys, owners
+}
+
+// acquireLocks takes a transaction-level advisory lock on each of the lock
+// keys of ids and on the run's locks, waiting for runs holding them to
+// finish. Postgres releases the locks when the transaction ends. A positive
+// timeout bounds the wait for each lock through lock_timeout, restored
+// afterwards so the queries aren't affected. With noWait a held lock fails
+// the run at once instead.
+func (e txExecutor) acquireLocks(ctx context.Context, ids []string, locks map[string]string, timeout time.Duration, noWait bool) error {
+	keys, owners := lockKeys(ids, locks)
+	if len(keys) == 0 {
+		return nil
+	}
+	if noWait {
+		for _, key := range keys {
+			var acquired bool
+			if err := e.tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(hashtextextended($1, 0))", key).Scan(&acquired); err != nil {
+				return statementError(ctx, fmt.Sprintf("acquiring lock %q failed", key), owners[key], err)
+			}
+			if !acquired {
+				return &executionError{QueryID: owners[key], Message: fmt.Sprintf("lock %q of %s is held by another run", key, owners[key]), Err: errLockHeld}
+			}
+		}
+		return nil
+	}
+	restore := func(context.Context) error { return nil }
+	if timeout > 0 {
+		var err error
+		restore, err = e.setSessionParams(ctx, map[string]string{"lock_timeout": fmt.Sprintf("%dms", max(timeout.Milliseconds(), 1))})
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		// Keys are hashed to the 64-bit integers advisory locks are named by.
+		if _, err := e.tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", key); err != nil {
+			if sqlState(err) == sqlStateLockNotAvailable {
+				return &executionError{QueryID: owners[key], Message: fmt.Sprintf("lock %q of %s is still held by another run after %s", key, owners[key], timeout), Err: err}
+			}
+			return statementError(ctx, fmt.Sprintf("acquiring lock %q failed", key), owners[key], err)
+		}
+	}
+	return restore(ctx)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const advisoryCatalog = `
+- id: nightly_rollup
+  sql: SELECT 1
+  lock_key: rollup
+- id: rollup_report
+  sql: SELECT 2
+  lock_key: rollup
+- id: cleanup
+  sql: SELECT 3
+  lock_key: cleanup
+`
+
+func TestLockKeys(t *testing.T) {
+	loadTestQueries(t, advisoryCatalog)
+	keys, owners := lockKeys([]string{"rollup_report", "nightly_rollup", "cleanup"}, runLocks("deploy", ""))
+	if want := []string{"cleanup", "deploy", "rollup"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	want := map[string]string{"cleanup": "cleanup", "deploy": "--lock", "rollup": "rollup_report"}
+	if !reflect.DeepEqual(owners, want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+}
+
+// TestAdvisoryLockContention holds a query's lock_key on one connection of
+// the database at DATABASE_URL while runs on another try to take it.
+func TestAdvisoryLockContention(t *testing.T) {
+	db := testPostgres(t)
+	loadTestQueries(t, advisoryCatalog)
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	holder, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback()
+	if _, err := holder.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", "rollup"); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(id string, opts runOptions) error {
+		opts.Out, opts.Diag = io.Discard, io.Discard
+		_, err := runQueriesInTransaction(ctx, db, []string{id}, Params{}, opts)
+		return err
+	}
+
+	// Runs on other keys aren't held up.
+	if err := run("cleanup", runOptions{LockNoWait: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = run("nightly_rollup", runOptions{LockNoWait: true})
+	var execErr *executionError
+	if !errors.Is(err, errLockHeld) || !errors.As(err, &execErr) || execErr.QueryID != "nightly_rollup" {
+		t.Fatalf("with --lock-wait=false: got %v, want the lock reported as held", err)
+	}
+
+	err = run("nightly_rollup", runOptions{LockTimeout: 100 * time.Millisecond})
+	if sqlState(err) != sqlStateLockNotAvailable {
+		t.Fatalf("with --lock-timeout: got %v, want lock_not_available", err)
+	}
+
+	// A waiting run takes the lock once the holder's transaction ends.
+	done := make(chan error, 1)
+	go func() { done <- run("rollup_report", runOptions{}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("run finished while the lock was held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := holder.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run still waiting after the lock was released")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Approval signature algorithms.
+const (
+	approvalEd25519 = "ed25519"
+	approvalHMAC    = "hmac-sha256"
+)
+
+// approval is a signed statement that an approver reviewed a plan file or a
+// rollback script. It is written by dbexec approve-plan and checked by dbexec
+// apply and dbexec rollback. For a rollback script, PlanRunID is the run it
+// undoes.
+type approval struct {
+	PlanRunID  string    `json:"plan_run_id"`
+	PlanDigest string    `json:"plan_sha256"`
+	Approver   string    `json:"approver"`
+	ApprovedAt time.Time `json:"approved_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Algorithm  string    `json:"algorithm"`
+	Signature  []byte    `json:"signature"`
+}
+
+// approvalKeys holds the key material configured through the environment.
+// Keys are never accepted as flags so they don't end up in shell history or
+// process listings.
+type approvalKeys struct {
+	hmacKey    []byte
+	signingKey ed25519.PrivateKey
+	verifyKey  ed25519.PublicKey
+}
+
+// loadApprovalKeys reads the approval keys configured through the
+// environment: DBEXEC_APPROVAL_HMAC_KEY (or DBEXEC_APPROVAL_HMAC_KEY_FILE) for
+// a shared secret, DBEXEC_APPROVAL_SIGNING_KEY_FILE for an ed25519 private key
+// and DBEXEC_APPROVAL_VERIFY_KEY_FILE for the matching public key, both PEM
+// encoded.
+func loadApprovalKeys() (approvalKeys, error) {
+	var keys approvalKeys
+	if secret := os.Getenv("DBEXEC_APPROVAL_HMAC_KEY"); secret != "" {
+		keys.hmacKey = []byte(secret)
+	} else if path := os.Getenv("DBEXEC_APPROVAL_HMAC_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return keys, fmt.Errorf("failed to read approval HMAC key: %w", err)
+		}
+		keys.hmacKey = []byte(strings.TrimSpace(string(data)))
+	}
+
+	if path := os.Getenv("DBEXEC_APPROVAL_SIGNING_KEY_FILE"); path != "" {
+		key, err := readPEMKey(path, "PRIVATE KEY", x509.ParsePKCS8PrivateKey)
+		if err != nil {
+			return keys, err
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return keys, fmt.Errorf("%s is not an ed25519 private key", path)
+		}
+		keys.signingKey = priv
+	}
+	if path := os.Getenv("DBEXEC_APPROVAL_VERIFY_KEY_FILE"); path != "" {
+		key, err := readPEMKey(path, "PUBLIC KEY", x509.ParsePKIXPublicKey)
+		if err != nil {
+			return keys, err
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return keys, fmt.Errorf("%s is not an ed25519 public key", path)
+		}
+		keys.verifyKey = pub
+	}
+	return keys, nil
+}
+
+// readPEMKey decodes the first PEM block of the given type in path.
+func readPEMKey(path, blockType string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM %s", path, blockType)
+	}
+	key, err := parse(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// planDigest returns the hex-encoded SHA-256 hash of the parts of a plan an
+// approval covers: its run ID, target, queries, SQL hashes and parameters,
+// secret ones by their digests.
+func planDigest(p planFile) string {
+	data, _ := json.Marshal(struct {
+		RunID        string            `json:"run_id"`
+		Target       string            `json:"target,omitempty"`
+		Queries      []string          `json:"queries"`
+		SQLHashes    map[string]string `json:"sql_sha256"`
+		Params       Params            `json:"params"`
+		StepParams   []Params          `json:"step_params"`
+		SecretParams map[string]string `json:"secret_params_sha256,omitempty"`
+	}{p.RunID, p.Target, p.Queries, p.SQLHashes, p.Params, p.StepParams, p.SecretParams})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signedPayload returns the bytes an approval's signature covers.
+func (a approval) signedPayload() []byte {
+	a.Signature = nil
+	data, _ := json.Marshal(a)
+	return data
+}
+
+// sign signs the approval with the configured key, preferring ed25519.
+func (a *approval) sign(keys approvalKeys) error {
+	switch {
+	case keys.signingKey != nil:
+		a.Algorithm = approvalEd25519
+		a.Signature = ed25519.Sign(keys.signingKey, a.signedPayload())
+	case keys.hmacKey != nil:
+		a.Algorithm = approvalHMAC
+		mac := hmac.New(sha256.New, keys.hmacKey)
+		mac.Write(a.signedPayload())
+		a.Signature = mac.Sum(nil)
+	default:
+		return fmt.Errorf("no approval signing key configured (set DBEXEC_APPROVAL_SIGNING_KEY_FILE or DBEXEC_APPROVAL_HMAC_KEY)")
+	}
+	return nil
+}
+
+// verify checks the approval's signature, expiry and that it covers the plan
+// or rollback script identified by runID with the given digest.
+func (a approval) verify(keys approvalKeys, runID, digest string, now time.Time) error {
+	switch a.Algorithm {
+	case approvalEd25519:
+		if keys.verifyKey == nil {
+			return fmt.Errorf("approval is signed with ed25519 but DBEXEC_APPROVAL_VERIFY_KEY_FILE is not set")
+		}
+		if !ed25519.Verify(keys.verifyKey, a.signedPayload(), a.Signature) {
+			return fmt.Errorf("approval signature is invalid")
+		}
+	case approvalHMAC:
+		if keys.hmacKey == nil {
+			return fmt.Errorf("approval is signed with %s but no approval HMAC key is configured", approvalHMAC)
+		}
+		mac := hmac.New(sha256.New, keys.hmacKey)
+		mac.Write(a.signedPayload())
+		if !hmac.Equal(mac.Sum(nil), a.Signature) {
+			return fmt.Errorf("approval signature is invalid")
+		}
+	default:
+		return fmt.Errorf("unsupported approval algorithm: %q", a.Algorithm)
+	}
+
+	if a.PlanRunID != runID || a.PlanDigest != digest {
+		return fmt.Errorf("approval by %s is for %s, which does not match %s", a.Approver, a.PlanRunID, runID)
+	}
+	if now.After(a.ExpiresAt) {
+		return fmt.Errorf("approval by %s expired at %s", a.Approver, a.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// requiresApproval lists the plan's queries marked requires_approval.
+func (p planFile) requiresApproval() []string {
+	var ids []string
+	for _, id := range p.Queries {
+		if queries[id].RequiresApproval && !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkApproval verifies the approval file at path for plan. It fails if the
+// plan holds queries that require approval and no file is given, or if the
+// approval is by the plan's creator.
+func checkApproval(path string, plan planFile) error {
+	if path == "" {
+		if ids := plan.requiresApproval(); len(ids) > 0 {
+			return fmt.Errorf("queries %s require approval: pass --approval-file from dbexec approve-plan", strings.Join(ids, ","))
+		}
+		return nil
+	}
+	return checkApprovalFile(path, plan.RunID, planDigest(plan), plan.Actor)
+}
+
+// checkUnapproved refuses to execute the queries ids marked requires_approval
+// outside dbexec apply and dbexec rollback, the only commands that verify a
+// signed approval before executing.
+func checkUnapproved(ids []string) error {
+	var unapproved []string
+	for _, id := range ids {
+		if q, ok := queries[strings.TrimSpace(id)]; ok && q.RequiresApproval && !containsString(unapproved, q.ID) {
+			unapproved = append(unapproved, q.ID)
+		}
+	}
+	if len(unapproved) > 0 {
+		return fmt.Errorf("queries %s require approval: create a plan with dbexec plan, have it signed with dbexec approve-plan and execute it with dbexec apply --approval-file", strings.Join(unapproved, ","))
+	}
+	return nil
+}
+
+// checkApprovalFile verifies that the approval file at path covers the plan
+// or rollback script identified by runID with the given digest. The approver
+// may be neither the one executing it nor creator, who made the plan or the
+// run the script undoes.
+func checkApprovalFile(path, runID, digest, creator string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read approval: %w", err)
+	}
+	var a approval
+	if err := json.Unmarshal(data, &a); err != nil {
+		return fmt.Errorf("failed to parse approval: %w", err)
+	}
+	keys, err := loadApprovalKeys()
+	if err != nil {
+		return err
+	}
+	if err := a.verify(keys, runID, digest, time.Now()); err != nil {
+		return err
+	}
+	if a.Approver == cliActor() || a.Approver == creator {
+		return fmt.Errorf("approval by %s is not valid: they cannot approve their own change", a.Approver)
+	}
+	fmt.Fprintf(os.Stderr, "Approval by %s verified (expires %s).\n", a.Approver, a.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// approvePlan implements the approve-plan command, signing a reviewed plan
+// file or rollback script.
+func approvePlan(args []string) error {
+	fs := flag.NewFlagSet("approve-plan", flag.ExitOnError)
+	outPath := fs.String("out", "approval.sig", "Path of the approval file to write")
+	expires := fs.Duration("expires", 24*time.Hour, "How long the approval stays valid")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: dbexec approve-plan [--out approval.sig] [--expires 24h] plan.json|rollback.json")
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	approver := cliActor()
+	var runID, digest string
+	var script rollbackScript
+	if err := json.Unmarshal(data, &script); err == nil && script.RollbackOf != "" {
+		if approver == script.Actor {
+			return fmt.Errorf("run %s was made by %s, who cannot also approve rolling it back", script.RollbackOf, approver)
+		}
+		runID, digest = script.RollbackOf, script.digest()
+	} else {
+		var plan planFile
+		if err := json.Unmarshal(data, &plan); err != nil {
+			return fmt.Errorf("failed to parse plan: %w", err)
+		}
+		if approver == plan.Actor {
+			return fmt.Errorf("plan %s was created by %s, who cannot also approve it", plan.RunID, approver)
+		}
+		runID, digest = plan.RunID, planDigest(plan)
+	}
+	keys, err := loadApprovalKeys()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	a := approval{
+		PlanRunID:  runID,
+		PlanDigest: digest,
+		Approver:   approver,
+		ApprovedAt: now,
+		ExpiresAt:  now.Add(*expires),
+	}
+	if err := a.sign(keys); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*outPath, append(out, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write approval: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s approved by %s until %s, written to %s\n", path, approver, a.ExpiresAt.Format(time.RFC3339), *outPath)
+	return nil
+}
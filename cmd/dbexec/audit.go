@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord is a single entry in the audit log.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	RunID   string    `json:"run_id,omitempty"`
+	Actor   string    `json:"actor"`
+	Role    string    `json:"role,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Runbook string    `json:"runbook,omitempty"`
+	CSV     string    `json:"csv,omitempty"`
+	Queries []string  `json:"queries"`
+	Approve bool      `json:"approve"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	// Summary holds per-statement rows and durations of the run.
+	Summary *runSummary `json:"summary,omitempty"`
+	// PlanRunID is the run ID of the plan file an apply run executes.
+	PlanRunID string `json:"plan_run_id,omitempty"`
+	// ShowRedacted records that the run showed the values of redact_columns
+	// and mask_columns.
+	ShowRedacted bool `json:"show_redacted,omitempty"`
+	// RollbackOf is the run ID a dbexec rollback run undoes.
+	RollbackOf string `json:"rollback_of,omitempty"`
+	// Endpoint is primary or replica when a read replica is configured.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Reason is the operator's --reason for the run, such as a ticket.
+	Reason string `json:"reason,omitempty"`
+}
+
+// checkReason fails an approved run of a query marked requires_approval
+// unless reason is given, so every such execution is tied to a ticket.
+func checkReason(ids []string, reason string) error {
+	if strings.TrimSpace(reason) != "" {
+		return nil
+	}
+	for _, id := range ids {
+		if q, ok := queries[strings.TrimSpace(id)]; ok && q.RequiresApproval {
+			return fmt.Errorf("%s has requires_approval: pass --reason, such as a change ticket, to execute it", q.ID)
+		}
+	}
+	return nil
+}
+
+// auditLog appends JSON-encoded audit records, one per line, to a writer.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+	// path is the audit log file, or "" when records go to a fallback writer.
+	path string
+}
+
+// openAuditLog opens the audit log at path for appending. If path is empty,
+// records are written to fallback instead.
+func openAuditLog(path string, fallback io.Writer) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{w: fallback}, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{w: f, f: f, path: path}, nil
+}
+
+// Record writes an audit entry for a run described by rec, filling in the
+// time and the outcome from runErr.
+func (a *auditLog) Record(rec auditRecord, runErr error) {
+	rec.Time = time.Now().UTC()
+	rec.Outcome = "success"
+	trimmed := make([]string, len(rec.Queries))
+	for i, id := range rec.Queries {
+		trimmed[i] = strings.TrimSpace(id)
+	}
+	rec.Queries = trimmed
+	if runErr != nil {
+		rec.Outcome = "error"
+		rec.Error = runErr.Error()
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("failed to encode audit record", "run_id", rec.RunID, "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		slog.Error("failed to write audit record", "run_id", rec.RunID, "error", err)
+	}
+}
+
+// Close closes the underlying audit log file, if any.
+func (a *auditLog) Close() error {
+	if a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// cliActor identifies the operator of a CLI run for the audit log.
+func cliActor() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
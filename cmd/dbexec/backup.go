@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// defaultBackupSchema is the schema backup tables are created in unless
+// --backup-schema or DBEXEC_BACKUP_SCHEMA names another.
+const defaultBackupSchema = "dbexec_backup"
+
+// backupTolerance is how far, as a fraction of the rows backed up, the rows
+// a statement affects may differ from them before the run is rolled back.
+const backupTolerance = 0.1
+
+// backupDateLayout dates backup table names.
+const backupDateLayout = "20060102"
+
+// backupTableDate matches the date and run ID at the end of a backup table's
+// name, such as fix_totals_20240601_3f2a9c0d1e4b5a67 or, for a query's second
+// statement, ..._3f2a9c0d1e4b5a67_2.
+var backupTableDate = regexp.MustCompile(`_(\d{8})_[0-9a-f]+(?:_\d+)?$`)
+
+// backupSchema returns the schema backup tables are created in.
+func (opts runOptions) backupSchema() string {
+	if opts.BackupSchema == "" {
+		return defaultBackupSchema
+	}
+	return opts.BackupSchema
+}
+
+// validateBackup checks that every UPDATE and DELETE statement of a query
+// with backup: true can be backed up, which needs the rows it touches to be
+// derivable as for a preview.
+func validateBackup(q QueryDefinition) error {
+	if !q.Backup {
+		return nil
+	}
+	backedUp := false
+	for i, stmtSQL := range q.SQL {
+		switch statementKeyword(stmtSQL) {
+		case "UPDATE", "DELETE":
+			if _, err := previewQuery(stmtSQL); err != nil {
+				return fmt.Errorf("query %s: cannot back up rows: %v", q.statementLabel(i), err)
+			}
+			backedUp = true
+		}
+	}
+	if !backedUp {
+		return fmt.Errorf("query %s: backup: true needs an UPDATE or DELETE statement", q.ID)
+	}
+	return nil
+}
+
+// backupTableName names the backup table of statement i of q in a run:
+// <query_id>_<date>_<run_id>, suffixed with the statement's number when the
+// query has several. The query ID is shortened to keep the name within
+// Postgres's 63-byte limit.
+func backupTableName(q QueryDefinition, i int, runID string, now time.Time) string {
+	suffix := "_" + now.UTC().Format(backupDateLayout) + "_" + runID
+	if len(q.SQL) > 1 {
+		suffix += fmt.Sprintf("_%d", i+1)
+	}
+	base := strings.ToLower(q.ID)
+	if max := 63 - len(suffix); len(base) > max {
+		base = base[:max]
+	}
+	return base + suffix
+}
+
+// backupRows copies the rows an UPDATE or DELETE statement is about to
+// modify into a new table in schema, inside the run's transaction, and
+// returns how many were copied. The table has the columns of the modified
+// table, created with CREATE TABLE ... (LIKE ...), since CREATE TABLE AS
+// can't take the statement's bound parameters.
+func (e txExecutor) backupRows(ctx context.Context, schema, table, stmtSQL string, args []interface{}) (int64, error) {
+	tableName, where, err := previewParts(stmtSQL)
+	if err != nil {
+		return 0, err
+	}
+	source := modifiedTable(tableName)
+	qualified := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+
+	if _, err := e.tx.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+pq.QuoteIdentifier(schema)); err != nil {
+		return 0, fmt.Errorf("failed to create backup schema: %w", err)
+	}
+	if _, err := e.tx.ExecContext(ctx, "CREATE TABLE "+qualified+" (LIKE "+source+")"); err != nil {
+		return 0, fmt.Errorf("failed to create backup table: %w", err)
+	}
+	res, err := e.tx.ExecContext(ctx, strings.TrimSpace("INSERT INTO "+qualified+" SELECT * FROM "+tableName+" "+where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy rows to backup table: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// checkBackupCount fails if a statement affected a number of rows far from
+// the number backed up before it ran, meaning the backup doesn't hold the
+// rows that changed.
+func checkBackupCount(label string, backedUp, affected int64) error {
+	diff := affected - backedUp
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > int64(float64(backedUp)*backupTolerance) {
+		return fmt.Errorf("%s affected %d rows but %d were backed up before it ran", label, affected, backedUp)
+	}
+	return nil
+}
+
+// backupInfo describes a backup table found by list-backups.
+type backupInfo struct {
+	Table   string
+	Created time.Time
+	Rows    int64
+	Bytes   int64
+}
+
+// listBackupTables returns the tables in the backup schema with their
+// estimated row counts and sizes, ordered by name.
+func listBackupTables(ctx context.Context, db *sql.DB, schema string) ([]backupInfo, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, COALESCE(s.n_live_tup, 0), pg_total_relation_size(c.oid)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE n.nspname = $1 AND c.relkind = 'r'
+		ORDER BY c.relname`, schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup tables: %w", err)
+	}
+	defer rows.Close()
+
+	var backups []backupInfo
+	for rows.Next() {
+		var b backupInfo
+		if err := rows.Scan(&b.Table, &b.Rows, &b.Bytes); err != nil {
+			return nil, err
+		}
+		if m := backupTableDate.FindStringSubmatch(b.Table); m != nil {
+			b.Created, _ = time.Parse(backupDateLayout, m[1])
+		}
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+// listBackups implements the list-backups command, printing the backup
+// tables of a database and the statements dropping those past retention.
+func listBackups(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("list-backups", flag.ExitOnError)
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	target := fs.String("target", os.Getenv("DBEXEC_TARGET"), "Connection profile from the targets file to connect to (default DATABASE_URL)")
+	schema := fs.String("backup-schema", envOr("DBEXEC_BACKUP_SCHEMA", defaultBackupSchema), "Schema holding the backup tables")
+	olderThan := fs.Duration("older-than", 0, "Only list backups created at least this long ago, such as 720h")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(*driver, *target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	backups, err := listBackupTables(context.Background(), db, *schema)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-*olderThan)
+	var listed []backupInfo
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCREATED\tROWS\tSIZE")
+	for _, b := range backups {
+		if *olderThan > 0 && (b.Created.IsZero() || b.Created.After(cutoff)) {
+			continue
+		}
+		created := "-"
+		if !b.Created.IsZero() {
+			created = b.Created.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s.%s\t%s\t%d\t%d\n", *schema, b.Table, created, b.Rows, b.Bytes)
+		listed = append(listed, b)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if *olderThan > 0 && len(listed) > 0 {
+		fmt.Fprintln(out, "\nOnce the fixes are verified, drop them with:")
+		for _, b := range listed {
+			fmt.Fprintf(out, "DROP TABLE %s.%s;\n", pq.QuoteIdentifier(*schema), pq.QuoteIdentifier(b.Table))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// benchResult is the outcome of dbexec bench: the latency of each timed
+// iteration and the rows it returned, with their statistics.
+type benchResult struct {
+	QueryID       string     `json:"query_id"`
+	Iterations    int        `json:"iterations"`
+	Warmup        int        `json:"warmup"`
+	NewConnection bool       `json:"new_connection"`
+	Min           durationMS `json:"min_ms"`
+	P50           durationMS `json:"p50_ms"`
+	P95           durationMS `json:"p95_ms"`
+	Max           durationMS `json:"max_ms"`
+	Mean          durationMS `json:"mean_ms"`
+	// Latencies and Rows hold each timed iteration's latency and row count,
+	// in order.
+	Latencies []durationMS `json:"latencies_ms"`
+	Rows      []int64      `json:"rows"`
+}
+
+// runBench implements the bench command: it runs one SELECT query
+// repeatedly in read-only transactions, discarding the rows, and reports its
+// latency.
+func runBench(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	queryID := fs.String("query", "", "ID of the SELECT query to benchmark")
+	iterations := fs.Int("iterations", 50, "Number of timed runs of the query")
+	warmup := fs.Int("warmup", 5, "Number of untimed runs before the timed ones")
+	paramsJSON := fs.String("params", "{}", "JSON string of the query's parameters")
+	newConnection := fs.Bool("new-connection", false, "Open a new connection for every run instead of reusing one; connecting is not timed")
+	queryTimeout := fs.Duration("query-timeout", 0, "Abort if any run takes longer than this (0 for no limit)")
+	output := fs.String("output", formatText, "Report format: text or json")
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	role := fs.String("role", os.Getenv("DBEXEC_ROLE"), "Role of the operator, checked against the query's required_role")
+	target := fs.String("target", os.Getenv("DBEXEC_TARGET"), "Connection profile from the targets file to run against (default DATABASE_URL)")
+	fs.StringVar(target, "env", *target, "Alias of --target")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	if *queryID == "" {
+		return fmt.Errorf("usage: dbexec bench --query <id> [--iterations 50] [--warmup 5]")
+	}
+	if *iterations < 1 {
+		return fmt.Errorf("--iterations must be at least 1")
+	}
+	if *warmup < 0 {
+		return fmt.Errorf("--warmup cannot be negative")
+	}
+	if *output != formatText && *output != formatJSON {
+		return fmt.Errorf("unsupported output format: %s", *output)
+	}
+	var params Params
+	if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
+		return fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := loadQueries(); err != nil {
+		return err
+	}
+	qdef, ok := queries[*queryID]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownQuery, *queryID)
+	}
+	if err := qdef.checkRole(*role); err != nil {
+		return err
+	}
+	qdef, err := qdef.withIdentifiers(params)
+	if err != nil {
+		return err
+	}
+	if qdef, err = qdef.withConditions(params); err != nil {
+		return err
+	}
+	if !qdef.readOnly() {
+		return fmt.Errorf("query %s is not a SELECT; bench only runs queries that read", qdef.ID)
+	}
+	bound, err := qdef.bindParams(params, nil)
+	if err != nil {
+		return err
+	}
+	sessionParams, err := qdef.sessionParamsFor(params)
+	if err != nil {
+		return err
+	}
+
+	if err := announceTarget(os.Stderr, *target, false, ""); err != nil {
+		return err
+	}
+	db, err := openDatabase(*driver, *target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *newConnection {
+		// Released connections are closed, so every run dials anew.
+		db.SetMaxIdleConns(0)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var conn *sql.Conn
+	result := benchResult{QueryID: qdef.ID, Iterations: *iterations, Warmup: *warmup, NewConnection: *newConnection}
+	for i := 0; i < *warmup+*iterations; i++ {
+		if conn == nil {
+			if conn, err = db.Conn(ctx); err != nil {
+				return fmt.Errorf("failed to connect: %w", err)
+			}
+		}
+		elapsed, rows, err := benchIteration(ctx, conn, qdef, bound, sessionParams, *queryTimeout)
+		if *newConnection {
+			conn.Close()
+			conn = nil
+		}
+		if err != nil {
+			return fmt.Errorf("run %d of %s: %w", i+1, qdef.ID, err)
+		}
+		if i >= *warmup {
+			result.Latencies = append(result.Latencies, durationMS(elapsed))
+			result.Rows = append(result.Rows, rows)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	result.computeStats()
+	if *output == formatJSON {
+		return json.NewEncoder(out).Encode(result)
+	}
+	result.write(out)
+	return nil
+}
+
+// benchIteration runs the statements of qdef once in a read-only transaction
+// on conn, reading and discarding their rows, and returns how long the
+// statements took and how many rows they returned. The transaction's setup,
+// its role and session parameters, isn't timed.
+func benchIteration(ctx context.Context, conn *sql.Conn, qdef QueryDefinition, args []interface{}, sessionParams map[string]string, timeout time.Duration) (time.Duration, int64, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	exec := txExecutor{tx: tx, conn: conn}
+	if qdef.DatabaseRole != "" {
+		if err := exec.setRole(ctx, qdef.DatabaseRole); err != nil {
+			return 0, 0, statementError(ctx, "setting role failed", qdef.ID, err)
+		}
+	}
+	if _, err := exec.setSessionParams(ctx, sessionParams); err != nil {
+		return 0, 0, statementError(ctx, "session parameters failed", qdef.ID, err)
+	}
+
+	var rowCount int64
+	start := time.Now()
+	for i, stmtSQL := range qdef.SQL {
+		label := qdef.statementLabel(i)
+		highest := placeholderCount(stmtSQL)
+		if highest > len(args) {
+			return 0, 0, fmt.Errorf("%s references $%d but only %d parameters are allowed", label, highest, len(args))
+		}
+		rows, err := tx.QueryContext(ctx, stmtSQL, args[:highest]...)
+		if err != nil {
+			return 0, 0, statementError(ctx, "execution error", label, err)
+		}
+		for rows.Next() {
+			rowCount++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, 0, statementError(ctx, "execution error", label, err)
+		}
+	}
+	return time.Since(start), rowCount, nil
+}
+
+// computeStats fills in the statistics of the recorded latencies.
+// Percentiles use the nearest-rank method.
+func (r *benchResult) computeStats() {
+	sorted := slices.Clone(r.Latencies)
+	slices.Sort(sorted)
+	percentile := func(p float64) durationMS {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	var total durationMS
+	for _, d := range sorted {
+		total += d
+	}
+	r.Min, r.Max = sorted[0], sorted[len(sorted)-1]
+	r.P50, r.P95 = percentile(0.5), percentile(0.95)
+	r.Mean = total / durationMS(len(sorted))
+}
+
+// write prints the report, with the rows per iteration as a single number
+// when every run returned the same count.
+func (r benchResult) write(out io.Writer) {
+	connection := "reused"
+	if r.NewConnection {
+		connection = "new"
+	}
+	ms := func(d durationMS) string { return formatDuration(time.Duration(d)) }
+	fmt.Fprintf(out, "[BENCH] QueryID=%s Iterations=%d Warmup=%d Connection=%s\n", r.QueryID, r.Iterations, r.Warmup, connection)
+	fmt.Fprintf(out, "Latency: min=%s p50=%s p95=%s max=%s mean=%s\n", ms(r.Min), ms(r.P50), ms(r.P95), ms(r.Max), ms(r.Mean))
+	lo, hi := slices.Min(r.Rows), slices.Max(r.Rows)
+	if lo == hi {
+		fmt.Fprintf(out, "Rows per iteration: %d\n", lo)
+	} else {
+		fmt.Fprintf(out, "Rows per iteration: %d to %d\n", lo, hi)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Transaction modes selected with --tx.
+const (
+	txSingle   = "single"    // every query of the run shares one transaction
+	txPerQuery = "per-query" // each query, or CSV row, commits or rolls back on its own
+	// txPerDatabase gives the queries of each database their own
+	// transaction when queries declare different databases.
+	txPerDatabase = "per-database"
+)
+
+// bulkRun tracks a --foreach-csv run, which executes one query once per row
+// of a CSV file.
+type bulkRun struct {
+	// Lines holds the CSV line number of each row.
+	Lines []int
+	// Progress receives a progress line every ProgressEvery rows (0 disables).
+	Progress      io.Writer
+	ProgressEvery int
+	// MaxTotalRows caps the rows affected across all executions (0 for no limit).
+	MaxTotalRows int64
+
+	done  int
+	total int64
+}
+
+// readBulkCSV reads the parameter rows of a --foreach-csv file for q. The
+// header names the parameters; every column must be one of q's allowed
+// parameters. Values in a row override those in base.
+func readBulkCSV(path string, q QueryDefinition, base Params) ([]Params, []int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open CSV: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if !q.acceptsParam(header[i]) || strings.HasPrefix(header[i], exportPrefix) {
+			return nil, nil, fmt.Errorf("CSV column %s is not an allowed parameter of %s", header[i], q.ID)
+		}
+	}
+
+	var rows []Params
+	var lines []int
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		row := make(Params, len(header))
+		for i, name := range header {
+			row[name] = ParamValue{Value: record[i]}
+		}
+		rows = append(rows, base.withOverrides(row))
+		lines = append(lines, line)
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("CSV %s has no data rows", path)
+	}
+	return rows, lines, nil
+}
+
+// rowDone records that the current row finished with the given number of
+// rows affected, enforcing the aggregate cap and reporting progress. It is a
+// no-op on a nil bulkRun.
+func (b *bulkRun) rowDone(rows int64) error {
+	if b == nil {
+		return nil
+	}
+	b.done++
+	b.total += rows
+	if b.MaxTotalRows > 0 && b.total > b.MaxTotalRows {
+		return fmt.Errorf("CSV line %d: %w", b.Lines[b.done-1], &rowLimitError{Scope: limitAggregate, Limit: b.MaxTotalRows, Actual: b.total})
+	}
+	if b.Progress != nil && b.ProgressEvery > 0 && (b.done%b.ProgressEvery == 0 || b.done == len(b.Lines)) {
+		fmt.Fprintf(b.Progress, "[PROGRESS] %d/%d rows, %d rows affected\n", b.done, len(b.Lines), b.total)
+	}
+	return nil
+}
+
+// lineError attributes err to the CSV line of the row being executed.
+func (b *bulkRun) lineError(err error) error {
+	if b == nil || b.done >= len(b.Lines) {
+		return err
+	}
+	return fmt.Errorf("CSV line %d: %w", b.Lines[b.done], err)
+}
+
+// repeat returns a list holding s n times.
+func repeat(s string, n int) []string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = s
+	}
+	return list
+}
+
+// Outcomes of a query run in its own transaction with --tx=per-query.
+const (
+	queryCommitted = "committed"
+	queryPreviewed = "previewed"
+	queryFailed    = "failed"
+	queryNotRun    = "not_run"
+)
+
+// perQueryOrder lists the queries of groups in the order they run.
+func perQueryOrder(groups []targetGroup) []string {
+	var ids []string
+	for _, g := range groups {
+		ids = append(ids, g.IDs...)
+	}
+	return ids
+}
+
+// reportPerQuery writes the outcome of each of ids, run one transaction per
+// query, given the summaries of the transactions run so far and the error
+// that ended the run, if any.
+func reportPerQuery(w io.Writer, ids []string, summaries []*runSummary, runErr error) {
+	committed := 0
+	for i, id := range ids {
+		outcome := queryNotRun
+		switch {
+		case i >= len(summaries):
+		case summaries[i].Committed:
+			outcome = queryCommitted
+			committed++
+		case runErr != nil && i == len(summaries)-1:
+			outcome = queryFailed
+		default:
+			outcome = queryPreviewed
+		}
+		fmt.Fprintf(w, "[TX] Query=%s Outcome=%s\n", strings.TrimSpace(id), outcome)
+	}
+	if committed > 0 {
+		fmt.Fprintf(w, "%d of %d queries committed\n", committed, len(ids))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "fmt"
+
+// resultCapture records columns of a result set while it is being written,
+// for the query's exports and expectations.
+type resultCapture struct {
+	queryID string
+	// masks holds the maskers of the query's redact_columns and mask_columns,
+	// which also apply to messages.
+	masks   map[string]string
+	columns map[string]bool
+	values  map[string][]interface{}
+	rows    int
+	err     error
+}
+
+// newResultCapture returns a capture for the columns q exports or asserts on,
+// or nil if q does neither.
+func newResultCapture(q QueryDefinition) *resultCapture {
+	columns := map[string]bool{}
+	for column := range q.Exports {
+		columns[column] = true
+	}
+	if q.Expect != nil && q.Expect.Value != nil {
+		columns[q.Expect.Value.Column] = true
+	}
+	if len(columns) == 0 && q.Expect == nil {
+		return nil
+	}
+	return &resultCapture{queryID: q.ID, masks: q.masks(), columns: columns, values: map[string][]interface{}{}}
+}
+
+// row records the wanted columns of a scanned row. It is a no-op on a nil
+// capture.
+func (c *resultCapture) row(columns []string, values []interface{}) {
+	if c == nil || c.err != nil {
+		return
+	}
+	if c.rows == 0 {
+		for column := range c.columns {
+			if !containsString(columns, column) {
+				c.err = fmt.Errorf("query %s reads column %s, which its result does not have", c.queryID, column)
+				return
+			}
+		}
+	}
+	for i, column := range columns {
+		if c.columns[column] {
+			c.values[column] = append(c.values[column], values[i])
+		}
+	}
+	c.rows++
+}
+
+// describe renders a captured value of column for messages, masking the
+// values of the query's redact_columns and mask_columns.
+func (c *resultCapture) describe(column string, v interface{}) string {
+	if masker := maskerFor(c.masks, column); v != nil && masker != nil {
+		return masker(formatValue(v))
+	}
+	return formatValue(v)
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
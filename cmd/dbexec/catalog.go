@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// queryOrder lists query IDs in the order they appear in the definitions file.
+var queryOrder []string
+
+// hasTags reports whether q carries the given tags: all of them, or at least
+// one when matchAny is set.
+func (q QueryDefinition) hasTags(tags []string, matchAny bool) bool {
+	have := map[string]bool{}
+	for _, t := range q.Tags {
+		have[t] = true
+	}
+	for _, t := range tags {
+		if have[t] && matchAny {
+			return true
+		}
+		if !have[t] && !matchAny {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+// selectQueries combines explicitly named query IDs with the queries matching
+// tags, in definition-file order, dropping duplicates.
+func selectQueries(ids, tags []string, matchAny bool) []string {
+	var selected []string
+	seen := map[string]bool{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		selected = append(selected, id)
+	}
+	if len(tags) == 0 {
+		return selected
+	}
+	for _, id := range queryOrder {
+		if !seen[id] && queries[id].hasTags(tags, matchAny) {
+			seen[id] = true
+			selected = append(selected, id)
+		}
+	}
+	return selected
+}
+
+// selectRun resolves the queries of a run from the --queries, --tags and
+// --runbook flags, returning the parameters a runbook fixes for each step.
+func selectRun(queryIDs, tags string, tagsAny bool, runbook string) ([]string, []Params, error) {
+	ids := selectQueries(splitList(queryIDs), splitList(tags), tagsAny)
+	if runbook == "" {
+		return ids, nil, nil
+	}
+	if len(ids) > 0 {
+		return nil, nil, fmt.Errorf("--runbook cannot be combined with --queries or --tags")
+	}
+	return expandRunbook(runbook)
+}
+
+// splitList splits a comma-separated flag value, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// listQueries implements the list command, printing the query catalog.
+func listQueries(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	tags := fs.String("tags", "", "Only list queries carrying all of these comma-separated tags")
+	tagsAny := fs.Bool("tags-any", false, "With --tags, list queries carrying any of the tags")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	if err := loadQueries(); err != nil {
+		return err
+	}
+	return writeQueryList(out, splitList(*tags), *tagsAny)
+}
+
+// writeQueryList prints the loaded queries carrying the tags in filter (any
+// of them with tagsAny), or every query and runbook when filter is empty.
+func writeQueryList(out io.Writer, filter []string, tagsAny bool) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTAGS\tDESCRIPTION")
+	for _, id := range queryOrder {
+		q := queries[id]
+		if len(filter) > 0 && !q.hasTags(filter, tagsAny) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", q.ID, strings.Join(q.Tags, ","), q.Description)
+	}
+	if len(filter) == 0 && len(runbookOrder) > 0 {
+		fmt.Fprintln(w, "\nRUNBOOK\tSTEPS")
+		for _, name := range runbookOrder {
+			steps := describeSteps(runbooks[name])
+			if lock := runbookLocks[name]; lock != "" {
+				steps += " (lock: " + lock + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, steps)
+		}
+	}
+	return w.Flush()
+}
+
+// queryDescription is a query's definition as dbexec runs it, printed by
+// --describe: defaults are filled in and what dbexec derives from the
+// statements is added.
+type queryDescription struct {
+	QueryDefinition `yaml:",inline"`
+	// StatementTypes holds the type of each statement, such as UPDATE.
+	StatementTypes []string `yaml:"statement_types" json:"statement_types"`
+	ReadOnly       bool     `yaml:"read_only" json:"read_only"`
+	// DefinitionHash is the hash plans and approvals pin the query to.
+	DefinitionHash string `yaml:"definition_hash" json:"definition_hash"`
+}
+
+// describe returns q's effective definition. Every allowed parameter is
+// listed in params, with the string type assumed for undeclared ones.
+func (q QueryDefinition) describe() queryDescription {
+	if q.MaxRowsScope == "" {
+		q.MaxRowsScope = rowsScopeStatement
+	}
+	params := make(map[string]ParamDefinition, len(q.AllowedParams))
+	for _, name := range q.AllowedParams {
+		if !strings.HasPrefix(name, exportPrefix) {
+			params[name] = ParamDefinition{Type: paramString}
+		}
+	}
+	for name, p := range q.Params {
+		params[name] = p
+	}
+	q.Params = params
+
+	d := queryDescription{QueryDefinition: q, ReadOnly: q.readOnly(), DefinitionHash: definitionHash(q)}
+	for _, stmtSQL := range q.SQL {
+		d.StatementTypes = append(d.StatementTypes, statementType(stmtSQL))
+	}
+	return d
+}
+
+// describeQuery writes the effective definition of the query id to out, in
+// JSON for the json format and YAML otherwise.
+func describeQuery(out io.Writer, id, format string) error {
+	q, ok := queries[strings.TrimSpace(id)]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownQuery, id)
+	}
+	d := q.describe()
+	if format == formatJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateKeywords are the actions of conditional statements that would
+// otherwise read as identifier placeholders in their short form, {{name}}.
+var templateKeywords = map[string]bool{"else": true, "end": true}
+
+// conditional reports whether the query has optional parameters, which make
+// its statements templates deciding which clauses are included.
+func (q QueryDefinition) conditional() bool {
+	for _, p := range q.Params {
+		if p.Optional {
+			return true
+		}
+	}
+	return false
+}
+
+// compileConditions parses the statements of a query with optional
+// parameters as text/template templates, in which identifier placeholders
+// are literal text that withIdentifiers replaces once they are rendered.
+// Each is executed with every parameter supplied and with none, so a
+// reference to an unknown parameter fails when definitions are loaded rather
+// than when the query runs.
+func compileConditions(q *QueryDefinition) error {
+	if !q.conditional() {
+		return nil
+	}
+	q.conditions = make([]*template.Template, len(q.SQL))
+	for i, stmtSQL := range q.SQL {
+		text := identifierPlaceholder.ReplaceAllStringFunc(stmtSQL, func(m string) string {
+			if templateKeywords[identifierPlaceholder.FindStringSubmatch(m)[1]] {
+				return m
+			}
+			return "{{" + strconv.Quote(m) + "}}"
+		})
+		tmpl, err := template.New(q.statementLabel(i)).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("query %s: invalid conditional statement: %w", q.ID, err)
+		}
+		for _, supplied := range []bool{true, false} {
+			data := map[string]bool{}
+			for _, name := range q.AllowedParams {
+				if !strings.HasPrefix(name, exportPrefix) {
+					data[name] = supplied
+				}
+			}
+			if err := tmpl.Execute(new(bytes.Buffer), data); err != nil {
+				return fmt.Errorf("query %s: invalid conditional statement: %w", q.ID, err)
+			}
+		}
+		q.conditions[i] = tmpl
+	}
+	return nil
+}
+
+// withConditions returns a copy of q with its statements rendered for the
+// parameters supplied in params: in each template, .name is true when the
+// parameter name was supplied, null included. Values are never part of the
+// rendering; they stay bound to placeholders. Placeholders are renumbered
+// and allowed_params narrowed to the parameters the rendered statements,
+// guards and rollback_sql still reference, so omitted optional parameters
+// aren't bound. Parameters that aren't optional must still be supplied. q is
+// returned unchanged when it has no optional parameters.
+func (q QueryDefinition) withConditions(params Params) (QueryDefinition, error) {
+	if len(q.conditions) == 0 {
+		return q, nil
+	}
+	data := map[string]bool{}
+	for _, name := range q.AllowedParams {
+		if strings.HasPrefix(name, exportPrefix) {
+			continue
+		}
+		_, supplied := params[name]
+		if !supplied && !q.Params[name].Optional {
+			return q, fmt.Errorf("%w: %s", errMissingParam, name)
+		}
+		data[name] = supplied
+	}
+	stmts := make(SQLStatements, len(q.SQL))
+	for i, tmpl := range q.conditions {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return q, fmt.Errorf("query %s: %w", q.ID, err)
+		}
+		stmts[i] = buf.String()
+	}
+
+	used := map[int]bool{}
+	for _, stmtSQL := range append([]string{q.SkipIf, q.OnlyIf, q.RollbackSQL}, stmts...) {
+		for _, t := range tokenizeSQL(stmtSQL) {
+			if n, err := strconv.Atoi(strings.TrimPrefix(t.Text, "$")); t.Kind == tokenParam && err == nil {
+				used[n] = true
+			}
+		}
+	}
+	renumbered := map[int]int{}
+	var allowed []string
+	for i, name := range q.AllowedParams {
+		if used[i+1] {
+			allowed = append(allowed, name)
+			renumbered[i+1] = len(allowed)
+		}
+	}
+	renumber := func(stmtSQL string) string {
+		var b strings.Builder
+		last := 0
+		for _, t := range tokenizeSQL(stmtSQL) {
+			n, err := strconv.Atoi(strings.TrimPrefix(t.Text, "$"))
+			if t.Kind != tokenParam || err != nil || renumbered[n] == 0 {
+				continue
+			}
+			b.WriteString(stmtSQL[last:t.Pos])
+			b.WriteString("$" + strconv.Itoa(renumbered[n]))
+			last = t.Pos + len(t.Text)
+		}
+		b.WriteString(stmtSQL[last:])
+		return b.String()
+	}
+
+	for i := range stmts {
+		stmts[i] = renumber(stmts[i])
+	}
+	q.SQL = stmts
+	q.SkipIf = renumber(q.SkipIf)
+	q.OnlyIf = renumber(q.OnlyIf)
+	q.RollbackSQL = renumber(q.RollbackSQL)
+	q.AllowedParams = allowed
+	q.conditions = nil
+	return q, nil
+}
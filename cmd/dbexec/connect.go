@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// exitConfigError is the exit status of a run that couldn't reach the
+// database with its connection settings, after every retry.
+const exitConfigError = 8
+
+// connectError reports that the preflight check failed on every attempt.
+type connectError struct {
+	Attempt  int
+	Attempts int
+	Err      error
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("failed to connect to database (attempt %d of %d): %v", e.Attempt, e.Attempts, e.Err)
+}
+
+func (e *connectError) Unwrap() error {
+	return e.Err
+}
+
+// Backoff between connection attempts: it starts at connectBackoff and
+// doubles after each failure up to connectMaxBackoff.
+const (
+	connectBackoff    = 500 * time.Millisecond
+	connectMaxBackoff = 10 * time.Second
+)
+
+// preflight checks that the database is reachable before anything runs,
+// since sql.Open doesn't connect. Failed attempts are retried up to retries
+// times with exponential backoff; each attempt is bounded by timeout (0 for
+// no limit). Progress and the server version are reported to w. When no
+// attempt succeeds, the error is a connectError.
+func preflight(ctx context.Context, db *sql.DB, retries int, timeout time.Duration, w io.Writer) error {
+	attempts := retries + 1
+	backoff := connectBackoff
+	for attempt := 1; ; attempt++ {
+		version, err := pingServer(ctx, db, timeout)
+		if err == nil {
+			fmt.Fprintf(w, "[CONNECTED] Attempt=%d/%d ServerVersion=%s\n", attempt, attempts, version)
+			return nil
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			return &connectError{Attempt: attempt, Attempts: attempts, Err: err}
+		}
+		fmt.Fprintf(w, "[CONNECT] Attempt=%d/%d failed: %v; retrying in %s\n", attempt, attempts, err, backoff)
+		select {
+		case <-ctx.Done():
+			return &connectError{Attempt: attempt, Attempts: attempts, Err: ctx.Err()}
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, connectMaxBackoff)
+	}
+}
+
+// pingServer connects to the database and returns its server version.
+func pingServer(ctx context.Context, db *sql.DB, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return "", err
+	}
+	var version string
+	if err := db.QueryRowContext(ctx, "SHOW server_version").Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to read server version: %w", err)
+	}
+	return version, nil
+}
+
+// poolOptions tunes the connection pool of a *sql.DB. The zero value of each
+// field except MaxIdleConns means no limit, as in database/sql.
+type poolOptions struct {
+	// MaxOpenConns caps the open connections (0 for no limit).
+	MaxOpenConns int
+	// MaxIdleConns caps the idle connections kept for reuse; database/sql
+	// keeps 2 by default and none when it is 0 or less.
+	MaxIdleConns int
+	// ConnMaxLifetime closes connections once they are this old (0 for no
+	// limit).
+	ConnMaxLifetime time.Duration
+}
+
+// registerPoolFlags adds --max-open-conns, --max-idle-conns and
+// --conn-max-lifetime to fs, defaulting to database/sql's defaults.
+func registerPoolFlags(fs *flag.FlagSet) *poolOptions {
+	var p poolOptions
+	fs.IntVar(&p.MaxOpenConns, "max-open-conns", 0, "Maximum number of open database connections (0 for no limit)")
+	fs.IntVar(&p.MaxIdleConns, "max-idle-conns", 2, "Maximum number of idle database connections kept for reuse (0 keeps none)")
+	fs.DurationVar(&p.ConnMaxLifetime, "conn-max-lifetime", 0, "Close database connections once they are this old (0 for no limit)")
+	return &p
+}
+
+// apply configures db's pool.
+func (p poolOptions) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	slog.Debug("connection pool configured", "max_open_conns", p.MaxOpenConns, "max_idle_conns", p.MaxIdleConns, "conn_max_lifetime", p.ConnMaxLifetime)
+}
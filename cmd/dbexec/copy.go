@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// errCopyUnsupported is returned by copyCSV when the connection's driver
+// can't read COPY output.
+var errCopyUnsupported = errors.New("COPY TO STDOUT needs the pgx driver")
+
+// supportsCopy reports whether db's driver can stream COPY output, which
+// lib/pq can't.
+func supportsCopy(db *sql.DB) bool {
+	_, ok := db.Driver().(*stdlib.Driver)
+	return ok
+}
+
+// copyable reports whether --output copy-csv can export the result of a
+// query as Postgres prints it: masked columns and the values exports and
+// assertions read need the rows scanned.
+func (opts runOptions) copyable(qdef QueryDefinition, capture *resultCapture) bool {
+	return len(opts.columnMasks(qdef)) == 0 && capture == nil
+}
+
+// copyCSV writes the result of the SELECT statement query to out as CSV with
+// a header, through COPY TO STDOUT, and returns the number of rows. COPY
+// can't take bound parameters, so args are inlined as quoted literals. NULL
+// values are written as null when it is set, and as empty fields otherwise.
+func (e txExecutor) copyCSV(ctx context.Context, query string, args []interface{}, null *string, out io.Writer) (int, error) {
+	inlined, err := inlineParams(query, args)
+	if err != nil {
+		return 0, err
+	}
+	// The line breaks keep a trailing comment from hiding the parenthesis.
+	stmt := "COPY (\n" + strings.TrimRight(strings.TrimSpace(inlined), ";") + "\n) TO STDOUT WITH (FORMAT csv, HEADER"
+	if null != nil {
+		stmt += ", NULL " + pq.QuoteLiteral(*null)
+	}
+	stmt += ")"
+
+	w := newResultWriter(out)
+	var rowCount int64
+	err = e.conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errCopyUnsupported
+		}
+		tag, err := c.Conn().PgConn().CopyTo(ctx, w, stmt)
+		rowCount = tag.RowsAffected()
+		return err
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return int(rowCount), err
+}
+
+// inlineParams replaces the positional parameters of query with args as SQL
+// literals. Every value, validated by bindParams beforehand, is quoted as a
+// string literal, which Postgres types from its context as it would a bound
+// parameter.
+func inlineParams(query string, args []interface{}) (string, error) {
+	var b strings.Builder
+	last := 0
+	for _, t := range tokenizeSQL(query) {
+		if t.Kind != tokenParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.Text[1:])
+		if err != nil || n < 1 || n > len(args) {
+			return "", fmt.Errorf("statement references %s but only %d parameters are bound", t.Text, len(args))
+		}
+		b.WriteString(query[last:t.Pos])
+		b.WriteString(sqlLiteral(args[n-1]))
+		last = t.Pos + len(t.Text)
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+// sqlLiteral returns v as a quoted SQL literal, or NULL.
+func sqlLiteral(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return pq.QuoteLiteral(val)
+	case []byte:
+		return pq.QuoteLiteral(`\x` + hex.EncodeToString(val))
+	case time.Time:
+		return pq.QuoteLiteral(val.Format(time.RFC3339Nano))
+	}
+	return pq.QuoteLiteral(fmt.Sprint(v))
+}
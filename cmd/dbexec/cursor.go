@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// resultRows is a result set being read: *sql.Rows, or cursorRows reading
+// one in batches.
+type resultRows interface {
+	Columns() ([]string, error)
+	ColumnTypes() ([]*sql.ColumnType, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// cursorName names the server-side cursor --fetch-size reads results
+// through. Only one is open at a time: each result set is closed before the
+// next statement runs.
+const cursorName = "dbexec_results"
+
+// cursorRows reads a result set through a server-side cursor, fetching
+// fetchSize rows at a time, so the client never holds more than one batch
+// however large the result is.
+type cursorRows struct {
+	ctx  context.Context
+	tx   *sql.Tx
+	size int
+	// batch holds the rows of the last FETCH, and read how many of them
+	// have been read.
+	batch  *sql.Rows
+	read   int
+	err    error
+	closed bool
+}
+
+// queryRows runs query within the transaction, through a server-side cursor
+// fetching fetchSize rows at a time when fetchSize is positive. The cursor
+// can only be used on Postgres and only for queries that don't modify data.
+func (e txExecutor) queryRows(ctx context.Context, key, query string, args []interface{}, fetchSize int) (resultRows, error) {
+	if fetchSize <= 0 {
+		return e.QueryContext(ctx, key, query, args...)
+	}
+	if _, err := e.tx.ExecContext(ctx, "DECLARE "+cursorName+" NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return nil, err
+	}
+	c := &cursorRows{ctx: ctx, tx: e.tx, size: fetchSize}
+	if err := c.fetch(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// fetch reads the next batch of rows from the cursor.
+func (c *cursorRows) fetch() error {
+	rows, err := c.tx.QueryContext(c.ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", c.size, cursorName))
+	if err != nil {
+		return fmt.Errorf("failed to fetch from cursor: %w", err)
+	}
+	c.batch, c.read = rows, 0
+	return nil
+}
+
+func (c *cursorRows) Columns() ([]string, error) {
+	return c.batch.Columns()
+}
+
+func (c *cursorRows) ColumnTypes() ([]*sql.ColumnType, error) {
+	return c.batch.ColumnTypes()
+}
+
+// Next advances to the next row, fetching another batch once the current
+// one is read. A batch shorter than fetchSize is the last.
+func (c *cursorRows) Next() bool {
+	for c.err == nil && !c.closed {
+		if c.batch.Next() {
+			c.read++
+			return true
+		}
+		if c.err = c.batch.Err(); c.err != nil || c.read < c.size {
+			return false
+		}
+		// The transaction's connection must be free before the next FETCH.
+		c.batch.Close()
+		c.err = c.fetch()
+	}
+	return false
+}
+
+func (c *cursorRows) Scan(dest ...interface{}) error {
+	return c.batch.Scan(dest...)
+}
+
+func (c *cursorRows) Err() error {
+	return c.err
+}
+
+// Close closes the current batch and the cursor. After an error that aborted
+// the transaction the cursor can't be closed, but rolling back closes it.
+func (c *cursorRows) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.batch != nil {
+		c.batch.Close()
+	}
+	_, err := c.tx.ExecContext(c.ctx, "CLOSE "+cursorName)
+	return err
+}
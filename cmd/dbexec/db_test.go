@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeResult is what the fake driver answers a statement with: a result set
+// of Columns, named by their Postgres types in Types, or, when executed, the
+// number of rows affected.
+type fakeResult struct {
+	Columns      []string
+	Types        []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+	// Generate, when set, produces the rows instead of Rows, so large result
+	// sets aren't held in memory: it fills dest with row i and reports
+	// whether there is such a row.
+	Generate func(i int, dest []driver.Value) bool
+	// Err, when set, fails the statement.
+	Err error
+}
+
+// fakeDB answers statements with canned results, so the runner can be tested
+// without Postgres. A statement without a result returns an empty result set
+// and affects no rows.
+type fakeDB struct {
+	mu       sync.Mutex
+	results  map[string]fakeResult
+	executed []string
+
+	prepares atomic.Int64
+	openRows atomic.Int64
+	// maxOpenRows, when positive, fails queries while that many result sets
+	// are open, as a connection serving one result set at a time does.
+	maxOpenRows int64
+	// connectErr, when set, fails every connection attempt.
+	connectErr error
+}
+
+// newFakeDB returns a database answering statements with results, keyed by
+// their SQL, and the fakeDB behind it.
+func newFakeDB(tb testing.TB, results map[string]fakeResult) (*sql.DB, *fakeDB) {
+	tb.Helper()
+	f := &fakeDB{results: results}
+	db := sql.OpenDB(f)
+	tb.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// statements returns the statements executed or queried so far, in order.
+func (f *fakeDB) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.executed...)
+}
+
+func (f *fakeDB) result(query string) fakeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executed = append(f.executed, query)
+	return f.results[query]
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	if f.connectErr != nil {
+		return nil, f.connectErr
+	}
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver { return fakeDriver{} }
+
+// fakeDriver only exists to satisfy driver.Connector: fake databases are
+// opened with sql.OpenDB.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("open fake databases with newFakeDB")
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.prepares.Add(1)
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res := s.db.result(s.query)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return driver.RowsAffected(res.RowsAffected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if max := s.db.maxOpenRows; max > 0 && s.db.openRows.Load() >= max {
+		return nil, errors.New("too many open result sets")
+	}
+	res := s.db.result(s.query)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	s.db.openRows.Add(1)
+	return &fakeRows{db: s.db, result: res}, nil
+}
+
+type fakeRows struct {
+	db     *fakeDB
+	result fakeResult
+	next   int
+	closed bool
+}
+
+func (r *fakeRows) Columns() []string { return r.result.Columns }
+
+func (r *fakeRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.db.openRows.Add(-1)
+	}
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	i := r.next
+	r.next++
+	if r.result.Generate != nil {
+		if !r.result.Generate(i, dest) {
+			return io.EOF
+		}
+		return nil
+	}
+	if i >= len(r.result.Rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.Rows[i])
+	return nil
+}
+
+// ColumnTypeDatabaseTypeName names the column's type as Postgres drivers do,
+// such as INT4 or _TEXT.
+func (r *fakeRows) ColumnTypeDatabaseTypeName(i int) string {
+	if i < len(r.result.Types) {
+		return r.result.Types[i]
+	}
+	return "TEXT"
+}
+
+// testPostgres connects to the database at DATABASE_URL, skipping the test
+// when it isn't set.
+func testPostgres(tb testing.TB) *sql.DB {
+	tb.Helper()
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		tb.Skip("DATABASE_URL is not set")
+	}
+	db, err := sql.Open(driverPQ, url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		tb.Fatalf("connecting to DATABASE_URL: %v", err)
+	}
+	return db
+}
+
+// loadTestQueries replaces the loaded queries and runbooks with those of
+// catalog, a definitions file.
+func loadTestQueries(tb testing.TB, catalog string) {
+	tb.Helper()
+	queries = map[string]QueryDefinition{}
+	queryOrder = nil
+	runbooks = map[string][]RunbookStep{}
+	runbookLocks = map[string]string{}
+	runbookOrder = nil
+	path := filepath.Join(tb.TempDir(), "queries.yaml")
+	if err := os.WriteFile(path, []byte(catalog), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	if err := loadQueriesFromYAML(nil, path); err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "io/fs"
+
+// embeddedQueriesFile is the name of the query catalog in embeddedQueries.
+const embeddedQueriesFile = "queries.yaml"
+
+// embeddedQueries holds the query catalog compiled into the binary when it is
+// built with the embedqueries tag, or nil. An embedded catalog is always used
+// instead of a file on disk.
+var embeddedQueries fs.FS
+
+// requireEmbeddedQueries is set by --embedded-queries to refuse loading the
+// catalog from disk.
+var requireEmbeddedQueries bool
@@ -0,0 +1,15 @@
+//go:build embedqueries
+
+package main
+
+import "embed"
+
+// Build with -tags embedqueries after copying the catalog to
+// cmd/dbexec/queries.yaml (see make build-embedded).
+//
+//go:embed queries.yaml
+var embeddedCatalog embed.FS
+
+func init() {
+	embeddedQueries = embeddedCatalog
+}
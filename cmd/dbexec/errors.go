@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// Exit statuses of CLI runs that failed for a reason scripts may want to
+// tell apart; other failures exit with status 1.
+const (
+	exitInvalidRequest   = 5 // unknown query or a missing or invalid parameter
+	exitRowLimitExceeded = 6 // max_rows_affected or --max-total-rows exceeded
+	exitExecutionFailed  = 7 // a statement failed in the database or was interrupted
+)
+
+// Errors for invalid requests, matched with errors.Is.
+var (
+	errUnknownQuery = errors.New("unknown query ID")
+	errMissingParam = errors.New("missing parameter")
+	errInvalidParam = errors.New("invalid parameter")
+)
+
+// Scopes of a rowLimitError.
+const (
+	limitStatement = ""          // max_rows_affected of a statement
+	limitTotal     = "total"     // max_rows_affected with max_rows_scope: total
+	limitAggregate = "aggregate" // --max-total-rows of a --foreach-csv run
+	limitMinimum   = "minimum"   // min_rows_affected, with Actual below Limit
+)
+
+// rowLimitError reports rows affected beyond a limit, or short of the
+// minimum for limitMinimum.
+type rowLimitError struct {
+	QueryID string
+	Scope   string
+	Limit   int64
+	Actual  int64
+}
+
+func (e *rowLimitError) Error() string {
+	switch e.Scope {
+	case limitTotal:
+		return fmt.Sprintf("exceeded total row limit for %s: %d > %d", e.QueryID, e.Actual, e.Limit)
+	case limitAggregate:
+		return fmt.Sprintf("exceeded aggregate row limit: %d > %d", e.Actual, e.Limit)
+	case limitMinimum:
+		return fmt.Sprintf("too few rows affected by %s: %d < %d", e.QueryID, e.Actual, e.Limit)
+	}
+	return fmt.Sprintf("exceeded row limit for %s: %d > %d", e.QueryID, e.Actual, e.Limit)
+}
+
+// executionError reports a statement that failed in the database or was
+// interrupted. QueryID is the statement's label.
+type executionError struct {
+	QueryID string
+	Message string
+	Err     error
+}
+
+func (e *executionError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *executionError) Unwrap() error {
+	return e.Err
+}
+
+// exitCode returns the exit status of a CLI run that failed with err.
+func exitCode(err error) int {
+	var assertErr *assertionError
+	var permErr *permissionError
+	var limitErr *rowLimitError
+	var execErr *executionError
+	var connErr *connectError
+	switch {
+	case errors.As(err, &assertErr):
+		return exitAssertionFailed
+	case errors.As(err, &permErr):
+		return exitPermissionDenied
+	case errors.Is(err, errUnknownQuery), errors.Is(err, errMissingParam), errors.Is(err, errInvalidParam):
+		return exitInvalidRequest
+	case errors.As(err, &limitErr):
+		return exitRowLimitExceeded
+	case errors.As(err, &execErr):
+		return exitExecutionFailed
+	case errors.As(err, &connErr):
+		return exitConfigError
+	}
+	return 1
+}
+
+// Postgres SQLSTATE codes that statementError reports specially.
+const (
+	sqlStateQueryCanceled    = "57014" // statement_timeout or pg_cancel_backend
+	sqlStateLockNotAvailable = "55P03" // lock_timeout or NOWAIT
+	sqlStateIdleInTxnTimeout = "25P03" // idle_in_transaction_session_timeout
+)
+
+// sqlState returns the SQLSTATE code of a Postgres error returned by either
+// driver, or "" if err isn't one.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// statementError describes err, returned while running label, as a failure of
+// action (e.g. "execution error"). Deadlines, cancellations and server-side
+// timeouts are reported as such, so a slow statement isn't mistaken for a
+// wrong one; runQueriesInTransaction adds which deadline expired.
+func statementError(ctx context.Context, action, label string, err error) error {
+	e := &executionError{QueryID: label, Message: fmt.Sprintf("%s for %s", action, label), Err: err}
+	switch {
+	case ctx.Err() != nil, errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		e.Message = label + " interrupted"
+		return e
+	}
+	switch sqlState(err) {
+	case sqlStateQueryCanceled:
+		e.Message = label + " was canceled by the server (statement_timeout or an administrator)"
+	case sqlStateLockNotAvailable:
+		e.Message = label + " could not acquire a lock in time (lock_timeout)"
+	case sqlStateIdleInTxnTimeout:
+		e.Message = label + " failed because the server ended the idle transaction"
+	}
+	return e
+}
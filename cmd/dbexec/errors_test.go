@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const errorsCatalog = `
+- id: user_by_id
+  sql: SELECT name FROM users WHERE id = $1
+  allowed_params: [user_id]
+  params:
+    user_id: {type: integer}
+- id: deactivate_users
+  sql: UPDATE users SET active = false WHERE team = $1
+  allowed_params: [team]
+  max_rows_affected: 1
+- id: broken
+  sql: SELECT broken()
+- id: admin_only
+  sql: SELECT 1
+  required_role: admin
+- id: one_user
+  sql: SELECT name FROM users LIMIT 1
+  expect:
+    row_count: 2
+`
+
+func TestTypedErrors(t *testing.T) {
+	loadTestQueries(t, errorsCatalog)
+	failure := errors.New("function broken() does not exist")
+	db, _ := newFakeDB(t, map[string]fakeResult{
+		"UPDATE users SET active = false WHERE team = $1": {RowsAffected: 5},
+		"SELECT broken()":                {Err: failure},
+		"SELECT name FROM users LIMIT 1": {Columns: []string{"name"}, Rows: [][]driver.Value{{"ada"}}},
+	})
+
+	tests := []struct {
+		name   string
+		ids    []string
+		params Params
+		role   string
+		check  func(error) bool
+		code   int
+	}{
+		{"unknown query", []string{"no_such_query"}, Params{}, "", is(errUnknownQuery), exitInvalidRequest},
+		{"missing param", []string{"user_by_id"}, Params{}, "", is(errMissingParam), exitInvalidRequest},
+		{"invalid param", []string{"user_by_id"}, Params{"user_id": {Value: "ten"}}, "", is(errInvalidParam), exitInvalidRequest},
+		{"row limit", []string{"deactivate_users"}, Params{"team": {Value: "ops"}}, "", func(err error) bool {
+			var e *rowLimitError
+			return errors.As(err, &e) && e.QueryID == "deactivate_users" && e.Limit == 1 && e.Actual == 5
+		}, exitRowLimitExceeded},
+		{"execution", []string{"broken"}, Params{}, "", func(err error) bool {
+			var e *executionError
+			return errors.As(err, &e) && e.QueryID == "broken" && errors.Is(err, failure)
+		}, exitExecutionFailed},
+		{"permission", []string{"admin_only"}, Params{}, "analyst", func(err error) bool {
+			var e *permissionError
+			return errors.As(err, &e) && e.Role == "analyst" && e.Required == "admin"
+		}, exitPermissionDenied},
+		{"assertion", []string{"one_user"}, Params{}, "", func(err error) bool {
+			var e *assertionError
+			return errors.As(err, &e) && e.QueryID == "one_user"
+		}, exitAssertionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runQueriesInTransaction(context.Background(), db, tt.ids, tt.params, runOptions{Out: io.Discard, Diag: io.Discard, Role: tt.role, Approve: true})
+			if err == nil {
+				t.Fatal("run succeeded")
+			}
+			if !tt.check(err) {
+				t.Errorf("unexpected error %T: %v", err, err)
+			}
+			if code := exitCode(err); code != tt.code {
+				t.Errorf("exitCode = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func is(target error) func(error) bool {
+	return func(err error) bool { return errors.Is(err, target) }
+}
+
+func TestConnectFailureExitCode(t *testing.T) {
+	db, fake := newFakeDB(t, map[string]fakeResult{
+		"SHOW server_version": {Columns: []string{"server_version"}, Rows: [][]driver.Value{{"16.4"}}},
+	})
+	refused := errors.New("connection refused")
+	fake.connectErr = refused
+
+	err := preflight(context.Background(), db, 1, 0, io.Discard)
+	var connErr *connectError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("got %T: %v, want a connectError", err, err)
+	}
+	if connErr.Attempt != 2 || connErr.Attempts != 2 || !errors.Is(err, refused) {
+		t.Errorf("got %+v", connErr)
+	}
+	// Runs against several targets name the target that failed.
+	if code := exitCode(fmt.Errorf("shard1: %w", err)); code != exitConfigError {
+		t.Errorf("exitCode = %d, want %d", code, exitConfigError)
+	}
+
+	fake.connectErr = nil
+	var out strings.Builder
+	if err := preflight(context.Background(), db, 0, 0, &out); err != nil {
+		t.Fatalf("preflight after the database came back: %v", err)
+	}
+	if want := "[CONNECTED] Attempt=1/1 ServerVersion=16.4\n"; out.String() != want {
+		t.Errorf("preflight reported %q, want %q", out.String(), want)
+	}
+}
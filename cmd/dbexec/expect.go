@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// exitAssertionFailed is the exit status of a run that failed only because a
+// query's result violated its expect block.
+const exitAssertionFailed = 3
+
+// Expectation asserts on the result of a query's last statement, which must
+// be a SELECT.
+type Expectation struct {
+	// RowCount, when set, is the exact number of rows expected.
+	RowCount *int `yaml:"row_count" json:"row_count,omitempty"`
+	// Value, when set, checks a column of the first row.
+	Value *ExpectedValue `yaml:"value" json:"value,omitempty"`
+}
+
+// ExpectedValue asserts that a column of the first row equals a value. An
+// equals of null expects SQL NULL.
+type ExpectedValue struct {
+	Column string      `yaml:"column" json:"column"`
+	Equals interface{} `yaml:"equals" json:"equals"`
+}
+
+// assertionError reports a result that violated a query's expectation.
+type assertionError struct {
+	QueryID string
+	Message string
+}
+
+func (e *assertionError) Error() string {
+	return fmt.Sprintf("assertion failed for %s: %s", e.QueryID, e.Message)
+}
+
+// validateExpect checks that a query with an expect block ends in a SELECT.
+func validateExpect(q QueryDefinition) error {
+	if q.Expect == nil {
+		return nil
+	}
+	if q.Expect.RowCount == nil && q.Expect.Value == nil {
+		return fmt.Errorf("query %s: expect must set row_count or value", q.ID)
+	}
+	if q.Expect.Value != nil && q.Expect.Value.Column == "" {
+		return fmt.Errorf("query %s: expect value must name a column", q.ID)
+	}
+	if statementType(q.SQL[len(q.SQL)-1]) != "SELECT" {
+		return fmt.Errorf("query %s: expect requires the last statement to be a SELECT", q.ID)
+	}
+	return nil
+}
+
+// checkExpect compares the captured result with the expectation.
+func (c *resultCapture) checkExpect(e *Expectation) error {
+	if e == nil {
+		return nil
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if e.RowCount != nil && c.rows != *e.RowCount {
+		return &assertionError{c.queryID, fmt.Sprintf("expected %d rows, got %d", *e.RowCount, c.rows)}
+	}
+	if e.Value != nil {
+		values := c.values[e.Value.Column]
+		if len(values) == 0 {
+			return &assertionError{c.queryID, fmt.Sprintf("expected %s = %v, but the query returned no rows", e.Value.Column, expectedString(e.Value.Equals))}
+		}
+		if !valuesEqual(values[0], e.Value.Equals) {
+			return &assertionError{c.queryID, fmt.Sprintf("expected %s = %s, got %s", e.Value.Column, expectedString(e.Value.Equals), c.describe(e.Value.Column, values[0]))}
+		}
+	}
+	return nil
+}
+
+// valuesEqual compares a scanned column value with an expected YAML value.
+// Numbers are compared numerically, times as instants when an RFC 3339 time
+// is expected, and everything else by its display form.
+func valuesEqual(actual, expected interface{}) bool {
+	if actual == nil || expected == nil {
+		return actual == nil && expected == nil
+	}
+	if t, ok := actual.(time.Time); ok {
+		return timeEqual(t, expected)
+	}
+	a, e := formatValue(actual), fmt.Sprint(expected)
+	if af, err := strconv.ParseFloat(a, 64); err == nil {
+		if ef, err := strconv.ParseFloat(e, 64); err == nil {
+			return af == ef
+		}
+	}
+	return a == e
+}
+
+// timeEqual compares a scanned time with an expected YAML value, so --tz
+// doesn't change the outcome: an RFC 3339 time must be the same instant, and
+// any other value must read as the time does without a zone, such as
+// 2024-06-01 13:30:00.
+func timeEqual(actual time.Time, expected interface{}) bool {
+	if e, ok := expected.(time.Time); ok {
+		return actual.Equal(e)
+	}
+	s := fmt.Sprint(expected)
+	if e, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return actual.Equal(e)
+	}
+	return s == actual.Format(time.DateTime)
+}
+
+// expectedString renders an expected value for messages.
+func expectedString(v interface{}) string {
+	if v == nil {
+		return "<NULL>"
+	}
+	return fmt.Sprint(v)
+}
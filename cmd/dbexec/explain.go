@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// Explain modes selected with --explain.
+const (
+	explainOff     = ""
+	explainPlan    = "plan"
+	explainAnalyze = "analyze"
+)
+
+// explainFlag is the value of --explain. It can be given without a value to
+// show plans or as --explain=analyze to also execute and time the statements.
+type explainFlag string
+
+func (f *explainFlag) String() string { return string(*f) }
+
+// IsBoolFlag lets --explain be passed without a value.
+func (f *explainFlag) IsBoolFlag() bool { return true }
+
+func (f *explainFlag) Set(v string) error {
+	switch strings.ToLower(v) {
+	case "true", explainPlan:
+		*f = explainPlan
+	case "false":
+		*f = explainOff
+	case explainAnalyze:
+		*f = explainAnalyze
+	default:
+		return fmt.Errorf("must be plan or analyze")
+	}
+	return nil
+}
+
+// explain returns the text plan of a statement with its bound arguments.
+// With analyze, the statement is executed inside a savepoint that is rolled
+// back afterwards so later statements and previews see unchanged data.
+func (e txExecutor) explain(ctx context.Context, query string, args []interface{}, analyze bool) (string, error) {
+	if !analyze {
+		return e.queryPlan(ctx, "EXPLAIN (FORMAT TEXT) "+query, args)
+	}
+	var plan string
+	err := e.rolledBack(ctx, "dbexec_explain", func() (err error) {
+		plan, err = e.queryPlan(ctx, "EXPLAIN (ANALYZE, FORMAT TEXT) "+query, args)
+		return err
+	})
+	return plan, err
+}
+
+// queryPlan runs an EXPLAIN statement and joins its output lines.
+func (e txExecutor) queryPlan(ctx context.Context, query string, args []interface{}) (string, error) {
+	rows, err := e.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+// planCost returns the planner's estimated total cost of a statement together
+// with its JSON plan.
+func (e txExecutor) planCost(ctx context.Context, query string, args []interface{}) (float64, string, error) {
+	plan, err := e.queryPlan(ctx, "EXPLAIN (FORMAT JSON) "+query, args)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var parsed []struct {
+		Plan struct {
+			TotalCost float64 `json:"Total Cost"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &parsed); err != nil || len(parsed) == 0 {
+		return 0, plan, fmt.Errorf("could not read plan cost: %v", err)
+	}
+	return parsed[0].Plan.TotalCost, plan, nil
+}
+
+// isPostgres reports whether db uses a Postgres driver, which plan-based
+// checks depend on.
+func isPostgres(db *sql.DB) bool {
+	switch db.Driver().(type) {
+	case *pq.Driver, *stdlib.Driver:
+		return true
+	}
+	return false
+}
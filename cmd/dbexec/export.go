@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// exportPrefix marks an allowed parameter whose value is exported by an
+// earlier query of the run rather than supplied with the run's params.
+const exportPrefix = "@"
+
+// ExportDefinition names the variable a result column is exported as. Array
+// exports collect the column of every row; other exports require exactly one
+// row.
+type ExportDefinition struct {
+	As    string `yaml:"as" json:"as"`
+	Array bool   `yaml:"array" json:"array,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare variable name or a mapping with as and
+// array.
+func (e *ExportDefinition) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*e = ExportDefinition{As: value.Value}
+		return nil
+	}
+	type plain ExportDefinition
+	return value.Decode((*plain)(e))
+}
+
+// validateExports checks a query's export declarations.
+func validateExports(q QueryDefinition) error {
+	for column, e := range q.Exports {
+		if e.As == "" || strings.HasPrefix(e.As, exportPrefix) {
+			return fmt.Errorf("query %s: export of column %s must name a variable without %s", q.ID, column, exportPrefix)
+		}
+	}
+	return nil
+}
+
+// exportedParams lists the variables a query references with the @ prefix.
+func (q QueryDefinition) exportedParams() []string {
+	var names []string
+	for _, p := range q.AllowedParams {
+		if name, ok := strings.CutPrefix(p, exportPrefix); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// storeExports checks the captured rows against the query's exports and adds
+// the exported values to vars. Array exports are bound as Postgres arrays.
+func (c *resultCapture) storeExports(exports map[string]ExportDefinition, vars map[string]interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	for column, e := range exports {
+		if e.Array {
+			vars[e.As] = pq.Array(append([]interface{}{}, c.values[column]...))
+			continue
+		}
+		if c.rows != 1 {
+			return fmt.Errorf("query %s exports %s from a single row but returned %d rows (declare the export with array: true to collect every row)", c.queryID, e.As, c.rows)
+		}
+		vars[e.As] = c.values[column][0]
+	}
+	return nil
+}
+
+// describeExports renders the exported values for output, e.g. "tenant_id=42".
+func (c *resultCapture) describeExports(exports map[string]ExportDefinition) string {
+	var parts []string
+	for column, e := range exports {
+		if e.Array {
+			parts = append(parts, fmt.Sprintf("%s=[%d values]", e.As, len(c.values[column])))
+		} else if len(c.values[column]) > 0 {
+			parts = append(parts, e.As+"="+c.describe(column, c.values[column][0]))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// queryExports runs a write statement that returns rows (via RETURNING) and
+// records them in capture, returning the number of rows returned.
+func (e txExecutor) queryExports(ctx context.Context, key, query string, args []interface{}, capture *resultCapture) (int64, error) {
+	rows, err := e.QueryContext(ctx, key, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values, scanArgs := scanRow(len(columns))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return n, err
+		}
+		capture.row(columns, values)
+		n++
+	}
+	return n, rows.Err()
+}
+
+// dryRunExports executes a write statement inside a savepoint that is rolled
+// back, so a dry run can still bind its exports in later queries. It does
+// nothing when capture is nil.
+func (e txExecutor) dryRunExports(ctx context.Context, key, query string, args []interface{}, capture *resultCapture) error {
+	if capture == nil {
+		return nil
+	}
+	return e.rolledBack(ctx, "dbexec_export", func() error {
+		_, err := e.queryExports(ctx, key, query, args, capture)
+		return err
+	})
+}
+
+// rolledBack runs fn inside a savepoint that is rolled back afterwards, so
+// its changes are invisible to the rest of the transaction.
+func (e txExecutor) rolledBack(ctx context.Context, name string, fn func() error) error {
+	if _, err := e.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	err := fn()
+	if _, rerr := e.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// exportedValue returns the value bound for an @-prefixed parameter.
+func exportedValue(vars map[string]interface{}, param string) (interface{}, error) {
+	name := strings.TrimPrefix(param, exportPrefix)
+	v, ok := vars[name]
+	if !ok {
+		return nil, fmt.Errorf("parameter %s has not been exported by an earlier query", param)
+	}
+	return v, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// What a fanned-out run does with the remaining targets once one fails.
+const (
+	onErrorStop     = "stop"
+	onErrorContinue = "continue"
+)
+
+// Outcomes of a target in a fanned-out run.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+	outcomeSkipped = "skipped"
+)
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// fanoutTarget is one of the databases a run is fanned out to.
+type fanoutTarget struct {
+	// Name identifies the target in output and the audit log: the target's
+	// name, or the host and database of a --db-url.
+	Name string
+	// Target is the connection profile, checked against each query's
+	// targets; it is empty for a --db-url.
+	Target string
+	URL    string
+}
+
+// fanoutTargets resolves the databases a run goes to: the named targets or
+// the connection strings given with --db-url, not both.
+func fanoutTargets(targets, dbURLs []string) ([]fanoutTarget, error) {
+	if len(targets) > 0 && len(dbURLs) > 0 {
+		return nil, fmt.Errorf("--db-url cannot be combined with --target")
+	}
+	var list []fanoutTarget
+	for _, name := range targets {
+		dbURL, err := databaseURL(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, fanoutTarget{Name: name, Target: name, URL: dbURL})
+	}
+	for i, dbURL := range dbURLs {
+		list = append(list, fanoutTarget{Name: describeURL(dbURL, i), URL: dbURL})
+	}
+	return list, nil
+}
+
+// describeURL names a connection string by its host and database, leaving
+// out credentials. Strings that aren't URLs are named by their position.
+func describeURL(dbURL string, i int) string {
+	if u, err := url.Parse(dbURL); err == nil && u.Host != "" {
+		return u.Host + u.Path
+	}
+	return fmt.Sprintf("db-url-%d", i+1)
+}
+
+// fanoutResult is the outcome of a fanned-out run on one target.
+type fanoutResult struct {
+	Target  string `json:"target"`
+	Outcome string `json:"outcome"`
+	Rows    int64  `json:"rows"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runFanout calls run for each target, each in its own transaction, with at
+// most workers running at once. Targets start in order; with stopOnError no
+// target starts after one has failed, and the rest are reported as skipped.
+// Each target's output is spooled to a temporary file and written in target
+// order as soon as it and the targets before it have finished. The run fails
+// if any target failed. If writing a target's output fails, the targets still
+// running are canceled and no more start.
+func runFanout(ctx context.Context, targets []fanoutTarget, workers int, stopOnError bool, opts runOptions, run func(context.Context, fanoutTarget, runOptions) (*runSummary, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type state struct {
+		out     *spoolFile
+		diag    bytes.Buffer
+		summary *runSummary
+		err     error
+		skipped bool
+		done    chan struct{}
+	}
+	states := make([]state, len(targets))
+	for i := range states {
+		states[i].done = make(chan struct{})
+	}
+	next := make(chan int)
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	// However runFanout returns, stop the workers and remove the spool
+	// files of the targets whose output wasn't written.
+	defer func() {
+		cancel()
+		wg.Wait()
+		for i := range states {
+			if states[i].out != nil {
+				states[i].out.Close()
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				st := &states[i]
+				if ctx.Err() != nil || stopOnError && failed.Load() {
+					st.skipped = true
+					close(st.done)
+					continue
+				}
+				if st.out, st.err = newSpoolFile(); st.err != nil {
+					failed.Store(true)
+					close(st.done)
+					continue
+				}
+				runOpts := opts
+				runOpts.Out = st.out
+				runOpts.Diag = &st.diag
+				runOpts.OmitSummary = true
+				if opts.Heartbeat != nil && workers > 1 {
+					// Spinners of concurrent statements would overwrite each
+					// other's line.
+					hb := *opts.Heartbeat
+					hb.TTY = false
+					runOpts.Heartbeat = &hb
+				}
+				st.summary, st.err = run(ctx, targets[i], runOpts)
+				if st.err != nil {
+					failed.Store(true)
+				}
+				close(st.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(next)
+		for i := range targets {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				states[i].skipped = true
+				close(states[i].done)
+			}
+		}
+	}()
+
+	diag := opts.diagnostics()
+	results := make([]fanoutResult, len(targets))
+	var firstErr error
+	failures := 0
+	for i, t := range targets {
+		st := &states[i]
+		<-st.done
+		res := fanoutResult{Target: t.Name, Outcome: outcomeSuccess}
+		switch {
+		case st.skipped:
+			res.Outcome = outcomeSkipped
+		case st.err != nil:
+			res.Outcome = outcomeError
+			res.Error = st.err.Error()
+			failures++
+			if firstErr == nil {
+				firstErr = st.err
+			}
+		}
+		if st.summary != nil {
+			for _, stmt := range st.summary.Statements {
+				res.Rows += stmt.Rows
+			}
+		}
+		results[i] = res
+
+		if st.skipped {
+			continue
+		}
+		fmt.Fprintf(diag, "===== Target=%s =====\n", t.Name)
+		st.diag.WriteTo(diag)
+		if st.out == nil {
+			continue
+		}
+		err := writeSpooled(opts, res, st.summary, st.out)
+		st.out.Close()
+		st.out = nil
+		if err != nil {
+			return fmt.Errorf("failed to write output of %s: %w", t.Name, err)
+		}
+	}
+
+	for _, res := range results {
+		line := fmt.Sprintf("[FANOUT] Target=%s Outcome=%s Rows=%d", res.Target, res.Outcome, res.Rows)
+		if res.Error != "" {
+			line += " Error=" + res.Error
+		}
+		fmt.Fprintln(diag, line)
+	}
+	if opts.Format == formatJSON {
+		if err := json.NewEncoder(opts.Out).Encode(struct {
+			Fanout []fanoutResult `json:"fanout"`
+		}{results}); err != nil {
+			return fmt.Errorf("failed to write summary: %w", err)
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d targets failed, first: %w", failures, len(targets), firstErr)
+	}
+	return nil
+}
+
+// writeSpooled writes a target's spooled output to opts.Out, in JSON output
+// nested in the target's line by writeFanoutJSON.
+func writeSpooled(opts runOptions, res fanoutResult, summary *runSummary, out *spoolFile) error {
+	r, err := out.reader()
+	if err != nil {
+		return err
+	}
+	if opts.Format == formatJSON {
+		return writeFanoutJSON(opts.Out, res, summary, r)
+	}
+	_, err = io.Copy(opts.Out, r)
+	return err
+}
+
+// writeFanoutJSON writes one target's run as a single JSON line nesting its
+// result sets, which r holds one per line, and its summary. Result sets are
+// copied as they are read, so none is held in memory.
+func writeFanoutJSON(w io.Writer, res fanoutResult, summary *runSummary, r io.Reader) error {
+	head, err := json.Marshal(struct {
+		Target  string `json:"target"`
+		Outcome string `json:"outcome"`
+		Error   string `json:"error,omitempty"`
+	}{res.Target, res.Outcome, res.Error})
+	if err != nil {
+		return err
+	}
+	tail, err := json.Marshal(struct {
+		Summary *runSummary `json:"summary,omitempty"`
+	}{summary})
+	if err != nil {
+		return err
+	}
+
+	out := newResultWriter(w)
+	// Reopen the head object so the result sets can be appended.
+	out.Write(head[:len(head)-1])
+	out.WriteString(`,"results":[`)
+	in := bufio.NewReaderSize(r, resultBufferSize)
+	// midLine is set while a result set longer than the buffer is copied.
+	first, midLine := true, false
+	for {
+		chunk, err := in.ReadSlice('\n')
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return err
+		}
+		if !midLine {
+			chunk = bytes.TrimLeft(chunk, " \t\r\n")
+			if len(chunk) > 0 && !first {
+				out.WriteString(",")
+			}
+			first = first && len(chunk) == 0
+		}
+		midLine = err == bufio.ErrBufferFull
+		if !midLine {
+			chunk = bytes.TrimRight(chunk, " \t\r\n")
+		}
+		out.Write(chunk)
+		if err == io.EOF {
+			break
+		}
+	}
+	// Close the results array and continue the object with the summary.
+	out.WriteString("]")
+	if len(tail) > 2 {
+		out.WriteString(",")
+		out.Write(tail[1:])
+	} else {
+		out.WriteString("}")
+	}
+	out.WriteString("\n")
+	return out.Flush()
+}
+
+// announceFanout prints the targets a run is fanned out to. Executing against
+// production targets must be confirmed by listing each of them in confirm,
+// a comma-separated list.
+func announceFanout(w io.Writer, targets []fanoutTarget, approve bool, confirm string) error {
+	for _, t := range targets {
+		if t.Target == "" {
+			fmt.Fprintf(w, "[TARGET] %s\n", t.Name)
+			continue
+		}
+		if err := announceTarget(w, t.Target, approve, confirm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// validateGuards checks that a query's skip_if and only_if guards are SELECT
+// statements that only reference the query's parameters.
+func validateGuards(q QueryDefinition) error {
+	for name, guard := range map[string]string{"skip_if": q.SkipIf, "only_if": q.OnlyIf} {
+		if guard == "" {
+			continue
+		}
+		if statementType(guard) != "SELECT" {
+			return fmt.Errorf("query %s: %s must be a SELECT statement", q.ID, name)
+		}
+		if n := placeholderCount(guard); n > len(q.AllowedParams) {
+			return fmt.Errorf("query %s: %s references $%d but only %d parameters are allowed", q.ID, name, n, len(q.AllowedParams))
+		}
+	}
+	return nil
+}
+
+// skipReason evaluates the guards of q with its bound arguments and returns
+// why the query should be skipped, or "" if it should run. only_if is checked
+// first so skip_if can rely on what it established.
+func (e txExecutor) skipReason(ctx context.Context, q QueryDefinition, args []interface{}) (string, error) {
+	if q.OnlyIf != "" {
+		holds, err := e.guardHolds(ctx, q.ID+":only_if", q.OnlyIf, args)
+		if err != nil {
+			return "", fmt.Errorf("only_if: %w", err)
+		}
+		if !holds {
+			return "only_if did not match", nil
+		}
+	}
+	if q.SkipIf != "" {
+		holds, err := e.guardHolds(ctx, q.ID+":skip_if", q.SkipIf, args)
+		if err != nil {
+			return "", fmt.Errorf("skip_if: %w", err)
+		}
+		if holds {
+			return "skip_if matched", nil
+		}
+	}
+	return "", nil
+}
+
+// guardHolds runs a guard query and reports whether it returned a row whose
+// first column is neither false nor NULL.
+func (e txExecutor) guardHolds(ctx context.Context, key, query string, args []interface{}) (bool, error) {
+	rows, err := e.QueryContext(ctx, key, query, args[:placeholderCount(query)]...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return false, err
+	}
+	values, scanArgs := scanRow(len(columns))
+	if err := rows.Scan(scanArgs...); err != nil {
+		return false, err
+	}
+	if len(values) == 0 {
+		return true, nil
+	}
+	switch v := values[0].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return true, nil
+}
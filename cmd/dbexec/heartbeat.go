@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// spinnerFrames are drawn in turn while a statement runs on a terminal.
+var spinnerFrames = []string{"|", "/", "-", `\`}
+
+// heartbeat reports that a long-running statement is still executing.
+type heartbeat struct {
+	// W receives progress output. It should be stderr or a log, never the
+	// writer carrying results.
+	W io.Writer
+	// Interval is how long a statement runs before the first report and the
+	// time between line reports.
+	Interval time.Duration
+	// TTY draws a spinner that redraws one line instead of printing lines.
+	TTY bool
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// start begins reporting progress for the statement labeled label. The
+// returned function stops reporting and must be called once the statement
+// returns. A nil heartbeat reports nothing.
+func (h *heartbeat) start(label string) (stop func()) {
+	if h == nil || h.W == nil || h.Interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	began := time.Now()
+	go func() {
+		defer close(finished)
+
+		// Stay quiet for statements that finish within the first interval.
+		select {
+		case <-done:
+			return
+		case <-time.After(h.Interval):
+		}
+
+		if h.TTY {
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+			for frame := 0; ; frame++ {
+				elapsed := time.Since(began).Truncate(time.Second)
+				fmt.Fprintf(h.W, "\r%s QueryID=%s running for %s\033[K", spinnerFrames[frame%len(spinnerFrames)], label, elapsed)
+				select {
+				case <-done:
+					fmt.Fprint(h.W, "\r\033[K")
+					return
+				case <-ticker.C:
+				}
+			}
+		}
+
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			fmt.Fprintf(h.W, "[RUNNING] QueryID=%s Elapsed=%s\n", label, time.Since(began).Truncate(time.Second))
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
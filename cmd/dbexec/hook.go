@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// postCommitTimeout bounds each post_commit hook, so a hung webhook can't
+// keep the run from finishing.
+const postCommitTimeout = 10 * time.Second
+
+// PostCommitHook is a side effect triggered once a run has committed: an
+// HTTP POST to URL, or Command run by sh, receiving the run's summary as
+// JSON.
+type PostCommitHook struct {
+	URL     string `yaml:"url" json:"url,omitempty"`
+	Command string `yaml:"command" json:"command,omitempty"`
+}
+
+// validate checks that the hook has exactly one of a URL and a command.
+func (h PostCommitHook) validate() error {
+	if (h.URL == "") == (strings.TrimSpace(h.Command) == "") {
+		return errors.New("needs exactly one of url and command")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// String names the hook in output and logs. A URL is shown without its path
+// and query, which often hold a secret, as in Slack webhook URLs.
+func (h PostCommitHook) String() string {
+	if h.URL != "" {
+		u, _ := url.Parse(h.URL)
+		return u.Scheme + "://" + u.Host
+	}
+	return h.Command
+}
+
+// validatePostCommit checks a query's post_commit hook.
+func validatePostCommit(q QueryDefinition) error {
+	if q.PostCommit == nil {
+		return nil
+	}
+	if err := q.PostCommit.validate(); err != nil {
+		return fmt.Errorf("query %s: post_commit %v", q.ID, err)
+	}
+	return nil
+}
+
+// postCommitOptions holds the hooks fired after every committed run, whatever
+// its queries.
+type postCommitOptions struct {
+	URL     string
+	Command string
+}
+
+// registerPostCommitFlags adds --post-commit-url and --post-commit-command to
+// fs, defaulting to DBEXEC_POST_COMMIT_URL and DBEXEC_POST_COMMIT_COMMAND.
+func registerPostCommitFlags(fs *flag.FlagSet) *postCommitOptions {
+	var p postCommitOptions
+	fs.StringVar(&p.URL, "post-commit-url", os.Getenv("DBEXEC_POST_COMMIT_URL"), "POST the summary of every committed run as JSON to this URL")
+	fs.StringVar(&p.Command, "post-commit-command", os.Getenv("DBEXEC_POST_COMMIT_COMMAND"), "Run this shell command after every committed run, with its summary as JSON on stdin")
+	return &p
+}
+
+// hooks returns the configured hooks, URL first.
+func (p postCommitOptions) hooks() ([]PostCommitHook, error) {
+	var hooks []PostCommitHook
+	if p.URL != "" {
+		h := PostCommitHook{URL: p.URL}
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("--post-commit-url: %v", err)
+		}
+		hooks = append(hooks, h)
+	}
+	if strings.TrimSpace(p.Command) != "" {
+		hooks = append(hooks, PostCommitHook{Command: p.Command})
+	}
+	return hooks, nil
+}
+
+// postCommitPayload is the JSON a post_commit hook receives. Text is a line
+// describing the run, which Slack incoming webhooks post as the message.
+type postCommitPayload struct {
+	Text string `json:"text"`
+	// QueryID is the query declaring the hook, empty for the run's global
+	// hooks.
+	QueryID string      `json:"query_id,omitempty"`
+	Queries []string    `json:"queries"`
+	Summary *runSummary `json:"summary"`
+}
+
+// runPostCommitHooks fires the post_commit hooks of the queries ids, once per
+// query declaring one, then the run's global hooks, after the run committed
+// with summary. They run one at a time, each for at most postCommitTimeout.
+// A failing hook is logged and reported, but nothing is undone: the
+// transaction is already committed.
+func runPostCommitHooks(ctx context.Context, out io.Writer, ids []string, global []PostCommitHook, summary *runSummary) {
+	type firing struct {
+		queryID string
+		hook    PostCommitHook
+	}
+	var firings []firing
+	var queryIDs []string
+	seen := map[string]bool{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		queryIDs = append(queryIDs, id)
+		if qdef, ok := queries[id]; ok && qdef.PostCommit != nil {
+			firings = append(firings, firing{id, *qdef.PostCommit})
+		}
+	}
+	for _, h := range global {
+		firings = append(firings, firing{"", h})
+	}
+	if len(firings) == 0 {
+		return
+	}
+
+	text := fmt.Sprintf("dbexec run %s committed %s", summary.RunID, strings.Join(queryIDs, ", "))
+	if summary.Target != "" {
+		text += " on " + summary.Target
+	}
+	// The run's deadlines no longer apply once it has committed.
+	ctx = context.WithoutCancel(ctx)
+	for _, f := range firings {
+		payload, err := json.Marshal(postCommitPayload{Text: text, QueryID: f.queryID, Queries: queryIDs, Summary: summary})
+		if err == nil {
+			err = f.hook.fire(ctx, summary.RunID, payload)
+		}
+		if err != nil {
+			slog.Warn("post_commit hook failed; the run stays committed", "run_id", summary.RunID, "query_id", f.queryID, "hook", f.hook.String(), "error", err)
+			fmt.Fprintf(out, "[POST-COMMIT] Hook=%s Outcome=failed\n", f.hook)
+			continue
+		}
+		fmt.Fprintf(out, "[POST-COMMIT] Hook=%s Outcome=ok\n", f.hook)
+	}
+}
+
+// fire sends payload to the hook: the body of a POST for a URL, which must
+// answer with a 2xx status, or the standard input of a command, which must
+// exit with status 0 and also gets the run ID as DBEXEC_RUN_ID.
+func (h PostCommitHook) fire(ctx context.Context, runID string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, postCommitTimeout)
+	defer cancel()
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			// The URL in the error may hold a secret.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s returned %s", h, resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "DBEXEC_RUN_ID="+runID)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		if msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
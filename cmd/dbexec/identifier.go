@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// identifierPlaceholder matches an identifier placeholder in SQL, written
+// {{ident:name}} or, in its short form, {{name}}.
+var identifierPlaceholder = regexp.MustCompile(`\{\{\s*(?:ident:)?([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// identifierName matches the values an identifier parameter may take: a
+// name, optionally qualified by its schema.
+var identifierName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// IdentifierParam declares the identifiers an identifier parameter may be
+// replaced with: those listed in Allowed and those matching Pattern. In YAML
+// a plain list is the allowlist.
+type IdentifierParam struct {
+	Allowed []string `yaml:"allowed" json:"allowed,omitempty"`
+	// Pattern must match the whole identifier, such as events_\d{4}_\d{2}
+	// for monthly partitions.
+	Pattern string `yaml:"pattern" json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// UnmarshalYAML accepts either a list of allowed identifiers or a mapping
+// with allowed and pattern.
+func (p *IdentifierParam) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&p.Allowed)
+	}
+	type plain IdentifierParam
+	return value.Decode((*plain)(p))
+}
+
+// allows reports whether ident is a valid identifier the parameter may be
+// replaced with.
+func (p IdentifierParam) allows(ident string) bool {
+	if !identifierName.MatchString(ident) {
+		return false
+	}
+	return containsString(p.Allowed, ident) || (p.re != nil && p.re.MatchString(ident))
+}
+
+// String describes the identifiers the parameter allows.
+func (p IdentifierParam) String() string {
+	var parts []string
+	if len(p.Allowed) > 0 {
+		parts = append(parts, "one of "+strings.Join(p.Allowed, ", "))
+	}
+	if p.Pattern != "" {
+		parts = append(parts, "matching "+p.Pattern)
+	}
+	return strings.Join(parts, " or ")
+}
+
+// identifierPlaceholders lists the identifier parameters referenced by sql.
+func identifierPlaceholders(sql string) []string {
+	var names []string
+	for _, m := range identifierPlaceholder.FindAllStringSubmatch(sql, -1) {
+		if !containsString(names, m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// compileIdentifierParams checks that every placeholder in a query's
+// statements, guards and rollback_sql is declared in identifier_params with an allowlist
+// or pattern, that identifier parameters don't shadow bound ones, and
+// compiles their patterns.
+func compileIdentifierParams(q *QueryDefinition) error {
+	for name, p := range q.IdentifierParams {
+		if q.allowsParam(name) {
+			return fmt.Errorf("query %s: identifier parameter %s is also listed in allowed_params", q.ID, name)
+		}
+		if len(p.Allowed) == 0 && p.Pattern == "" {
+			return fmt.Errorf("query %s: identifier parameter %s needs an allowlist or a pattern", q.ID, name)
+		}
+		for _, ident := range p.Allowed {
+			if !identifierName.MatchString(ident) {
+				return fmt.Errorf("query %s: identifier parameter %s allows invalid identifier %q", q.ID, name, ident)
+			}
+		}
+		if p.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("query %s: identifier parameter %s has invalid pattern: %w", q.ID, name, err)
+			}
+			p.re = re
+			q.IdentifierParams[name] = p
+		}
+	}
+	for _, stmtSQL := range append([]string{q.SkipIf, q.OnlyIf, q.RollbackSQL}, q.SQL...) {
+		for _, name := range identifierPlaceholders(stmtSQL) {
+			if q.conditional() && templateKeywords[name] {
+				continue
+			}
+			if _, ok := q.IdentifierParams[name]; !ok {
+				return fmt.Errorf("query %s: placeholder {{ident:%s}} is not declared in identifier_params", q.ID, name)
+			}
+		}
+	}
+	return nil
+}
+
+// withIdentifiers returns a copy of q with every identifier placeholder in
+// its statements, guards and rollback_sql replaced by the quoted identifier supplied in
+// params. Values must be plain identifiers in the parameter's allowlist or
+// matching its pattern; a dotted value such as audit.events is quoted part by
+// part. q is returned unchanged when it has no identifier parameters.
+func (q QueryDefinition) withIdentifiers(params Params) (QueryDefinition, error) {
+	if len(q.IdentifierParams) == 0 {
+		return q, nil
+	}
+	quoted := make(map[string]string, len(q.IdentifierParams))
+	for name, p := range q.IdentifierParams {
+		val, ok := params[name]
+		if !ok {
+			return q, fmt.Errorf("%w: %s", errMissingParam, name)
+		}
+		if val.Null || !p.allows(val.Value) {
+			return q, fmt.Errorf("%w %s for %s: %s is not an identifier %s", errInvalidParam, name, q.ID, val, p)
+		}
+		quoted[name] = quoteIdentifier(val.Value)
+	}
+	substitute := func(sql string) string {
+		return identifierPlaceholder.ReplaceAllStringFunc(sql, func(m string) string {
+			// {{end}} and {{else}} of conditional statements are left alone.
+			if ident, ok := quoted[identifierPlaceholder.FindStringSubmatch(m)[1]]; ok {
+				return ident
+			}
+			return m
+		})
+	}
+
+	stmts := make(SQLStatements, len(q.SQL))
+	for i, stmtSQL := range q.SQL {
+		stmts[i] = substitute(stmtSQL)
+	}
+	q.SQL = stmts
+	q.SkipIf = substitute(q.SkipIf)
+	q.OnlyIf = substitute(q.OnlyIf)
+	q.RollbackSQL = substitute(q.RollbackSQL)
+	return q, nil
+}
+
+// quoteIdentifier quotes each dot-separated part of a possibly
+// schema-qualified identifier.
+func quoteIdentifier(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// acceptsParam reports whether a value for name can be supplied to the query,
+// either as a bound parameter, an identifier parameter or the schema
+// parameter.
+func (q QueryDefinition) acceptsParam(name string) bool {
+	_, ok := q.IdentifierParams[name]
+	return ok || q.allowsParam(name) || (q.SchemaParam != "" && name == q.SchemaParam)
+}
+
+// identifierParamNames returns the names of a query's identifier parameters
+// in sorted order.
+func (q QueryDefinition) identifierParamNames() []string {
+	names := make([]string, 0, len(q.IdentifierParams))
+	for name := range q.IdentifierParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schema returns the JSON Schema of the parameter's values.
+func (p IdentifierParam) schema() map[string]interface{} {
+	enum := map[string]interface{}{"type": paramString, "enum": p.Allowed}
+	pattern := map[string]interface{}{"type": paramString, "pattern": "^(?:" + p.Pattern + ")$"}
+	switch {
+	case p.Pattern == "":
+		return enum
+	case len(p.Allowed) == 0:
+		return pattern
+	}
+	return map[string]interface{}{"anyOf": []interface{}{enum, pattern}}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// rowExclusiveConflicts are the table lock modes, as named in pg_locks, that
+// conflict with the ROW EXCLUSIVE lock UPDATE and DELETE statements take.
+var rowExclusiveConflicts = []string{"ShareLock", "ShareRowExclusiveLock", "ExclusiveLock", "AccessExclusiveLock"}
+
+// lockProbeTimeout bounds how long the row lock probe of --lock-impact waits
+// for the table lock it needs.
+const lockProbeTimeout = "1s"
+
+// lockConflict is a lock another session holds, or waits for, that would
+// block a statement.
+type lockConflict struct {
+	PID     int64
+	User    string
+	State   string
+	Mode    string
+	Granted bool
+	// Age is how long the session's transaction has been open.
+	Age   time.Duration
+	Query string
+}
+
+// lockImpact estimates the locks an UPDATE or DELETE statement would take
+// and whether other sessions would block it.
+type lockImpact struct {
+	Table   string
+	Mode    string
+	RowLock string
+	// Conflicts are the other sessions' locks on the table that conflict
+	// with Mode, held or queued ahead of it.
+	Conflicts []lockConflict
+	// Rows is how many rows the statement would touch and LockedRows how
+	// many of them other transactions hold row locks on; both are -1 when
+	// the rows weren't probed.
+	Rows       int64
+	LockedRows int64
+}
+
+// modifiedTable returns the table named by an UPDATE or DELETE statement's
+// tableName, as returned by previewParts, without ONLY or an alias.
+func modifiedTable(tableName string) string {
+	fields := strings.Fields(tableName)
+	if strings.EqualFold(fields[0], "ONLY") && len(fields) > 1 {
+		return fields[1]
+	}
+	return fields[0]
+}
+
+// lockImpact reads pg_locks and pg_stat_activity for sessions whose table
+// locks conflict with stmtSQL's, then counts the rows it would touch that
+// other transactions have locked. The count locks rows FOR UPDATE SKIP
+// LOCKED inside a savepoint that is rolled back, so it releases them again
+// and never waits for them; it is skipped when a conflicting table lock is
+// held, since it would wait for that.
+func (e txExecutor) lockImpact(ctx context.Context, label, stmtSQL string, args []interface{}) (lockImpact, error) {
+	tableName, where, err := previewParts(stmtSQL)
+	if err != nil {
+		return lockImpact{}, err
+	}
+	impact := lockImpact{Table: modifiedTable(tableName), Mode: "RowExclusiveLock", RowLock: "FOR UPDATE", Rows: -1, LockedRows: -1}
+	if statementKeyword(stmtSQL) == "UPDATE" {
+		// Updates that don't change a key column take the weaker row lock.
+		impact.RowLock = "FOR NO KEY UPDATE"
+	}
+
+	modes := make([]string, len(rowExclusiveConflicts))
+	for i, mode := range rowExclusiveConflicts {
+		modes[i] = pq.QuoteLiteral(mode)
+	}
+	rows, err := e.tx.QueryContext(ctx, `
+		SELECT a.pid, COALESCE(a.usename, ''), COALESCE(a.state, ''), l.mode, l.granted,
+			COALESCE(EXTRACT(EPOCH FROM now() - a.xact_start), 0), COALESCE(left(a.query, 200), '')
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'relation' AND l.relation = $1::text::regclass AND l.pid <> pg_backend_pid()
+			AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND l.mode IN (`+strings.Join(modes, ", ")+`)
+		ORDER BY l.granted DESC, a.xact_start`, impact.Table)
+	if err != nil {
+		return impact, fmt.Errorf("failed to read locks on %s: %w", impact.Table, err)
+	}
+	defer rows.Close()
+	held := false
+	for rows.Next() {
+		var c lockConflict
+		var age float64
+		if err := rows.Scan(&c.PID, &c.User, &c.State, &c.Mode, &c.Granted, &age, &c.Query); err != nil {
+			return impact, err
+		}
+		c.Age = time.Duration(age * float64(time.Second))
+		c.Query = strings.Join(strings.Fields(c.Query), " ")
+		held = held || c.Granted
+		impact.Conflicts = append(impact.Conflicts, c)
+	}
+	if err := rows.Close(); err != nil {
+		return impact, err
+	}
+	if held {
+		return impact, nil
+	}
+
+	previewSQL := strings.TrimSpace("SELECT * FROM " + tableName + " " + where)
+	err = e.rolledBack(ctx, "dbexec_locks", func() error {
+		if _, err := e.tx.ExecContext(ctx, "SET LOCAL lock_timeout = '"+lockProbeTimeout+"'"); err != nil {
+			return err
+		}
+		total, err := e.count(ctx, label+":lock-rows", countQuery(previewSQL), args)
+		if err != nil {
+			return err
+		}
+		unlocked, err := e.count(ctx, label+":lock-skip", countQuery(previewSQL+" FOR UPDATE SKIP LOCKED"), args)
+		if err != nil {
+			return err
+		}
+		impact.Rows, impact.LockedRows = total, total-unlocked
+		return nil
+	})
+	if err != nil {
+		return impact, fmt.Errorf("failed to probe row locks on %s: %w", impact.Table, err)
+	}
+	return impact, nil
+}
+
+// write prints the estimate for the statement label, warning about each
+// conflicting lock and about rows locked by other transactions.
+func (l lockImpact) write(out io.Writer, label string) {
+	fmt.Fprintf(out, "[LOCKS] QueryID=%s Table=%s Mode=%s RowLock=%s\n", label, l.Table, l.Mode, l.RowLock)
+	for _, c := range l.Conflicts {
+		verb := "holds"
+		if !c.Granted {
+			verb = "is waiting for"
+		}
+		fmt.Fprintf(out, "  WARNING: pid %d (%s, %s, transaction open %s) %s %s: %s\n", c.PID, c.User, c.State, formatDuration(c.Age.Round(time.Second)), verb, c.Mode, c.Query)
+	}
+	if l.LockedRows > 0 {
+		fmt.Fprintf(out, "  WARNING: %d of the %d rows are locked by other transactions\n", l.LockedRows, l.Rows)
+	}
+	if len(l.Conflicts) == 0 && l.LockedRows <= 0 {
+		fmt.Fprintln(out, "  No conflicting locks are held; the statement would not block right now.")
+	}
+	fmt.Fprintln(out)
+}
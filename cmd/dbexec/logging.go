@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Supported log formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFlags holds the logging flags shared by every command.
+type logFlags struct {
+	level  *string
+	format *string
+}
+
+// registerLogFlags adds --log-level and --log-format to fs, defaulting to
+// DBEXEC_LOG_LEVEL and DBEXEC_LOG_FORMAT.
+func registerLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:  fs.String("log-level", envOr("DBEXEC_LOG_LEVEL", "info"), "Minimum level of diagnostics logged to stderr: debug, info, warn or error"),
+		format: fs.String("log-format", envOr("DBEXEC_LOG_FORMAT", logFormatText), "Format of diagnostics logged to stderr: text or json"),
+	}
+}
+
+// setup installs a logger configured by the flags as the slog default.
+// Diagnostics always go to stderr so stdout holds only results.
+func (f *logFlags) setup() error {
+	logger, err := newLogger(os.Stderr, *f.level, *f.format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// newLogger returns a logger writing to w at the given level and format.
+// Code embedding the runner can install its own logger with slog.SetDefault
+// instead; every diagnostic goes through the default logger.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unsupported log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unsupported log format: %s", format)
+}
+
+// envOr returns the environment variable key, or def when it is unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
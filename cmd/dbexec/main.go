@@ -3,280 +3,1914 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/lib/pq"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
 )
 
 type QueryDefinition struct {
-	ID               string   `yaml:"id" json:"id"`
-	Description      string   `yaml:"description" json:"description"`
-	SQL              string   `yaml:"sql" json:"sql"`
-	RequiresApproval bool     `yaml:"requires_approval" json:"requires_approval"`
-	MaxRowsAffected  int      `yaml:"max_rows_affected" json:"max_rows_affected"`
-	AllowedParams    []string `yaml:"allowed_params" json:"allowed_params"`
+	ID               string        `yaml:"id" json:"id"`
+	Description      string        `yaml:"description" json:"description"`
+	SQL              SQLStatements `yaml:"sql" json:"sql"`
+	RequiresApproval bool          `yaml:"requires_approval" json:"requires_approval"`
+	MaxRowsAffected  int           `yaml:"max_rows_affected" json:"max_rows_affected"`
+	MinRowsAffected  int           `yaml:"min_rows_affected" json:"min_rows_affected"`
+	AllowedParams    []string      `yaml:"allowed_params" json:"allowed_params"`
+	AllowDDL         bool          `yaml:"allow_ddl" json:"allow_ddl"`
+	// AllowFullTable permits UPDATE and DELETE statements without a WHERE
+	// clause.
+	AllowFullTable bool `yaml:"allow_full_table" json:"allow_full_table,omitempty"`
+	// Statements is an explicit list form of SQL for definitions that need
+	// several statements; their SQL is copied into SQL when the definition is
+	// loaded.
+	Statements []StatementDefinition `yaml:"statements" json:"statements,omitempty"`
+	// SQLFile names a file holding the query's SQL instead of sql, relative
+	// to the catalog's directory; it is read when the definition is loaded.
+	SQLFile string `yaml:"sql_file" json:"sql_file,omitempty"`
+	// MaxRowsScope selects whether max_rows_affected limits each statement
+	// (rowsScopeStatement, the default) or the query's total (rowsScopeTotal).
+	MaxRowsScope string `yaml:"max_rows_scope" json:"max_rows_scope,omitempty"`
+	// MaxPlanCost aborts the run when the planner's estimated total cost of a
+	// statement exceeds it (0 for no limit).
+	MaxPlanCost float64 `yaml:"max_plan_cost" json:"max_plan_cost,omitempty"`
+	// Tags group queries so they can be selected together with --tags.
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// SkipIf is a SELECT run before the query; if it returns a row (that is
+	// not false or NULL) the query is skipped.
+	SkipIf string `yaml:"skip_if" json:"skip_if,omitempty"`
+	// OnlyIf is a SELECT run before the query; unless it returns a row (that
+	// is not false or NULL) the query is skipped.
+	OnlyIf string `yaml:"only_if" json:"only_if,omitempty"`
+	// Exports maps result columns of the query's last statement to variables
+	// later queries of the run can bind as @name parameters.
+	Exports map[string]ExportDefinition `yaml:"exports" json:"exports,omitempty"`
+	// Expect asserts on the result of the query's last statement.
+	Expect *Expectation `yaml:"expect" json:"expect,omitempty"`
+	// Params optionally declares the type and format of allowed parameters.
+	Params map[string]ParamDefinition `yaml:"params" json:"params,omitempty"`
+	// IdentifierParams maps {{ident:name}} placeholders to the table or
+	// column names they may be replaced with.
+	IdentifierParams map[string]IdentifierParam `yaml:"identifier_params" json:"identifier_params,omitempty"`
+	// AllowedWindows restricts execution (but not previews) to the given time
+	// ranges, such as "Mon-Fri 22:00-02:00 UTC".
+	AllowedWindows []string `yaml:"allowed_windows" json:"allowed_windows,omitempty"`
+	// RateLimit caps successful approved runs per period, such as "1/day",
+	// counted from the audit log.
+	RateLimit string `yaml:"rate_limit" json:"rate_limit,omitempty"`
+	// RequiredRole, when set, is the role a run must have to include the query.
+	RequiredRole string `yaml:"required_role" json:"required_role,omitempty"`
+	// Targets, when set, lists the connection profiles the query may run
+	// against.
+	Targets []string `yaml:"targets" json:"targets,omitempty"`
+	// Database names the connection profile the query always runs against,
+	// such as an analytics database, whatever target the run selects.
+	Database string `yaml:"database" json:"database,omitempty"`
+	// ForcePrimary keeps runs including the query on the primary even when
+	// every query only reads, such as a read that must see earlier writes.
+	ForcePrimary bool `yaml:"force_primary" json:"force_primary,omitempty"`
+	// SessionParams are run-time parameters, such as lock_timeout, set for
+	// the duration of the query as with SET LOCAL.
+	SessionParams map[string]string `yaml:"session_params" json:"session_params,omitempty"`
+	// LockKey names a Postgres advisory lock taken at the start of the
+	// transaction, so concurrent runs of the same operation serialize.
+	LockKey string `yaml:"lock_key" json:"lock_key,omitempty"`
+	// PostCommit is a hook fired after a run including the query commits,
+	// such as a webhook invalidating a cache.
+	PostCommit *PostCommitHook `yaml:"post_commit" json:"post_commit,omitempty"`
+	// DatabaseRole is the role the query runs as, switched to with SET LOCAL
+	// ROLE, so dbexec can connect as a low-privilege user.
+	DatabaseRole string `yaml:"role" json:"role,omitempty"`
+	// Backup copies the rows each UPDATE or DELETE statement is about to
+	// modify into a table in the backup schema before executing it.
+	Backup bool `yaml:"backup" json:"backup,omitempty"`
+	// RollbackSQL undoes the query's UPDATE statement for one changed row. It
+	// binds the query's parameters as $1..$n and the row's previous values
+	// as {{old:column}}; committed runs write it, once per row, to a rollback
+	// script replayed by dbexec rollback.
+	RollbackSQL string `yaml:"rollback_sql" json:"rollback_sql,omitempty"`
+	// RedactColumns lists result columns, matched case-insensitively, whose
+	// values are shown as <REDACTED> unless the run passes --show-redacted.
+	RedactColumns []string `yaml:"redact_columns" json:"redact_columns,omitempty"`
+	// MaskColumns selects a built-in masker, such as mask_email or last4, for
+	// result columns whose values are partly shown unless the run passes
+	// --show-redacted.
+	MaskColumns map[string]string `yaml:"mask_columns" json:"mask_columns,omitempty"`
+	// SchemaParam names the parameter selecting the schema the query runs in,
+	// set as its search_path; the schema must match SchemaPattern.
+	SchemaParam   string `yaml:"schema_param" json:"schema_param,omitempty"`
+	SchemaPattern string `yaml:"schema_pattern" json:"schema_pattern,omitempty"`
+
+	windows       []maintenanceWindow
+	rateLimit     rateLimit
+	schemaPattern *regexp.Regexp
+	// conditions are the parsed statements of a query with optional
+	// parameters.
+	conditions []*template.Template
+}
+
+// SQLStatements holds the statements of a query definition. In YAML the sql
+// field may be a single statement or a list of statements that are executed
+// in order within the same transaction.
+type SQLStatements []string
+
+// UnmarshalYAML accepts either a scalar or a sequence of statements.
+func (s *SQLStatements) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*s = SQLStatements{value.Value}
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*s = list
+		return nil
+	}
+	return fmt.Errorf("line %d: sql must be a string or a list of strings", value.Line)
+}
+
+// StatementDefinition is one entry of a query's statements list.
+type StatementDefinition struct {
+	SQL string `yaml:"sql" json:"sql"`
+	// ExpectRowsAffected, when set, is the exact number of rows the statement
+	// must affect.
+	ExpectRowsAffected *int `yaml:"expect_rows_affected" json:"expect_rows_affected,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare SQL string or a mapping with sql and
+// expect_rows_affected.
+func (s *StatementDefinition) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = StatementDefinition{SQL: value.Value}
+		return nil
+	}
+	type plain StatementDefinition
+	return value.Decode((*plain)(s))
+}
+
+// Scopes of max_rows_affected.
+const (
+	rowsScopeStatement = "statement"
+	rowsScopeTotal     = "total"
+)
+
+// checkRowsAffected enforces max_rows_affected, min_rows_affected and the
+// expect_rows_affected of statement i, which affected n rows, bringing the
+// query's total to total. With max_rows_scope: total, the minimum applies to
+// the total once the last statement that writes has run.
+func (q QueryDefinition) checkRowsAffected(i int, n, total int64) error {
+	if q.MinRowsAffected > 0 {
+		if q.MaxRowsScope == rowsScopeTotal && i == q.lastWrite() && total < int64(q.MinRowsAffected) {
+			return &rowLimitError{QueryID: q.ID, Scope: limitMinimum, Limit: int64(q.MinRowsAffected), Actual: total}
+		}
+		if q.MaxRowsScope != rowsScopeTotal && n < int64(q.MinRowsAffected) {
+			return &rowLimitError{QueryID: q.statementLabel(i), Scope: limitMinimum, Limit: int64(q.MinRowsAffected), Actual: n}
+		}
+	}
+	if q.MaxRowsAffected > 0 {
+		if q.MaxRowsScope == rowsScopeTotal && total > int64(q.MaxRowsAffected) {
+			return &rowLimitError{QueryID: q.ID, Scope: limitTotal, Limit: int64(q.MaxRowsAffected), Actual: total}
+		}
+		if q.MaxRowsScope != rowsScopeTotal && n > int64(q.MaxRowsAffected) {
+			return &rowLimitError{QueryID: q.statementLabel(i), Limit: int64(q.MaxRowsAffected), Actual: n}
+		}
+	}
+	return q.checkExpectedRows(i, n)
+}
+
+// lastWrite returns the index of the query's last statement that doesn't
+// only read, as isRead tells, or -1 if it only reads.
+func (q QueryDefinition) lastWrite() int {
+	for i := len(q.SQL) - 1; i >= 0; i-- {
+		if !isRead(q.SQL[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkExpectedRows checks the rows affected (or, in a preview, that would be
+// affected) by statement i against its expect_rows_affected.
+func (q QueryDefinition) checkExpectedRows(i int, n int64) error {
+	if i >= len(q.Statements) || q.Statements[i].ExpectRowsAffected == nil {
+		return nil
+	}
+	if want := *q.Statements[i].ExpectRowsAffected; n != int64(want) {
+		return &assertionError{QueryID: q.statementLabel(i), Message: fmt.Sprintf("expected %d rows affected, got %d", want, n)}
+	}
+	return nil
+}
+
+// statementLabel identifies statement i of a query in output. Single-statement
+// queries are labeled with the bare query ID.
+func (q QueryDefinition) statementLabel(i int) string {
+	if len(q.SQL) == 1 {
+		return q.ID
+	}
+	return fmt.Sprintf("%s[%d]", q.ID, i)
 }
 
 var queries = map[string]QueryDefinition{}
 
 // loadQueriesFromYAML loads query definitions from a YAML file and stores them in the queries map.
-func loadQueriesFromYAML(path string) error {
-	data, err := os.ReadFile(path)
+// The file is read from fsys, or from disk when fsys is nil.
+func loadQueriesFromYAML(fsys fs.FS, path string) error {
+	var data []byte
+	var err error
+	if fsys != nil {
+		data, err = fs.ReadFile(fsys, path)
+	} else {
+		data, err = os.ReadFile(path)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read YAML file: %w", err)
 	}
 
-	var list []QueryDefinition
-	if err := yaml.Unmarshal(data, &list); err != nil {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
 		return fmt.Errorf("failed to unmarshal YAML: %w", err)
 	}
+	var file definitionsFile
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.SequenceNode {
+		err = doc.Decode(&file.Queries)
+	} else {
+		err = doc.Decode(&file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+	list := file.Queries
 
 	for _, q := range list {
+		if q.SQLFile != "" {
+			if len(q.SQL) > 0 || len(q.Statements) > 0 {
+				return fmt.Errorf("query %s: sql_file cannot be combined with sql or statements", q.ID)
+			}
+			stmtSQL, err := readSQLFile(fsys, path, q.SQLFile)
+			if err != nil {
+				return fmt.Errorf("query %s: %w", q.ID, err)
+			}
+			q.SQL = SQLStatements{stmtSQL}
+		}
+		if len(q.Statements) > 0 {
+			if len(q.SQL) > 0 {
+				return fmt.Errorf("query %s: set either sql or statements, not both", q.ID)
+			}
+			for _, st := range q.Statements {
+				q.SQL = append(q.SQL, st.SQL)
+			}
+		}
+		switch q.MaxRowsScope {
+		case "", rowsScopeStatement, rowsScopeTotal:
+		default:
+			return fmt.Errorf("query %s: max_rows_scope must be %s or %s", q.ID, rowsScopeStatement, rowsScopeTotal)
+		}
+		if q.MinRowsAffected < 0 || (q.MaxRowsAffected > 0 && q.MinRowsAffected > q.MaxRowsAffected) {
+			return fmt.Errorf("query %s: min_rows_affected must be between 0 and max_rows_affected", q.ID)
+		}
+		if err := validateStatementType(q); err != nil {
+			return err
+		}
+		if err := compileParams(&q); err != nil {
+			return err
+		}
+		if err := compileConditions(&q); err != nil {
+			return err
+		}
+		if err := validateExports(q); err != nil {
+			return err
+		}
+		if err := validateGuards(q); err != nil {
+			return err
+		}
+		if err := validateExpect(q); err != nil {
+			return err
+		}
+		if err := compileIdentifierParams(&q); err != nil {
+			return err
+		}
+		if err := compileWindows(&q); err != nil {
+			return err
+		}
+		if err := compileRateLimit(&q); err != nil {
+			return err
+		}
+		if err := validateSessionParams(q); err != nil {
+			return err
+		}
+		if err := compileSchemaParam(&q); err != nil {
+			return err
+		}
+		if err := validateDatabaseRole(q); err != nil {
+			return err
+		}
+		if err := validateLockKey(q); err != nil {
+			return err
+		}
+		if err := validatePostCommit(q); err != nil {
+			return err
+		}
+		if err := validateBackup(q); err != nil {
+			return err
+		}
+		if err := validateRollback(q); err != nil {
+			return err
+		}
+		if err := validateRedactColumns(q); err != nil {
+			return err
+		}
+		if _, exists := queries[q.ID]; !exists {
+			queryOrder = append(queryOrder, q.ID)
+		}
 		queries[q.ID] = q
 	}
-	return nil
+	return loadRunbooks(&file.Runbooks)
+}
+
+// readSQLFile reads the sql_file name of a definition in the catalog at
+// catalogPath, resolving a relative name against the catalog's directory.
+// Like the catalog, it is read from fsys, or from disk when fsys is nil.
+func readSQLFile(fsys fs.FS, catalogPath, name string) (string, error) {
+	var data []byte
+	var err error
+	if fsys != nil {
+		data, err = fs.ReadFile(fsys, path.Join(path.Dir(catalogPath), name))
+	} else {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(catalogPath), name)
+		}
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read sql_file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runOptions controls how runQueriesInTransaction executes a batch of queries.
+type runOptions struct {
+	// Approve commits the transaction; otherwise the run is a dry run.
+	Approve bool
+	// Out receives the run's result payload: result sets in the selected
+	// format and, for JSON, the summary line.
+	Out io.Writer
+	// Diag receives everything else meant for a human, such as preview and
+	// execution banners, row counts and timings. Nil sends it to Out.
+	Diag io.Writer
+	// Format selects how result sets are rendered: text, table, json, csv
+	// or template.
+	Format string
+	// Template renders each row with the template format.
+	Template *template.Template
+	// NullString, when set, is how NULL values are shown in text and CSV
+	// results. Nil keeps each format's default.
+	NullString *string
+	// OutputDir, when set, writes each query's result set to
+	// <OutputDir>/<run ID>/<id>.<ext>, prefixed with preview- in dry runs,
+	// instead of Out.
+	OutputDir string
+	// Reason is the operator's reason for the run, such as a change ticket,
+	// recorded in its summary.
+	Reason string
+	// Actor is who started the run, recorded in its rollback script so they
+	// can't approve undoing it. Empty means the CLI user.
+	Actor string
+	// Approved is set once a signed approval of the run has been verified,
+	// by dbexec apply. Executing queries marked requires_approval is refused
+	// without it.
+	Approved bool
+	// FetchSize, when positive, reads the results of SELECT statements and
+	// previews through a server-side cursor, this many rows at a time, on
+	// Postgres.
+	FetchSize int
+	// Force writes into a run's output directory even if it already exists.
+	Force bool
+	// results tracks the files written to the run's output directory; it is
+	// set when the run starts.
+	results *resultFiles
+	// Stmts, when set, caches prepared statements across runs.
+	Stmts *stmtCache
+	// RunID identifies the run in traces and the audit log.
+	RunID string
+	// Heartbeat, when set, reports statements that are still executing.
+	Heartbeat *heartbeat
+	// Explain prints each statement's plan before it runs: explainPlan or
+	// explainAnalyze, which is only allowed for dry runs.
+	Explain string
+	// IgnorePlanCost skips the max_plan_cost guardrail.
+	IgnorePlanCost bool
+	// LockImpact estimates, for each previewed UPDATE and DELETE, the locks
+	// it would take and warns about sessions it would wait for.
+	LockImpact bool
+	// ShowSQL prints each statement and its bound arguments before it runs.
+	ShowSQL bool
+	// TransactionTimeout caps the wall-clock time of the whole transaction.
+	// Exceeding it cancels the running statement and rolls everything back.
+	TransactionTimeout time.Duration
+	// Locks maps the names of the advisory locks the run takes besides its
+	// queries' lock_keys, from --lock and the runbook, to what declared them.
+	Locks map[string]string
+	// LockTimeout, when positive, bounds how long the run waits for each
+	// lock held by another run.
+	LockTimeout time.Duration
+	// LockNoWait fails the run at once when another run holds one of its
+	// locks.
+	LockNoWait bool
+	// PostCommit are the hooks fired after the run commits, besides those of
+	// its queries.
+	PostCommit []PostCommitHook
+	// QueryTimeout caps the time of each query; its context is derived from
+	// the transaction's.
+	QueryTimeout time.Duration
+	// StepParams, when set, holds parameters fixed for the query at the same
+	// index of ids (such as a runbook step's), overriding the run's params.
+	StepParams []Params
+	// Bulk, when set, tracks a --foreach-csv run: each entry of ids executes
+	// one CSV row.
+	Bulk *bulkRun
+	// AllowFullTable permits executing queries with an UPDATE or DELETE
+	// without a WHERE clause; their definitions must also set
+	// allow_full_table.
+	AllowFullTable bool
+	// Role is the caller's role, checked against each query's required_role.
+	Role string
+	// Target is the connection profile the run is connected to ("" for
+	// DATABASE_URL), checked against each query's targets.
+	Target string
+	// AllowDDL permits executing queries with statements other than SELECT,
+	// INSERT, UPDATE or DELETE; their definitions must also set allow_ddl.
+	AllowDDL bool
+	// OverrideWindow executes queries outside their allowed_windows; each one
+	// is recorded in the summary's window_overrides.
+	OverrideWindow bool
+	// SearchPath, when set, is the search_path of the whole transaction, as
+	// returned by parseSearchPath.
+	SearchPath string
+	// ShowRedacted shows the values of each query's redact_columns and
+	// mask_columns in its results.
+	ShowRedacted bool
+	// ByteaFormat encodes bytea values in results: byteaBase64 (the default
+	// when empty) or byteaHex.
+	ByteaFormat string
+	// BinaryMaxBytes cuts bytea values in text and table output longer than
+	// this many bytes short (0 for defaultBinaryMaxBytes, negative for no
+	// limit).
+	BinaryMaxBytes int
+	// MaxColWidth cuts table output values longer than this many characters
+	// short (0 for no limit).
+	MaxColWidth int
+	// RawJSON shows json and jsonb values as they are in text output and as
+	// strings in JSON output, rather than pretty-printed and nested.
+	RawJSON bool
+	// JSONMaxBytes cuts json values in text output longer than this many
+	// bytes short (0 for defaultJSONMaxBytes, negative for no limit).
+	JSONMaxBytes int
+	// MaxResultRows limits the rows written of each result set (0 for no
+	// limit). The rest are still read, so exports, expectations and row
+	// counts see them.
+	MaxResultRows int
+	// BackupSchema is the schema of the backup tables of queries with
+	// backup: true ("" for defaultBackupSchema).
+	BackupSchema string
+	// RollbackDir is the directory the rollback scripts of queries with
+	// rollback_sql are written to ("" for DBEXEC_ROLLBACK_DIR or
+	// defaultRollbackDir).
+	RollbackDir string
+	// CountOnly previews UPDATE and DELETE statements by counting the rows
+	// they would affect instead of printing them.
+	CountOnly bool
+	// OmitSummary leaves the closing totals and JSON summary line to the
+	// caller, which combines several runs.
+	OmitSummary bool
 }
 
 // runQueriesInTransaction executes a list of predefined queries within a single transaction.
-// If approve is false, it performs a dry run without committing changes.
-func runQueriesInTransaction(db *sql.DB, ids []string, params map[string]string, approve bool) error {
-	ctx := context.Background()
-	tx, err := db.BeginTx(ctx, nil)
+// If opts.Approve is false, it performs a dry run without committing changes.
+func runQueriesInTransaction(ctx context.Context, db *sql.DB, ids []string, params Params, opts runOptions) (summary *runSummary, err error) {
+	summary = &runSummary{RunID: opts.RunID, Target: opts.Target, Reason: opts.Reason}
+	runStart := time.Now()
+	defer func() { summary.Elapsed = durationMS(time.Since(runStart)) }()
+	defer func() { observeRun(opts.Approve, err) }()
+	ctx, runSpan := tracer.Start(ctx, "dbexec.run", trace.WithAttributes(
+		attribute.String("dbexec.run_id", opts.RunID),
+		attribute.Bool("dbexec.approve", opts.Approve),
+		attribute.Int("dbexec.query_count", len(ids)),
+	))
+	defer func() { endSpan(runSpan, err) }()
+	var querySpan trace.Span
+	var currentQuery string
+	defer func() {
+		if querySpan != nil {
+			endSpan(querySpan, err)
+		}
+	}()
+
+	if opts.OutputDir != "" && opts.results == nil {
+		opts.results = &resultFiles{Dir: filepath.Join(opts.OutputDir, opts.RunID)}
+	}
+	if opts.results != nil {
+		defer func() { summary.Outputs = opts.results.written() }()
+	}
+
+	out := opts.diagnostics()
+	approve := opts.Approve
+	if opts.Explain == explainAnalyze && approve {
+		return summary, fmt.Errorf("EXPLAIN ANALYZE executes statements and is only allowed without --approve")
+	}
+	if approve {
+		if err := checkWriteGate(); err != nil {
+			return summary, err
+		}
+		if !opts.Approved {
+			if err := checkUnapproved(ids); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	for step, id := range ids {
+		if qdef, ok := queries[strings.TrimSpace(id)]; ok {
+			// Check identifiers before anything runs: they are interpolated
+			// into the SQL.
+			stepParams := params
+			if step < len(opts.StepParams) {
+				stepParams = params.withOverrides(opts.StepParams[step])
+			}
+			if _, err := qdef.withIdentifiers(stepParams); err != nil {
+				return summary, err
+			}
+			if _, err := qdef.withConditions(stepParams); err != nil {
+				return summary, err
+			}
+			if err := qdef.checkRole(opts.Role); err != nil {
+				return summary, err
+			}
+			if err := qdef.checkTarget(opts.Target); err != nil {
+				return summary, err
+			}
+		}
+	}
+	if approve {
+		now := time.Now()
+		for _, id := range ids {
+			qdef, ok := queries[strings.TrimSpace(id)]
+			if !ok {
+				continue
+			}
+			if qdef.requiresDDL() && !opts.AllowDDL {
+				return summary, fmt.Errorf("%s runs statements other than SELECT, INSERT, UPDATE or DELETE and requires --allow-ddl", qdef.ID)
+			}
+			if qdef.requiresFullTable() && !opts.AllowFullTable {
+				return summary, fmt.Errorf("%s updates or deletes every row of a table and requires --allow-full-table", qdef.ID)
+			}
+			if qdef.inWindow(now) || containsString(summary.WindowOverrides, qdef.ID) {
+				continue
+			}
+			if !opts.OverrideWindow {
+				return summary, fmt.Errorf("%s may only be executed during %s (use --override-window to run it anyway)", qdef.ID, strings.Join(qdef.AllowedWindows, ", "))
+			}
+			fmt.Fprintf(out, "[WINDOW OVERRIDE] QueryID=%s AllowedWindows=%s\n", qdef.ID, strings.Join(qdef.AllowedWindows, "; "))
+			summary.WindowOverrides = append(summary.WindowOverrides, qdef.ID)
+		}
+	}
+
+	if opts.TransactionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.TransactionTimeout)
+		defer cancel()
+	}
+	// Track what was executing so a deadline can be attributed to it.
+	var current string
+	var qctx context.Context
+	cancelQuery := context.CancelFunc(func() {})
+	defer func() { cancelQuery() }()
+	defer func() {
+		if err != nil && currentQuery != "" {
+			observeQueryError(currentQuery, approve, errorClass(err, ctx, qctx))
+			err = opts.Bulk.lineError(err)
+		}
+	}()
+	defer func() {
+		if err == nil || current == "" {
+			return
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded) && opts.TransactionTimeout > 0:
+			err = fmt.Errorf("transaction timeout of %s exceeded while executing %s: %w", opts.TransactionTimeout, current, err)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("deadline exceeded while executing %s: %w", current, err)
+		case qctx != nil && errors.Is(qctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("query timeout of %s exceeded while executing %s: %w", opts.QueryTimeout, current, err)
+		case errors.Is(ctx.Err(), context.Canceled):
+			err = fmt.Errorf("run canceled while executing %s: %w", current, err)
+		}
+	}()
+
+	// The transaction gets a connection of its own so COPY can run on it.
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return summary, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return summary, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
 		if tx != nil {
 			tx.Rollback() // Will be ignored if already committed
 		}
 	}()
+	if opts.SearchPath != "" {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('search_path', $1, true)", opts.SearchPath); err != nil {
+			return summary, fmt.Errorf("failed to set search_path: %w", err)
+		}
+	}
+	exec := txExecutor{tx: tx, conn: conn, stmts: opts.Stmts}
+	// Other drivers have no advisory locks.
+	if isPostgres(db) {
+		if err := exec.acquireLocks(ctx, ids, opts.Locks, opts.LockTimeout, opts.LockNoWait); err != nil {
+			return summary, err
+		}
+	}
+	checkPlanCost := !opts.IgnorePlanCost && isPostgres(db)
+	checkLocks := isPostgres(db)
+	// Other drivers read results without a cursor.
+	fetchSize := opts.FetchSize
+	if !isPostgres(db) {
+		fetchSize = 0
+	}
+	copyResults := opts.Format == formatCopyCSV && supportsCopy(db)
+	// exported holds the variables exported by the queries run so far.
+	exported := map[string]interface{}{}
+	// backups counts the backup tables created in the run.
+	backups := 0
+	// rollback collects the statements undoing the run, last query first,
+	// and its backup tables.
+	rollback := rollbackScript{RollbackOf: opts.RunID, Actor: opts.Actor, Target: opts.Target}
+	if rollback.Actor == "" {
+		rollback.Actor = cliActor()
+	}
+	// activeRole is the database role the transaction runs as ("" for the
+	// connecting role).
+	activeRole := ""
 
-	for _, id := range ids {
+	for step, id := range ids {
 		qdef, ok := queries[strings.TrimSpace(id)]
 		if !ok {
-			return fmt.Errorf("unknown query ID: %s", id)
+			return summary, fmt.Errorf("%w: %s", errUnknownQuery, id)
 		}
+		currentQuery = qdef.ID
 
-		args := []interface{}{}
-		for _, key := range qdef.AllowedParams {
-			val, ok := params[key]
-			if !ok {
-				return fmt.Errorf("missing parameter: %s", key)
+		qctx, querySpan = tracer.Start(ctx, "dbexec.query", trace.WithAttributes(
+			attribute.String("dbexec.query_id", qdef.ID),
+			attribute.String("db.operation", statementKeyword(qdef.SQL[0])),
+		))
+		if opts.QueryTimeout > 0 {
+			var cancel context.CancelFunc
+			qctx, cancel = context.WithTimeout(qctx, opts.QueryTimeout)
+			cancelQuery = cancel
+		}
+
+		stepParams := params
+		if step < len(opts.StepParams) {
+			stepParams = params.withOverrides(opts.StepParams[step])
+		}
+		qdef, err = qdef.withConditions(stepParams)
+		if err != nil {
+			return summary, err
+		}
+		args, err := qdef.bindParams(stepParams, exported)
+		if err != nil {
+			return summary, err
+		}
+		qdef, err = qdef.withIdentifiers(stepParams)
+		if err != nil {
+			return summary, err
+		}
+		if err := validateStatementType(qdef); err != nil {
+			return summary, err
+		}
+
+		current = qdef.ID
+		if qdef.DatabaseRole != activeRole {
+			if err := exec.setRole(qctx, qdef.DatabaseRole); err != nil {
+				return summary, statementError(qctx, "setting role failed", qdef.ID, err)
 			}
-			args = append(args, val)
+			activeRole = qdef.DatabaseRole
+			summary.role = activeRole
+		}
+		sessionParams, err := qdef.sessionParamsFor(stepParams)
+		if err != nil {
+			return summary, err
+		}
+		restoreSession, err := exec.setSessionParams(qctx, sessionParams)
+		if err != nil {
+			return summary, statementError(qctx, "session parameters failed", qdef.ID, err)
+		}
+		reason, err := exec.skipReason(qctx, qdef, args)
+		if err != nil {
+			return summary, statementError(qctx, "guard failed", qdef.ID, err)
+		}
+		if reason != "" {
+			if err := restoreSession(qctx); err != nil {
+				return summary, statementError(qctx, "session parameters failed", qdef.ID, err)
+			}
+			fmt.Fprintf(out, "[SKIPPED] QueryID=%s Reason=%s\n\n", qdef.ID, reason)
+			summary.add(qdef.ID, qdef.ID, modeSkipped, 0, 0)
+			querySpan.SetAttributes(attribute.Bool("dbexec.skipped", true))
+			endSpan(querySpan, nil)
+			querySpan = nil
+			currentQuery = ""
+			cancelQuery()
+			if err := opts.Bulk.rowDone(0); err != nil {
+				return summary, err
+			}
+			continue
 		}
 
+		start := time.Now()
+		var queryRows int64
+		result := newResultCapture(qdef)
+		var undo []rollbackStatement
 
-		// Check if this is a SELECT query
-		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(qdef.SQL)), "SELECT") {
-			// For SELECT statements, use QueryContext and print results
-			rows, err := tx.QueryContext(ctx, qdef.SQL, args...)
-			if err != nil {
-				return fmt.Errorf("execution error for %s: %v", id, err)
+		for i, stmtSQL := range qdef.SQL {
+			label := qdef.statementLabel(i)
+			current = label
+			// Exports and expectations are read from the query's last statement.
+			var capture *resultCapture
+			if i == len(qdef.SQL)-1 {
+				capture = result
+			}
+			// Every statement shares the query's parameters but is only bound
+			// with those up to the highest placeholder it references.
+			highest := placeholderCount(stmtSQL)
+			if highest > len(args) {
+				return summary, fmt.Errorf("%s references $%d but only %d parameters are allowed", label, highest, len(args))
+			}
+			stmtArgs := args[:highest]
+			if opts.ShowSQL {
+				writeBoundSQL(out, qdef, label, stmtSQL, stmtArgs)
 			}
-			defer rows.Close()
 
-			// Print the query results
-			prefix := "[EXECUTED]"
-			title := "Results:"
-			rowCount, err := printQueryResults(rows, qdef.ID, prefix, title)
-			if err != nil {
-				return fmt.Errorf("error printing results for %s: %v", id, err)
-			}
-
-			fmt.Printf("Total rows: %d\n\n", rowCount)
-		} else if !approve {
-			// For preview mode, create a simple SELECT statement
-			// Extract table name and WHERE clause from the UPDATE statement
-			sql := qdef.SQL
-			
-			// Normalize SQL by removing newlines and extra spaces
-			normalizedSQL := strings.Join(strings.Fields(sql), " ")
-			upper := strings.ToUpper(normalizedSQL)
-			
-			// Find key parts of the SQL
-			updateIndex := strings.Index(upper, "UPDATE ")
-			setIndex := strings.Index(upper, " SET ")
-			whereIndex := strings.Index(upper, " WHERE ")
-			
-			var previewSQL string
-			
-			if updateIndex != -1 && setIndex != -1 && updateIndex < setIndex {
-				// Extract table name
-				tableName := strings.TrimSpace(normalizedSQL[updateIndex+7:setIndex])
-				
-				// Build a simple SELECT statement
-				if whereIndex != -1 && whereIndex > setIndex {
-					whereClause := normalizedSQL[whereIndex:]
-					previewSQL = fmt.Sprintf("SELECT * FROM %s %s", tableName, whereClause)
+			if qdef.MaxPlanCost > 0 && checkPlanCost {
+				cost, costPlan, err := exec.planCost(qctx, stmtSQL, stmtArgs)
+				if err != nil {
+					return summary, statementError(qctx, "plan cost check failed", label, err)
+				}
+				if cost > qdef.MaxPlanCost {
+					fmt.Fprintf(out, "[PLAN COST] QueryID=%s Cost=%.2f Limit=%.2f\n%s\n\n", label, cost, qdef.MaxPlanCost, costPlan)
+					return summary, fmt.Errorf("plan cost for %s exceeds limit: %.2f > %.2f (use --ignore-plan-cost to override)", label, cost, qdef.MaxPlanCost)
+				}
+			}
+
+			var plan string
+			if opts.Explain != explainOff {
+				plan, err = exec.explain(qctx, stmtSQL, stmtArgs, opts.Explain == explainAnalyze)
+				if err != nil {
+					return summary, statementError(qctx, "explain failed", label, err)
+				}
+				fmt.Fprintf(out, "[EXPLAIN] QueryID=%s\n%s\n\n", label, plan)
+			}
+
+			// Check if this is a SELECT query that only reads
+			if isRead(stmtSQL) {
+				// For SELECT statements, use QueryContext and print results
+				stmtStart := time.Now()
+				prefix := "[EXECUTED]"
+				title := "Results:"
+				var rowCount int
+				if copyResults && opts.copyable(qdef, capture) {
+					stopHeartbeat := opts.Heartbeat.start(label)
+					rowCount, err = opts.writeOutput(label, prefix, func(w io.Writer) (int, error) {
+						return exec.copyCSV(qctx, stmtSQL, stmtArgs, opts.NullString, w)
+					})
+					stopHeartbeat()
+					if err != nil {
+						return summary, statementError(qctx, "execution error", label, err)
+					}
+				} else {
+					if copyResults {
+						slog.Warn("query masks columns or reads its result, so its rows are scanned instead of exported with COPY", "query_id", qdef.ID)
+					}
+					stopHeartbeat := opts.Heartbeat.start(label)
+					rows, err := exec.queryRows(qctx, label, stmtSQL, stmtArgs, fetchSize)
+					stopHeartbeat()
+					if err != nil {
+						return summary, statementError(qctx, "execution error", label, err)
+					}
+
+					// Print the query results, then release the result set so it doesn't
+					// stay open on the transaction's connection for the rest of the batch
+					rowCount, err = opts.writeResults(rows, label, prefix, title, opts.columnMasks(qdef), capture, stmtStart)
+					rows.Close()
+					if err != nil {
+						return summary, fmt.Errorf("error printing results for %s: %w", label, err)
+					}
+				}
+
+				elapsed := time.Since(stmtStart)
+				summary.add(qdef.ID, label, modeExecuted, int64(rowCount), elapsed).Plan = plan
+				queryRows += int64(rowCount)
+				fmt.Fprintf(out, "Total rows: %d (%s)\n\n", rowCount, formatDuration(elapsed))
+			} else if !approve {
+				// For preview mode, run a SELECT over the rows the statement would touch
+				keyword := statementKeyword(stmtSQL)
+				if keyword == "INSERT" {
+					fmt.Fprintf(out, "[PREVIEW] QueryID=%s INSERT statements are not previewed\n\n", label)
+					summary.add(qdef.ID, label, modeNotPreviewed, 0, 0).Plan = plan
+					if err := exec.dryRunExports(qctx, label, stmtSQL, stmtArgs, capture); err != nil {
+						return summary, statementError(qctx, "export failed", label, err)
+					}
+					continue
+				}
+				previewSQL, err := previewQuery(stmtSQL)
+				if err != nil {
+					return summary, fmt.Errorf("%v: %s", err, label)
+				}
+				if opts.LockImpact && checkLocks {
+					impact, err := exec.lockImpact(qctx, label, stmtSQL, stmtArgs)
+					if err != nil {
+						return summary, statementError(qctx, "lock impact estimate failed", label, err)
+					}
+					impact.write(out, label)
+				}
+
+				if opts.CountOnly {
+					previewSQL = countQuery(previewSQL)
+				}
+
+				fmt.Fprintf(out, "[PREVIEW] Using query: %s\n", previewSQL)
+				stmtStart := time.Now()
+				stopHeartbeat := opts.Heartbeat.start(label)
+				var rowCount int
+				if opts.CountOnly {
+					var count int64
+					count, err = exec.count(qctx, label+":count", previewSQL, stmtArgs)
+					stopHeartbeat()
+					if err != nil {
+						return summary, statementError(qctx, "preview failed", label, err)
+					}
+					rowCount = int(count)
 				} else {
-					previewSQL = fmt.Sprintf("SELECT * FROM %s", tableName)
+					rows, err := exec.queryRows(qctx, label+":preview", previewSQL, stmtArgs, fetchSize)
+					stopHeartbeat()
+					if err != nil {
+						return summary, statementError(qctx, "preview failed", label, err)
+					}
+
+					// Print the query results and release the result set
+					prefix := "[PREVIEW]"
+					title := fmt.Sprintf("Results that would be affected by the %s:", keyword)
+					rowCount, err = opts.writeResults(rows, label, prefix, title, opts.columnMasks(qdef), nil, stmtStart)
+					rows.Close()
+					if err != nil {
+						return summary, fmt.Errorf("error printing preview results for %s: %w", label, err)
+					}
+				}
+
+				elapsed := time.Since(stmtStart)
+				summary.add(qdef.ID, label, modePreview, int64(rowCount), elapsed).Plan = plan
+				queryRows += int64(rowCount)
+				fmt.Fprintf(out, "Total rows that would be affected: %d (%s)\n\n", rowCount, formatDuration(elapsed))
+				if err := qdef.checkExpectedRows(i, int64(rowCount)); err != nil {
+					return summary, err
+				}
+				if err := exec.dryRunExports(qctx, label, stmtSQL, stmtArgs, capture); err != nil {
+					return summary, statementError(qctx, "export failed", label, err)
 				}
 			} else {
-				// Fallback to original SQL with a comment
-				previewSQL = "-- Could not parse UPDATE statement properly\n" + sql
-				return fmt.Errorf("could not parse UPDATE statement for preview: %s", id)
-			}
-			
-			fmt.Printf("[PREVIEW] Using query: %s\n", previewSQL)
-			rows, err := tx.QueryContext(ctx, previewSQL, args...)
-			if err != nil {
-				return fmt.Errorf("preview failed for %s: %v", id, err)
-			}
-			defer rows.Close()
-			
-			// Print the query results
-			prefix := "[PREVIEW]"
-			title := "Results that would be affected by the UPDATE:"
-			rowCount, err := printQueryResults(rows, qdef.ID, prefix, title)
-			if err != nil {
-				return fmt.Errorf("error printing preview results for %s: %v", id, err)
+				// For non-SELECT statements, use ExecContext, or QueryContext to
+				// print the rows returned by RETURNING (or capture them for exports)
+				var backupTable string
+				var backedUp int64
+				if keyword := statementKeyword(stmtSQL); qdef.Backup && (keyword == "UPDATE" || keyword == "DELETE") {
+					backupTable = backupTableName(qdef, i, opts.RunID, time.Now())
+					backedUp, err = exec.backupRows(qctx, opts.backupSchema(), backupTable, stmtSQL, stmtArgs)
+					if err != nil {
+						return summary, statementError(qctx, "backup failed", label, err)
+					}
+					backupTable = opts.backupSchema() + "." + backupTable
+					fmt.Fprintf(out, "[BACKUP] QueryID=%s Table=%s Rows=%d\n", label, backupTable, backedUp)
+					backups++
+					rollback.Backups = append(rollback.Backups, backupTable)
+				}
+				if qdef.RollbackSQL != "" && statementKeyword(stmtSQL) == "UPDATE" {
+					image, err := exec.preImage(qctx, stmtSQL, stmtArgs, qdef.rollbackColumns())
+					if err != nil {
+						return summary, statementError(qctx, "reading previous values failed", label, err)
+					}
+					if undo, err = qdef.rollbackStatements(opts.RunID, stepParams, args, image); err != nil {
+						return summary, err
+					}
+					shape := queries[qdef.ID].rollbackParams(stepParams)
+					for j := range undo {
+						undo[j].Role = qdef.DatabaseRole
+						undo[j].SessionParams = rollbackSession(sessionParams, opts.SearchPath)
+						undo[j].Params = shape
+					}
+				}
+				stmtStart := time.Now()
+				stopHeartbeat := opts.Heartbeat.start(label)
+				var n int64
+				var rows *sql.Rows
+				var err error
+				switch {
+				case hasReturning(stmtSQL):
+					rows, err = exec.QueryContext(qctx, label, stmtSQL, stmtArgs...)
+				case capture != nil:
+					n, err = exec.queryExports(qctx, label, stmtSQL, stmtArgs, capture)
+				default:
+					var res sql.Result
+					if res, err = exec.ExecContext(qctx, label, stmtSQL, stmtArgs...); err == nil {
+						n, _ = res.RowsAffected()
+					}
+				}
+				stopHeartbeat()
+				if err != nil {
+					return summary, statementError(qctx, "execution error", label, err)
+				}
+				if rows != nil {
+					// Print the returned rows, which count as the rows affected
+					rowCount, err := opts.writeResults(rows, label, "[EXECUTED]", "Returned rows:", opts.columnMasks(qdef), capture, stmtStart)
+					rows.Close()
+					if err != nil {
+						return summary, fmt.Errorf("error printing returned rows for %s: %w", label, err)
+					}
+					n = int64(rowCount)
+				}
+				elapsed := time.Since(stmtStart)
+				stmtResult := summary.add(qdef.ID, label, modeExecuted, n, elapsed)
+				stmtResult.Plan = plan
+				if backupTable != "" {
+					stmtResult.Backup = backupTable
+					stmtResult.BackupRows = backedUp
+					if err := checkBackupCount(label, backedUp, n); err != nil {
+						return summary, err
+					}
+				}
+				if err := qdef.checkRowsAffected(i, n, queryRows+n); err != nil {
+					return summary, err
+				}
+
+				queryRows += n
+				line := fmt.Sprintf("[EXECUTED] QueryID=%s RowsAffected=%d Duration=%s", label, n, formatDuration(elapsed))
+				if activeRole != "" {
+					line += " Role=" + activeRole
+				}
+				fmt.Fprintln(out, line)
 			}
-			
-			fmt.Printf("Total rows that would be affected: %d\n\n", rowCount)
-			continue
-		} else {
-			// For non-SELECT statements, use ExecContext
-			res, err := tx.ExecContext(ctx, qdef.SQL, args...)
-			if err != nil {
-				return fmt.Errorf("execution error for %s: %v", id, err)
+		}
+
+		if err := restoreSession(qctx); err != nil {
+			return summary, statementError(qctx, "session parameters failed", qdef.ID, err)
+		}
+		if undo != nil {
+			rollback.Queries = append(rollback.Queries, qdef.ID)
+			rollback.Statements = append(undo, rollback.Statements...)
+		}
+		if result != nil {
+			if err := result.checkExpect(qdef.Expect); err != nil {
+				return summary, err
 			}
-			n, _ := res.RowsAffected()
-			if qdef.MaxRowsAffected > 0 && int(n) > qdef.MaxRowsAffected {
-				return fmt.Errorf("exceeded row limit for %s: %d > %d", id, n, qdef.MaxRowsAffected)
+			if len(qdef.Exports) > 0 {
+				if err := result.storeExports(qdef.Exports, exported); err != nil {
+					return summary, err
+				}
+				fmt.Fprintf(out, "[EXPORT] QueryID=%s %s\n\n", qdef.ID, result.describeExports(qdef.Exports))
 			}
+		}
 
-			fmt.Printf("[EXECUTED] QueryID=%s RowsAffected=%d\n", qdef.ID, n)
+		observeQuery(qdef.ID, approve, time.Since(start), queryRows)
+		querySpan.SetAttributes(attribute.Int64("dbexec.rows", queryRows))
+		endSpan(querySpan, nil)
+		querySpan = nil
+		currentQuery = ""
+		cancelQuery()
+		if err := opts.Bulk.rowDone(queryRows); err != nil {
+			return summary, err
 		}
 	}
+	current = "COMMIT"
 
 	if approve {
+		// Write the rollback script before committing, so a run that can't
+		// record how to undo it isn't committed.
+		if len(rollback.Queries) > 0 || len(rollback.Backups) > 0 {
+			rollback.CreatedAt = time.Now().UTC()
+			path, err := rollback.write(opts.rollbackDir())
+			if err != nil {
+				return summary, err
+			}
+			summary.Rollback = path
+			defer func() {
+				if !summary.Committed {
+					os.Remove(path)
+					summary.Rollback = ""
+				}
+			}()
+		}
+		commitStart := time.Now()
 		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("failed to commit transaction: %w", err)
+			return summary, fmt.Errorf("failed to commit transaction: %w", err)
 		}
 		tx = nil // Prevent rollback in defer
-		fmt.Println("All queries committed successfully.")
-	} else {
-		fmt.Println("Dry run completed. No changes applied.")
+		summary.Committed = true
+		summary.CommitTime = durationMS(time.Since(commitStart))
+		if backups > 0 {
+			fmt.Fprintf(out, "%d backup tables kept in %s until dropped; list them with dbexec list-backups --older-than 720h\n", backups, opts.backupSchema())
+		}
+		if summary.Rollback != "" {
+			fmt.Fprintf(out, "[ROLLBACK] Script=%s Statements=%d; undo with dbexec rollback %s\n", summary.Rollback, len(rollback.Statements), opts.RunID)
+		}
+		summary.Elapsed = durationMS(time.Since(runStart))
+		runPostCommitHooks(ctx, out, ids, opts.PostCommit, summary)
+		if !opts.OmitSummary {
+			fmt.Fprintln(out, "All queries committed successfully.")
+			fmt.Fprintf(out, "Total elapsed: %s (commit: %s)\n", formatDuration(time.Since(runStart)), formatDuration(time.Duration(summary.CommitTime)))
+		}
+	} else if !opts.OmitSummary {
+		fmt.Fprintln(out, "Dry run completed. No changes applied.")
+		fmt.Fprintf(out, "Total elapsed: %s\n", formatDuration(time.Since(runStart)))
 	}
-	return nil
+	if opts.results != nil && !opts.OmitSummary {
+		writeOutputFiles(out, opts.results.written())
+	}
+	if opts.Format == formatJSON && !opts.OmitSummary {
+		summary.Elapsed = durationMS(time.Since(runStart))
+		if err := summary.writeJSON(opts.Out); err != nil {
+			return summary, fmt.Errorf("failed to write summary: %w", err)
+		}
+	}
+	return summary, nil
 }
 
-func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL is required")
+// previewQuery derives a SELECT over the rows an UPDATE or DELETE statement
+// would touch, keeping the statement's WHERE clause and placeholders.
+func previewQuery(stmtSQL string) (string, error) {
+	tableName, where, err := previewParts(stmtSQL)
+	if err != nil {
+		return "", err
+	}
+
+	// Build a simple SELECT statement
+	if where != "" {
+		return fmt.Sprintf("SELECT * FROM %s %s", tableName, where), nil
+	}
+	return fmt.Sprintf("SELECT * FROM %s", tableName), nil
+}
+
+// previewParts splits an UPDATE or DELETE statement into the table it
+// modifies, with any alias, and its WHERE clause ("" when it has none).
+func previewParts(stmtSQL string) (tableName, where string, err error) {
+	// Normalize SQL by removing newlines and extra spaces
+	normalizedSQL := strings.Join(strings.Fields(stmtSQL), " ")
+	upper := strings.ToUpper(normalizedSQL)
+
+	// Find key parts of the SQL
+	whereIndex := strings.Index(upper, " WHERE ")
+
+	switch statementKeyword(stmtSQL) {
+	case "UPDATE":
+		updateIndex := strings.Index(upper, "UPDATE ")
+		setIndex := strings.Index(upper, " SET ")
+		if updateIndex == -1 || setIndex == -1 || updateIndex > setIndex {
+			return "", "", fmt.Errorf("could not parse UPDATE statement for preview")
+		}
+		tableName = strings.TrimSpace(normalizedSQL[updateIndex+7 : setIndex])
+		if whereIndex != -1 && whereIndex < setIndex {
+			whereIndex = -1
+		}
+	case "DELETE":
+		fromIndex := strings.Index(upper, "DELETE FROM ")
+		if fromIndex == -1 {
+			return "", "", fmt.Errorf("could not parse DELETE statement for preview")
+		}
+		tableEnd := len(normalizedSQL)
+		if whereIndex != -1 {
+			tableEnd = whereIndex
+		}
+		tableName = strings.TrimSpace(normalizedSQL[fromIndex+12 : tableEnd])
+	default:
+		return "", "", fmt.Errorf("could not derive a preview query for %s statement", statementKeyword(stmtSQL))
+	}
+
+	if whereIndex != -1 {
+		where = strings.TrimSpace(normalizedSQL[whereIndex:])
+	}
+	return tableName, where, nil
+}
+
+// countQuery wraps a preview query so it returns only the number of rows.
+func countQuery(previewSQL string) string {
+	return fmt.Sprintf("SELECT count(*) FROM (%s) AS preview", previewSQL)
+}
+
+// count runs a query returning a single count.
+func (e txExecutor) count(ctx context.Context, key, query string, args []interface{}) (int64, error) {
+	rows, err := e.QueryContext(ctx, key, query, args...)
+	if err != nil {
+		return 0, err
 	}
+	defer rows.Close()
+	var n int64
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("count returned no rows")
+	}
+	if err := rows.Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, rows.Err()
+}
+
+// newRunID returns a random identifier for a run.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// loadQueries loads the query definitions configured through the environment
+// or --queries-url, or the catalog embedded in the binary if it has one.
+// Catalogs at HTTP(S) URLs are fetched into a local cache first.
+func loadQueries() error {
 	yamlPath := os.Getenv("QUERY_DEFINITIONS_PATH")
-	if yamlPath == "" {
+	if queriesURL != "" {
+		if !isCatalogURL(queriesURL) {
+			return fmt.Errorf("--queries-url must be an http:// or https:// URL")
+		}
+		yamlPath = queriesURL
+	}
+	var fsys fs.FS
+	switch {
+	case embeddedQueries != nil:
+		if yamlPath != "" {
+			return fmt.Errorf("this binary has an embedded query catalog, which QUERY_DEFINITIONS_PATH or --queries-url cannot replace")
+		}
+		fsys, yamlPath = embeddedQueries, embeddedQueriesFile
+	case requireEmbeddedQueries:
+		return fmt.Errorf("--embedded-queries: this binary was built without an embedded query catalog (build with -tags embedqueries)")
+	case yamlPath == "":
 		yamlPath = "queries.yaml"
+	case isCatalogURL(yamlPath):
+		path, err := fetchCatalog(yamlPath)
+		if err != nil {
+			return err
+		}
+		yamlPath = path
 	}
-	if err := loadQueriesFromYAML(yamlPath); err != nil {
-		log.Fatalf("Failed to load queries: %v", err)
+	if err := loadQueriesFromYAML(fsys, yamlPath); err != nil {
+		return fmt.Errorf("failed to load queries: %w", err)
+	}
+	return nil
+}
+
+// Supported database drivers.
+const (
+	driverPQ  = "postgres" // github.com/lib/pq
+	driverPgx = "pgx"      // github.com/jackc/pgx/v5/stdlib
+)
+
+// openDatabase opens the database configured through the environment using
+// the named driver.
+func openDatabase(driver, target string) (*sql.DB, error) {
+	dbURL, err := databaseURL(target)
+	if err != nil {
+		return nil, err
+	}
+	return openDatabaseURL(driver, dbURL)
+}
+
+// openDatabaseURL opens a connection pool for the connection string dbURL.
+func openDatabaseURL(driver, dbURL string) (*sql.DB, error) {
+	if driver != driverPQ && driver != driverPgx {
+		return nil, fmt.Errorf("unsupported driver: %s", driver)
+	}
+	return sql.Open(driver, dbURL)
+}
+
+// writeParamSchemas writes a JSON object mapping each query ID to a JSON
+// Schema of its parameters. If ids is empty, every query is included.
+func writeParamSchemas(out io.Writer, ids []string) error {
+	if len(ids) == 0 {
+		for id := range queries {
+			ids = append(ids, id)
+		}
+	}
+	schemas := map[string]interface{}{}
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, id)
+		}
+		schemas[qdef.ID] = qdef.paramSchema()
 	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schemas)
+}
 
-	db, err := sql.Open("postgres", dbURL)
+func main() {
+	var err error
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			err = serve(os.Args[2:])
+		case "list":
+			err = listQueries(os.Stdout, os.Args[2:])
+		case "list-backups":
+			err = listBackups(os.Stdout, os.Args[2:])
+		case "plan":
+			err = runPlan(os.Args[2:])
+		case "apply":
+			err = runApply(os.Args[2:])
+		case "approve-plan":
+			err = approvePlan(os.Args[2:])
+		case "rollback":
+			err = runRollback(os.Args[2:])
+		case "bench":
+			err = runBench(os.Stdout, os.Args[2:])
+		default:
+			err = runCLI()
+		}
+	} else {
+		err = runCLI()
+	}
 	if err != nil {
-		log.Fatal(err)
+		slog.Error(err.Error())
+		os.Exit(exitCode(err))
 	}
-	defer db.Close()
+}
 
+// runCLI runs the default command, previewing or executing queries selected
+// by the command-line flags. Errors are returned rather than logged so the
+// deferred cleanup, including rolling back an open transaction, always runs.
+func runCLI() error {
 	// CLI flags
 	queryIDs := flag.String("queries", "", "Comma-separated list of query IDs to run")
+	tags := flag.String("tags", "", "Also run every query carrying all of these comma-separated tags")
+	tagsAny := flag.Bool("tags-any", false, "With --tags, select queries carrying any of the tags")
+	runbook := flag.String("runbook", "", "Run the named runbook's queries in order")
+	foreachCSV := flag.String("foreach-csv", "", "Run the selected query once per row of this CSV file, whose header names its parameters")
+	maxQueries := flag.Int("max-queries", 0, "Refuse to run more than this many queries in one invocation (0 for DBEXEC_MAX_QUERIES, or no limit when it is unset)")
+	txMode := flag.String("tx", txSingle, "Transaction mode: single, per-query to commit each query (or --foreach-csv row) separately, or per-database to run the queries of each database in their own transaction")
+	perQueryTx := flag.Bool("per-query-tx", false, "Commit each query in its own transaction, so a later failure doesn't undo earlier ones (same as --tx=per-query)")
+	progressEvery := flag.Int("progress-every", 100, "With --foreach-csv, report progress on stderr every this many rows (0 disables)")
+	maxTotalRows := flag.Int64("max-total-rows", 0, "With --foreach-csv, abort once the rows affected across all rows exceed this (0 for no limit)")
+	parallel := flag.Int("parallel", 1, "Run up to this many independent queries at once, each in its own transaction on a separate connection; queries that write need --tx=per-query")
+	testID := flag.String("test", "", "Run a single query in a transaction that is always rolled back, for authoring queries")
 	paramsJSON := flag.String("params", "", "JSON string of parameters for all queries")
 	approve := flag.Bool("approve", false, "Set to true to execute (false for preview)")
+	reason := flag.String("reason", "", "Reason for the run, such as \"JIRA-123: cleanup orphaned sessions\", recorded in the audit log and run summary (required to execute requires_approval queries)")
+	driver := flag.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	connectRetries := flag.Int("connect-retries", 2, "Retry connecting to the database this many times, with exponential backoff, before giving up")
+	connectTimeout := flag.Duration("connect-timeout", 10*time.Second, "Time limit of each connection attempt (0 for no limit)")
+	pool := registerPoolFlags(flag.CommandLine)
+	postCommit := registerPostCommitFlags(flag.CommandLine)
+	output := flag.String("output", formatText, "Result format: text, table, json, csv, copy-csv (CSV exported by Postgres with COPY; pgx driver) or template")
+	templateText := flag.String("template", "", "With --output template, a Go text/template executed for each result row, such as 'order {{.id}}: {{.status}}'")
+	templateFile := flag.String("template-file", "", "With --output template, read the row template from this file")
+	showRedacted := flag.Bool("show-redacted", false, "Show the values of the queries' redact_columns and mask_columns in results, after confirming on the terminal")
+	byteaFormat := flag.String("bytea-format", byteaBase64, "How bytea values are shown in results: base64 or hex")
+	flag.StringVar(byteaFormat, "binary-format", *byteaFormat, "Alias of --bytea-format")
+	binaryMaxBytes := flag.Int("binary-max-bytes", defaultBinaryMaxBytes, "In text and table output, show only this many bytes of bytea values, followed by their length (0 for no limit)")
+	maxColWidth := flag.Int("max-col-width", 40, "With --output table, cut values longer than this many characters short with an ellipsis (0 for no limit)")
+	tz := flag.String("tz", envOr("DBEXEC_TZ", "UTC"), "Time zone timestamptz values are shown in, such as America/New_York or Local (JSON output always uses UTC)")
+	flag.StringVar(tz, "timezone", *tz, "Alias of --tz")
+	fetchSize := flag.Int("fetch-size", 0, "Read the results of SELECT statements and previews through a server-side cursor, this many rows at a time, so large results aren't held in memory (Postgres; 0 reads them whole)")
+	maxResultRows := flag.Int("max-result-rows", 0, "Write at most this many rows of each result set, still counting the rest (0 for no limit)")
+	rawJSON := flag.Bool("raw-json", false, "Show json and jsonb values as they are in text output and as strings in JSON output, instead of pretty-printed and nested")
+	jsonMaxBytes := flag.Int("json-max-bytes", defaultJSONMaxBytes, "In text output, cut json values longer than this many bytes short with a note of their size (0 for no limit)")
+	nullString := flag.String("null-string", "<NULL>", "How NULL values are shown in text, table and CSV results (CSV defaults to an empty field)")
+	outputDir := flag.String("output-dir", "", "Write each query's results to <dir>/<run-id>/<id>.<ext> (preview-<id>.<ext> in dry runs) instead of stdout")
+	force := flag.Bool("force", false, "With --output-dir, write into a run's directory even if it already exists")
+	outputFile := flag.String("output-file", "", "Write results to this file instead of stdout")
+	quiet := flag.Bool("quiet", false, "Suppress progress reports for long-running statements")
+	heartbeatInterval := flag.Duration("heartbeat", 10*time.Second, "Report statements still running after this long, and again at this interval")
+	metricsTextfile := flag.String("metrics-textfile", "", "Write Prometheus metrics for this run to a node_exporter textfile")
+	var explain explainFlag
+	flag.Var(&explain, "explain", "Print each statement's plan before running it; --explain=analyze also executes it (dry runs only)")
+	transactionTimeout := flag.Duration("transaction-timeout", 0, "Abort and roll back if the whole transaction takes longer than this (0 for no limit)")
+	queryTimeout := flag.Duration("query-timeout", 0, "Abort and roll back if any single query takes longer than this (0 for no limit)")
+	lock := flag.String("lock", "", "Take the Postgres advisory lock of this name for the run's transaction, so runs sharing it never overlap")
+	lockWait := flag.Bool("lock-wait", true, "Wait for a lock held by another run, bounded by --lock-timeout; false fails at once, naming the lock")
+	lockTimeout := flag.Duration("lock-timeout", 0, "Fail if another run holds a lock, --lock or a query's lock_key, for longer than this (0 waits until it is released)")
+	lockImpact := flag.Bool("lock-impact", false, "Before previewing each UPDATE and DELETE, show the locks it would take and warn about sessions it would wait for (Postgres)")
+	ignorePlanCost := flag.Bool("ignore-plan-cost", false, "Skip the max_plan_cost guardrail (emergencies only)")
+	allowFullTable := flag.Bool("allow-full-table", false, "Permit executing queries with allow_full_table: true (UPDATE or DELETE without WHERE)")
+	target := flag.String("target", os.Getenv("DBEXEC_TARGET"), "Connection profile from the targets file to run against (default DATABASE_URL); a comma-separated list runs against each")
+	flag.StringVar(target, "env", *target, "Alias of --target")
+	confirmEnv := flag.String("confirm-env", "", "Name of the production target being executed against, confirming the choice (comma-separated for several)")
+	var dbURLs listFlag
+	flag.Var(&dbURLs, "db-url", "Connection string to use instead of DATABASE_URL; repeat it to run against each database")
+	onError := flag.String("on-error", onErrorStop, "When running against several targets or with --parallel: stop, or continue with the remaining targets or queries after one fails")
+	readDBURL := flag.String("read-db-url", os.Getenv("READ_DATABASE_URL"), "Connection string of a read replica for runs whose queries only read")
+	role := flag.String("role", os.Getenv("DBEXEC_ROLE"), "Role of the operator, checked against each query's required_role")
+	allowDDL := flag.Bool("allow-ddl", false, "Permit executing queries with allow_ddl: true (TRUNCATE, ALTER, DROP, CREATE, ...)")
+	searchPath := flag.String("search-path", os.Getenv("DBEXEC_SEARCH_PATH"), "Comma-separated schemas set as the search_path of the transaction, such as tenant_042,public")
+	backupSchema := flag.String("backup-schema", envOr("DBEXEC_BACKUP_SCHEMA", defaultBackupSchema), "Schema the backup tables of queries with backup: true are created in")
+	rollbackDir := flag.String("rollback-dir", envOr("DBEXEC_ROLLBACK_DIR", defaultRollbackDir), "Directory the rollback scripts of committed runs are written to")
+	countOnly := flag.Bool("count-only", false, "Preview UPDATE and DELETE statements by counting the rows they would affect instead of printing them")
+	showSQL := flag.Bool("show-sql", false, "Print each statement and its bound arguments (sensitive parameters redacted) before it runs")
+	summaryJSON := flag.String("summary-json", "", "Write a JSON summary of the run, including any error, to this file")
+	overrideWindow := flag.Bool("override-window", false, "Execute queries outside their allowed_windows (recorded in the audit log)")
+	flag.StringVar(&queriesURL, "queries-url", "", "Load the query catalog from this HTTP(S) URL instead of QUERY_DEFINITIONS_PATH, caching it locally")
+	flag.BoolVar(&requireEmbeddedQueries, "embedded-queries", false, "Load queries only from the catalog embedded in the binary, never from disk")
+	schedule := flag.String("schedule", "", "Keep running and execute the selected queries (with --approve) whenever this cron spec fires, such as \"0 3 * * *\"")
+	describe := flag.String("describe", "", "Print the definition of this query as loaded, with defaults applied, in YAML (or JSON with --output json) and exit")
+	interactiveParams := flag.Bool("interactive-params", false, "Ask for every parameter missing from --params on the terminal (the default when stdin is a terminal), reading secret ones without echo")
+	paramSchema := flag.Bool("param-schema", false, "Print a JSON Schema of the parameters of each query (or of --queries) and exit")
+	repl := flag.Bool("repl", false, "Start an interactive shell to list, describe and run queries, previewing each run and confirming before executing it")
+	logs := registerLogFlags(flag.CommandLine)
 	flag.Parse()
+	if err := logs.setup(); err != nil {
+		return err
+	}
 
-	if *queryIDs == "" || *paramsJSON == "" {
-		log.Fatal("You must provide --queries and --params")
+	if err := loadQueries(); err != nil {
+		return err
 	}
 
-	var params map[string]string
-	if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
-		log.Fatalf("Failed to parse parameters: %v", err)
+	ids, stepParams, err := selectRun(*queryIDs, *tags, *tagsAny, *runbook)
+	if err != nil {
+		return err
+	}
+	if *testID != "" {
+		if len(ids) > 0 {
+			return fmt.Errorf("--test cannot be combined with --queries, --tags or --runbook")
+		}
+		if *approve {
+			return fmt.Errorf("--test always rolls back and cannot be combined with --approve")
+		}
+		ids = []string{*testID}
+		if *paramsJSON == "" {
+			*paramsJSON = "{}"
+		}
+	}
+	if *describe != "" {
+		return describeQuery(os.Stdout, *describe, *output)
+	}
+	if *paramSchema {
+		if err := writeParamSchemas(os.Stdout, ids); err != nil {
+			return err
+		}
+		return nil
 	}
 
-	ids := strings.Split(*queryIDs, ",")
-	if err := runQueriesInTransaction(db, ids, params, *approve); err != nil {
-		log.Fatalf("Error executing queries: %v", err)
+	if *repl {
+		if !isTerminal(os.Stdin) {
+			return fmt.Errorf("--repl needs a terminal on stdin")
+		}
+		if len(ids) > 0 || *testID != "" || *approve || *foreachCSV != "" || *schedule != "" || *readDBURL != "" || *parallel > 1 || len(dbURLs) > 1 || len(splitList(*target)) > 1 {
+			return fmt.Errorf("--repl selects and confirms queries itself and cannot be combined with --queries, --tags, --runbook, --test, --approve, --foreach-csv, --schedule, --read-db-url, --parallel or several targets")
+		}
 	}
-}
 
-// printQueryResults formats and prints the results of a SQL query
-func printQueryResults(rows *sql.Rows, queryID, prefix, title string) (int, error) {
-	// Get column names
-	columns, err := rows.Columns()
+	// On a terminal, parameters left out of --params are asked for.
+	prompting := *interactiveParams || isTerminal(os.Stdin)
+	if *interactiveParams && !isTerminal(os.Stdin) {
+		return fmt.Errorf("--interactive-params needs a terminal on stdin")
+	}
+	if *paramsJSON == "" && prompting {
+		*paramsJSON = "{}"
+	}
+	if !*repl && ((*queryIDs == "" && *tags == "" && *runbook == "" && *testID == "") || *paramsJSON == "") {
+		return fmt.Errorf("you must provide --queries, --tags, --runbook or --test, and --params")
+	}
+	if len(ids) == 0 && !*repl {
+		return fmt.Errorf("no queries match tags: %s", *tags)
+	}
+	if *maxQueries == 0 {
+		if v := os.Getenv("DBEXEC_MAX_QUERIES"); v != "" {
+			if *maxQueries, err = strconv.Atoi(v); err != nil || *maxQueries < 0 {
+				return fmt.Errorf("invalid DBEXEC_MAX_QUERIES %q: must be a non-negative integer", v)
+			}
+		}
+	}
+	if *maxQueries < 0 {
+		return fmt.Errorf("--max-queries cannot be negative")
+	}
+	if *maxQueries > 0 && len(ids) > *maxQueries {
+		return fmt.Errorf("%d queries selected, more than --max-queries allows (%d)", len(ids), *maxQueries)
+	}
+	if err := validateFormat(*output); err != nil {
+		return err
+	}
+	var rowTemplate *template.Template
+	if *output == formatTemplate {
+		if rowTemplate, err = parseRowTemplate(*templateText, *templateFile); err != nil {
+			return err
+		}
+	} else if *templateText != "" || *templateFile != "" {
+		return fmt.Errorf("--template and --template-file require --output template")
+	}
+	if *byteaFormat != byteaBase64 && *byteaFormat != byteaHex {
+		return fmt.Errorf("unsupported --bytea-format: %s", *byteaFormat)
+	}
+	if displayLocation, err = time.LoadLocation(*tz); err != nil {
+		return fmt.Errorf("invalid --tz: %w", err)
+	}
+	if *lockTimeout < 0 {
+		return fmt.Errorf("--lock-timeout cannot be negative")
+	}
+	if *lock != "" && strings.TrimSpace(*lock) == "" {
+		return fmt.Errorf("--lock cannot be blank")
+	}
+	postCommitHooks, err := postCommit.hooks()
+	if err != nil {
+		return err
+	}
+	if *fetchSize < 0 {
+		return fmt.Errorf("--fetch-size cannot be negative")
+	}
+	if *maxResultRows < 0 {
+		return fmt.Errorf("--max-result-rows cannot be negative")
+	}
+	if *output == formatCopyCSV {
+		if *maxResultRows > 0 {
+			return fmt.Errorf("--max-result-rows cannot be combined with --output copy-csv")
+		}
+		if *driver != driverPgx {
+			slog.Warn("--output copy-csv needs --driver pgx; writing CSV from scanned rows instead")
+		}
+	}
+	if *binaryMaxBytes < 0 {
+		return fmt.Errorf("--binary-max-bytes cannot be negative")
+	}
+	if *binaryMaxBytes == 0 {
+		// runOptions uses 0 for the default limit.
+		*binaryMaxBytes = -1
+	}
+	if *jsonMaxBytes < 0 {
+		return fmt.Errorf("--json-max-bytes cannot be negative")
+	}
+	if *jsonMaxBytes == 0 {
+		// runOptions uses 0 for the default limit.
+		*jsonMaxBytes = -1
+	}
+	var quotedSearchPath string
+	if *searchPath != "" {
+		if quotedSearchPath, err = parseSearchPath(*searchPath); err != nil {
+			return err
+		}
+	}
+	if !schemaName.MatchString(*backupSchema) {
+		return fmt.Errorf("--backup-schema: invalid schema name %q", *backupSchema)
+	}
+	if *countOnly && *approve {
+		return fmt.Errorf("--count-only only applies to previews and cannot be combined with --approve")
+	}
+	if *approve {
+		if err := checkWriteGate(); err != nil {
+			return err
+		}
+		if err := checkReason(ids, *reason); err != nil {
+			return err
+		}
+		if err := checkUnapproved(ids); err != nil {
+			return err
+		}
+	}
+	// Only an explicit --null-string overrides CSV's empty fields.
+	var explicitNullString *string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "null-string" {
+			explicitNullString = nullString
+		}
+	})
+	if *txMode != txSingle && *txMode != txPerQuery && *txMode != txPerDatabase {
+		return fmt.Errorf("unsupported transaction mode: %s", *txMode)
+	}
+	if *perQueryTx {
+		if *txMode != txSingle && *txMode != txPerQuery {
+			return fmt.Errorf("--per-query-tx cannot be combined with --tx=%s", *txMode)
+		}
+		*txMode = txPerQuery
+	}
+	if *txMode == txPerQuery && *foreachCSV == "" && len(ids) > 1 {
+		if err := checkIndependent(ids, "--tx=per-query"); err != nil {
+			return err
+		}
+	}
+	if *foreachCSV != "" && (len(ids) != 1 || *runbook != "") {
+		return fmt.Errorf("--foreach-csv requires exactly one query")
+	}
+	var sched cron.Schedule
+	if *schedule != "" {
+		if !*approve || *testID != "" {
+			return fmt.Errorf("--schedule executes the queries and requires --approve")
+		}
+		if sched, err = parseSchedule(*schedule); err != nil {
+			return err
+		}
+	}
+	// Queries declaring a database run against it rather than the selected
+	// target; each database's queries share a transaction.
+	groups := groupByDatabase(ids, stepParams, *target)
+	if len(groups) > 1 || (len(groups) == 1 && groups[0].Target != *target) {
+		if len(splitList(*target)) > 1 || len(dbURLs) > 1 {
+			return fmt.Errorf("queries declaring a database cannot run against several targets")
+		}
+	}
+	if len(groups) == 1 && groups[0].Target != *target {
+		if len(dbURLs) > 0 {
+			return fmt.Errorf("the queries run against database %s and cannot be combined with --db-url", groups[0].Target)
+		}
+		*target = groups[0].Target
+	}
+	if len(groups) > 1 {
+		if *txMode == txSingle {
+			return fmt.Errorf("the queries run against databases %s, which one transaction cannot span: pass --tx=per-database to run each database's queries in its own transaction", strings.Join(groupTargetNames(groups), ", "))
+		}
+		if *readDBURL != "" || *parallel > 1 {
+			return fmt.Errorf("queries against several databases cannot be combined with --read-db-url or --parallel")
+		}
+	}
+	fanout, err := fanoutTargets(splitList(*target), dbURLs)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get columns: %v", err)
-	}
-	
-	fmt.Printf("%s QueryID=%s\n", prefix, queryID)
-	fmt.Println(title)
-	
-	// Prepare values to scan into
-	values := make([]interface{}, len(columns))
-	scanArgs := make([]interface{}, len(columns))
-	for i := range values {
-		scanArgs[i] = &values[i]
-	}
-	
-	// Print each row
-	rowCount := 0
-	for rows.Next() {
-		err = rows.Scan(scanArgs...)
+		return err
+	}
+	if len(fanout) > 1 {
+		if *readDBURL != "" || *foreachCSV != "" || *outputDir != "" || sched != nil || *txMode == txPerQuery {
+			return fmt.Errorf("running against several targets cannot be combined with --read-db-url, --foreach-csv, --output-dir, --schedule or --tx=per-query")
+		}
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	if *parallel > 1 && len(fanout) <= 1 {
+		if *foreachCSV != "" {
+			return fmt.Errorf("--parallel cannot be combined with --foreach-csv")
+		}
+		if err := checkParallel(ids, *txMode == txPerQuery); err != nil {
+			return err
+		}
+		if len(runLocks(*lock, *runbook)) > 0 {
+			return fmt.Errorf("--parallel cannot be combined with --lock or a runbook's lock, which every query would wait for")
+		}
+	}
+	if *onError != onErrorStop && *onError != onErrorContinue {
+		return fmt.Errorf("unsupported --on-error: %s", *onError)
+	}
+	if *outputDir != "" && *outputFile != "" {
+		return fmt.Errorf("--output-file cannot be combined with --output-dir")
+	}
+	if *outputDir != "" {
+		if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	var params Params
+	if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
+		return fmt.Errorf("failed to parse parameters: %w", err)
+	}
+	if prompting && *foreachCSV == "" {
+		if prompts := missingParams(ids, params, stepParams); len(prompts) > 0 {
+			prompted, err := promptParams(os.Stdin, os.Stderr, prompts)
+			if err != nil {
+				return err
+			}
+			params = params.withOverrides(prompted)
+		}
+	}
+	if *showRedacted {
+		if err := confirmShowRedacted(os.Stdin, os.Stderr, ids); err != nil {
+			return err
+		}
+	}
+
+	var bulk *bulkRun
+	var bulkRows []Params
+	if *foreachCSV != "" {
+		qdef, ok := queries[ids[0]]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, ids[0])
+		}
+		rows, lines, err := readBulkCSV(*foreachCSV, qdef, params)
 		if err != nil {
-			return rowCount, fmt.Errorf("error scanning row: %v", err)
-		}
-		
-		// Print each column on a new line
-		fmt.Printf("Row %d:\n", rowCount+1)
-		fmt.Println(strings.Repeat("-", 40))
-		
-		for i, col := range columns {
-			// Format the value based on type
-			var displayVal string
-			v := values[i]
-			
-			if v == nil {
-				displayVal = "<NULL>"
-			} else {
-				switch val := v.(type) {
-				case []byte:
-					// Try to convert byte slice to UUID string if it looks like a UUID
-					if len(val) == 16 {
-						// Format as UUID: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
-						displayVal = fmt.Sprintf("%x-%x-%x-%x-%x", 
-							val[0:4], val[4:6], val[6:8], val[8:10], val[10:16])
-					} else {
-						// Try to convert to string
-						displayVal = string(val)
+			return err
+		}
+		bulkRows = rows
+		bulk = &bulkRun{Lines: lines, ProgressEvery: *progressEvery, MaxTotalRows: *maxTotalRows}
+		if !*quiet {
+			bulk.Progress = os.Stderr
+		}
+	}
+
+	// A run fanned out to several targets connects to each of them in turn;
+	// a run against several databases connects to all of them up front, so
+	// none is changed when another is unreachable.
+	var db *sql.DB
+	var endpoint string
+	if len(fanout) > 1 {
+		if err := announceFanout(os.Stderr, fanout, *approve, *confirmEnv); err != nil {
+			return err
+		}
+	} else if len(groups) > 1 {
+		for i := range groups {
+			g := &groups[i]
+			if g.Target == *target && len(dbURLs) == 1 {
+				fmt.Fprintln(os.Stderr, "[TARGET] --db-url")
+				g.DB, err = openDatabaseURL(*driver, dbURLs[0])
+			} else if err = announceTarget(os.Stderr, g.Target, *approve, *confirmEnv); err == nil {
+				g.DB, err = openDatabase(*driver, g.Target)
+			}
+			if err != nil {
+				return err
+			}
+			defer g.DB.Close()
+			pool.apply(g.DB)
+			if err := preflight(context.Background(), g.DB, *connectRetries, *connectTimeout, os.Stderr); err != nil {
+				return fmt.Errorf("%s: %w", targetLabel(g.Target), err)
+			}
+		}
+	} else {
+		// A --repl session can execute queries, so a production target must
+		// be confirmed when it starts.
+		var dbURL string
+		if len(dbURLs) == 1 {
+			dbURL = dbURLs[0]
+			fmt.Fprintln(os.Stderr, "[TARGET] --db-url")
+		} else if err := announceTarget(os.Stderr, *target, *approve || *repl, *confirmEnv); err != nil {
+			return err
+		}
+		if *readDBURL != "" {
+			endpoint = endpointPrimary
+			if routeToReplica(ids) {
+				endpoint = endpointReplica
+			}
+			fmt.Fprintf(os.Stderr, "[ENDPOINT] %s\n", endpoint)
+		}
+		switch {
+		case endpoint == endpointReplica:
+			db, err = openDatabaseURL(*driver, *readDBURL)
+		case dbURL != "":
+			db, err = openDatabaseURL(*driver, dbURL)
+		default:
+			db, err = openDatabase(*driver, *target)
+		}
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		pool.apply(db)
+		if err := preflight(context.Background(), db, *connectRetries, *connectTimeout, os.Stderr); err != nil {
+			return err
+		}
+		if len(runLocks(*lock, *runbook)) > 0 && !isPostgres(db) {
+			slog.Warn("advisory locks need Postgres; the run takes no lock", "driver", *driver)
+		}
+	}
+
+	audit, err := openAuditLog(os.Getenv("DBEXEC_AUDIT_LOG"), io.Discard)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	ctx := contextFromEnvironment(context.Background())
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	var progress *heartbeat
+	if !*quiet {
+		progress = &heartbeat{W: os.Stderr, Interval: *heartbeatInterval, TTY: isTerminal(os.Stderr)}
+	}
+
+	var results io.Writer = os.Stdout
+	var resultsFile *os.File
+	if *outputFile != "" {
+		if resultsFile, err = os.Create(*outputFile); err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer resultsFile.Close()
+		results = resultsFile
+	}
+
+	opts := runOptions{
+		Approve:            *approve,
+		Out:                results,
+		Diag:               os.Stderr,
+		Format:             *output,
+		Template:           rowTemplate,
+		NullString:         explicitNullString,
+		OutputDir:          *outputDir,
+		Force:              *force,
+		Heartbeat:          progress,
+		Explain:            string(explain),
+		IgnorePlanCost:     *ignorePlanCost,
+		LockImpact:         *lockImpact,
+		TransactionTimeout: *transactionTimeout,
+		Locks:              runLocks(*lock, *runbook),
+		LockTimeout:        *lockTimeout,
+		LockNoWait:         !*lockWait,
+		PostCommit:         postCommitHooks,
+		QueryTimeout:       *queryTimeout,
+		StepParams:         stepParams,
+		OverrideWindow:     *overrideWindow,
+		AllowDDL:           *allowDDL,
+		Role:               *role,
+		AllowFullTable:     *allowFullTable,
+		ShowSQL:            *showSQL,
+		CountOnly:          *countOnly,
+		SearchPath:         quotedSearchPath,
+		BackupSchema:       *backupSchema,
+		RollbackDir:        *rollbackDir,
+		MaxColWidth:        *maxColWidth,
+		MaxResultRows:      *maxResultRows,
+		FetchSize:          *fetchSize,
+		RawJSON:            *rawJSON,
+		JSONMaxBytes:       *jsonMaxBytes,
+		ByteaFormat:        *byteaFormat,
+		BinaryMaxBytes:     *binaryMaxBytes,
+		ShowRedacted:       *showRedacted,
+		Target:             *target,
+		Reason:             *reason,
+	}
+	// Each batch runs in its own transaction; only --tx=per-query has more
+	// than one.
+	batches := [][]string{ids}
+	if bulk == nil && *txMode == txPerQuery {
+		batches = [][]string{}
+		for _, id := range ids {
+			batches = append(batches, []string{id})
+		}
+	}
+	if bulk != nil {
+		opts.StepParams = bulkRows
+		opts.Bulk = bulk
+		batches = [][]string{}
+		if *txMode == txPerQuery {
+			for range bulkRows {
+				batches = append(batches, ids[:1])
+			}
+		} else {
+			batches = append(batches, repeat(ids[0], len(bulkRows)))
+		}
+	}
+
+	// runOnce executes the batches, then writes the summary and metrics
+	// files.
+	runOnce := func(ctx context.Context) error {
+		if *approve {
+			if err := audit.checkRateLimits(ids, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		var summaries []*runSummary
+		var err error
+		if len(fanout) > 1 {
+			byTarget := make(map[string]*runSummary, len(fanout))
+			var mu sync.Mutex
+			err = runFanout(ctx, fanout, *parallel, *onError == onErrorStop, opts, func(ctx context.Context, t fanoutTarget, runOpts runOptions) (*runSummary, error) {
+				db, err := openDatabaseURL(*driver, t.URL)
+				if err != nil {
+					return nil, err
+				}
+				defer db.Close()
+				pool.apply(db)
+				if err := preflight(ctx, db, *connectRetries, *connectTimeout, runOpts.diagnostics()); err != nil {
+					return nil, err
+				}
+				runOpts.RunID = newRunID()
+				runOpts.Target = t.Target
+				summary, err := runQueriesInTransaction(ctx, db, ids, params, runOpts)
+				audit.Record(auditRecord{RunID: runOpts.RunID, Actor: cliActor(), Role: *role, Target: t.Name, Runbook: *runbook, Queries: ids, Approve: *approve, ShowRedacted: *showRedacted, Reason: *reason, Summary: summary}, err)
+				mu.Lock()
+				byTarget[t.Name] = summary
+				mu.Unlock()
+				return summary, err
+			})
+			for _, t := range fanout {
+				if summary, ok := byTarget[t.Name]; ok {
+					summaries = append(summaries, summary)
+				}
+			}
+		} else if len(groups) > 1 {
+		groupLoop:
+			for _, g := range groups {
+				fmt.Fprintf(opts.diagnostics(), "===== Target=%s Queries=%s =====\n", targetLabel(g.Target), strings.Join(g.IDs, ","))
+				groupBatches := [][]string{g.IDs}
+				if *txMode == txPerQuery {
+					groupBatches = [][]string{}
+					for _, id := range g.IDs {
+						groupBatches = append(groupBatches, []string{id})
+					}
+				}
+				for i, batch := range groupBatches {
+					runOpts := opts
+					runOpts.RunID = newRunID()
+					runOpts.Target = g.Target
+					runOpts.StepParams = g.StepParams
+					if len(groupBatches) > 1 && g.StepParams != nil {
+						runOpts.StepParams = g.StepParams[i : i+1]
+					}
+					var summary *runSummary
+					summary, err = runQueriesInTransaction(ctx, g.DB, batch, params, runOpts)
+					audit.Record(auditRecord{RunID: runOpts.RunID, Actor: cliActor(), Role: *role, Target: g.Target, Runbook: *runbook, Queries: batch, Approve: *approve, ShowRedacted: *showRedacted, Reason: *reason, Summary: summary}, err)
+					summaries = append(summaries, summary)
+					if err != nil {
+						err = fmt.Errorf("%s: %w", targetLabel(g.Target), err)
+						break groupLoop
 					}
-				case time.Time:
-					// Format time values consistently
-					displayVal = val.Format("2006-01-02 15:04:05")
-				default:
-					// Use default formatting for other types
-					displayVal = fmt.Sprintf("%v", val)
 				}
 			}
-			
-			fmt.Printf("  %s: %s\n", col, displayVal)
+		} else if *parallel > 1 {
+			runOpts := opts
+			runOpts.RunID = newRunID()
+			summaries, err = runQueriesInParallel(ctx, ids, *parallel, *onError == onErrorStop, runOpts, func(ctx context.Context, i int, runOpts runOptions) (*runSummary, error) {
+				summary, err := runQueriesInTransaction(ctx, db, ids[i:i+1], params, runOpts)
+				audit.Record(auditRecord{RunID: runOpts.RunID, Actor: cliActor(), Role: *role, Target: *target, Endpoint: endpoint, Runbook: *runbook, Queries: ids[i : i+1], Approve: *approve, ShowRedacted: *showRedacted, Reason: *reason, Summary: summary}, err)
+				return summary, err
+			})
+		} else {
+			for i, batch := range batches {
+				runOpts := opts
+				runOpts.RunID = newRunID()
+				if len(batches) > 1 && opts.StepParams != nil {
+					runOpts.StepParams = opts.StepParams[i : i+1]
+				}
+				var summary *runSummary
+				summary, err = runQueriesInTransaction(ctx, db, batch, params, runOpts)
+				auditIDs := batch
+				if bulk != nil {
+					auditIDs = ids
+				}
+				audit.Record(auditRecord{RunID: runOpts.RunID, Actor: cliActor(), Role: *role, Target: *target, Endpoint: endpoint, Runbook: *runbook, CSV: *foreachCSV, Queries: auditIDs, Approve: *approve, ShowRedacted: *showRedacted, Reason: *reason, Summary: summary}, err)
+				summaries = append(summaries, summary)
+				if err != nil {
+					break
+				}
+			}
+		}
+		// --parallel reports the outcome of each query itself.
+		if *txMode == txPerQuery && bulk == nil && len(ids) > 1 && *parallel == 1 {
+			reportPerQuery(opts.diagnostics(), perQueryOrder(groups), summaries, err)
+		}
+		if *summaryJSON != "" {
+			if serr := newRunReport(*approve, summaries, err).writeFile(*summaryJSON); serr != nil {
+				slog.Error("failed to write summary", "path", *summaryJSON, "error", serr)
+			}
 		}
-		fmt.Println()
-		rowCount++
+		if *metricsTextfile != "" {
+			if merr := writeMetricsTextfile(*metricsTextfile); merr != nil {
+				slog.Error("failed to write metrics", "path", *metricsTextfile, "error", merr)
+			}
+		}
+		return err
 	}
-	
-	if err = rows.Err(); err != nil {
-		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+
+	switch {
+	case *repl:
+		err = replSession{DB: db, Opts: opts, Params: params, Audit: audit, Format: *output}.run(ctx, os.Stdin)
+	case sched != nil:
+		err = runScheduled(ctx, sched, runOnce)
+	default:
+		err = runOnce(ctx)
 	}
-	
-	return rowCount, nil
+	if resultsFile != nil {
+		if cerr := resultsFile.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to close output file: %w", cerr)
+		}
+	}
+	if serr := shutdownTracing(context.Background()); serr != nil {
+		slog.Error("failed to flush traces", "error", serr)
+	}
+	if err != nil {
+		return fmt.Errorf("error executing queries: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRunManySelects(t *testing.T) {
+	const n = 50
+	var catalog strings.Builder
+	var ids []string
+	results := map[string]fakeResult{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("report_%d", i)
+		sql := fmt.Sprintf("SELECT id FROM report_%d", i)
+		fmt.Fprintf(&catalog, "- id: %s\n  sql: %s\n", id, sql)
+		ids = append(ids, id)
+		results[sql] = fakeResult{Columns: []string{"id"}, Types: []string{"INT4"}, Rows: [][]driver.Value{{int64(1)}, {int64(2)}}}
+	}
+	loadTestQueries(t, catalog.String())
+	db, fake := newFakeDB(t, results)
+	// Like a Postgres connection, the transaction's connection serves one
+	// result set at a time.
+	fake.maxOpenRows = 1
+
+	summary, err := runQueriesInTransaction(context.Background(), db, ids, Params{}, runOptions{Out: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Statements) != n {
+		t.Fatalf("got %d statements in the summary, want %d", len(summary.Statements), n)
+	}
+	for _, stmt := range summary.Statements {
+		if stmt.Rows != 2 {
+			t.Errorf("%s: got %d rows, want 2", stmt.QueryID, stmt.Rows)
+		}
+	}
+	if open := fake.openRows.Load(); open != 0 {
+		t.Errorf("%d result sets left open", open)
+	}
+}
+
+func TestResultPayloadSeparatedFromDiagnostics(t *testing.T) {
+	loadTestQueries(t, `
+- id: users
+  sql: SELECT id, name FROM users
+`)
+	db, _ := newFakeDB(t, map[string]fakeResult{
+		"SELECT id, name FROM users": {
+			Columns: []string{"id", "name"},
+			Types:   []string{"INT4", "TEXT"},
+			Rows:    [][]driver.Value{{int64(1), "ada"}, {int64(2), nil}},
+		},
+	})
+	var out, diag strings.Builder
+	if _, err := runQueriesInTransaction(context.Background(), db, []string{"users"}, Params{}, runOptions{Format: formatCSV, Out: &out, Diag: &diag}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "id,name\n1,ada\n2,\n"; got != want {
+		t.Errorf("payload = %q, want %q", got, want)
+	}
+	for _, want := range []string{"Total rows: 2", "Dry run completed"} {
+		if !strings.Contains(diag.String(), want) {
+			t.Errorf("diagnostics don't contain %q:\n%s", want, diag.String())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsRegistry holds the dbexec metrics. It is served on /metrics in server
+// mode and can be written to a node_exporter textfile after CLI runs.
+// Labels never carry parameter values.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbexec_runs_total",
+		Help: "Number of runs by mode (preview or approve) and outcome.",
+	}, []string{"mode", "outcome"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dbexec_query_duration_seconds",
+		Help:    "Execution time of each query.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"query_id", "mode"})
+
+	rowsAffectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbexec_rows_affected_total",
+		Help: "Rows returned, affected, or that would be affected in preview, per query.",
+	}, []string{"query_id", "mode"})
+
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbexec_queries_total",
+		Help: "Number of queries executed successfully.",
+	}, []string{"query_id", "mode"})
+
+	queryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbexec_query_errors_total",
+		Help: "Number of failed queries by error class.",
+	}, []string{"query_id", "mode", "class"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(runsTotal, queryDuration, rowsAffectedTotal, queriesTotal, queryErrorsTotal)
+}
+
+// Error classes used as the class label of dbexec_query_errors_total.
+const (
+	errClassTimeout  = "timeout"   // a transaction or query deadline expired
+	errClassCanceled = "canceled"  // the run was canceled, e.g. the client went away
+	errClassDatabase = "database"  // the database rejected a statement
+	errClassRejected = "rejected"  // dbexec refused to continue: parameters, row limit, plan cost
+	errClassAssert   = "assertion" // a result violated the query's expect block
+)
+
+// errorClass classifies err, returned while running a query under the given
+// transaction and query contexts (qctx may be nil).
+func errorClass(err error, ctx, qctx context.Context) string {
+	var assertErr *assertionError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded),
+		qctx != nil && errors.Is(qctx.Err(), context.DeadlineExceeded),
+		sqlState(err) == sqlStateQueryCanceled, sqlState(err) == sqlStateLockNotAvailable:
+		return errClassTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		return errClassCanceled
+	case sqlState(err) != "":
+		return errClassDatabase
+	case errors.As(err, &assertErr):
+		return errClassAssert
+	}
+	return errClassRejected
+}
+
+// runMode returns the metrics label for a run.
+func runMode(approve bool) string {
+	if approve {
+		return "approve"
+	}
+	return "preview"
+}
+
+// observeQuery records the duration and row count of a single query.
+func observeQuery(queryID string, approve bool, elapsed time.Duration, rows int64) {
+	mode := runMode(approve)
+	queryDuration.WithLabelValues(queryID, mode).Observe(elapsed.Seconds())
+	rowsAffectedTotal.WithLabelValues(queryID, mode).Add(float64(rows))
+	queriesTotal.WithLabelValues(queryID, mode).Inc()
+}
+
+// observeQueryError records a failed query.
+func observeQueryError(queryID string, approve bool, class string) {
+	queryErrorsTotal.WithLabelValues(queryID, runMode(approve), class).Inc()
+}
+
+// observeRun records the outcome of a run.
+func observeRun(approve bool, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	runsTotal.WithLabelValues(runMode(approve), outcome).Inc()
+}
+
+// writeMetricsTextfile writes the current metrics to path in the Prometheus
+// text format for node_exporter's textfile collector.
+func writeMetricsTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, metricsRegistry)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifyActor is recorded in the audit log as the actor of runs triggered by
+// a notification on channel.
+func notifyActor(channel string) string {
+	return "notify:" + channel
+}
+
+// notifyBinding runs a query whenever a notification arrives on a channel.
+type notifyBinding struct {
+	Channel string
+	QueryID string
+}
+
+// notifyFlag collects repeated --on-notify channel:query_id flags.
+type notifyFlag []notifyBinding
+
+func (f *notifyFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, b := range *f {
+		parts[i] = b.Channel + ":" + b.QueryID
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *notifyFlag) Set(v string) error {
+	channel, id, ok := strings.Cut(v, ":")
+	if !ok || channel == "" || id == "" {
+		return fmt.Errorf("must look like channel:query_id")
+	}
+	*f = append(*f, notifyBinding{Channel: channel, QueryID: id})
+	return nil
+}
+
+// checkNotifyBindings fails if a binding names an unknown query or one
+// marked requires_approval, which notifications can't execute.
+func checkNotifyBindings(bindings []notifyBinding) error {
+	for _, b := range bindings {
+		if _, ok := queries[b.QueryID]; !ok {
+			return fmt.Errorf("--on-notify %s: %w: %s", b.Channel, errUnknownQuery, b.QueryID)
+		}
+		if err := checkUnapproved([]string{b.QueryID}); err != nil {
+			return fmt.Errorf("--on-notify %s: %w", b.Channel, err)
+		}
+	}
+	return nil
+}
+
+// listenForNotifications subscribes to the channels of bindings on the
+// database at dbURL and, until ctx is done, executes the bound query for
+// every notification. The payload, if any, must be a JSON object of
+// parameters. Notifications are handled one at a time in arrival order; the
+// listener reconnects on its own when the connection drops.
+func (s *server) listenForNotifications(ctx context.Context, dbURL string, bindings []notifyBinding) error {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			slog.Warn("notification listener disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			slog.Info("notification listener reconnected; notifications sent while disconnected were missed")
+		case pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("notification listener failed to connect", "error", err)
+		}
+	})
+	subscribed := map[string]bool{}
+	for _, b := range bindings {
+		if subscribed[b.Channel] {
+			continue
+		}
+		if err := listener.Listen(b.Channel); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on channel %s: %w", b.Channel, err)
+		}
+		subscribed[b.Channel] = true
+		slog.Info("listening for notifications", "channel", b.Channel)
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-listener.Notify:
+				if n == nil {
+					// Sent after a reconnect.
+					continue
+				}
+				for _, b := range bindings {
+					if b.Channel == n.Channel {
+						s.runNotification(ctx, b, n.Extra)
+					}
+				}
+			case <-time.After(90 * time.Second):
+				// Make sure a dead connection is noticed even when nothing
+				// is sent.
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+// runNotification executes the query bound to a notification, with the
+// parameters in its payload, and records it in the audit log.
+func (s *server) runNotification(ctx context.Context, b notifyBinding, payload string) {
+	var params Params
+	if strings.TrimSpace(payload) != "" {
+		if err := json.Unmarshal([]byte(payload), &params); err != nil {
+			slog.Error("ignoring notification with invalid payload", "channel", b.Channel, "query_id", b.QueryID, "error", err)
+			return
+		}
+	}
+
+	ids := []string{b.QueryID}
+	runID := newRunID()
+	if err := s.audit.checkRateLimits(ids, time.Now()); err != nil {
+		s.audit.Record(auditRecord{RunID: runID, Actor: notifyActor(b.Channel), Target: s.target, Queries: ids, Approve: true}, err)
+		slog.Error("notification not handled", "channel", b.Channel, "query_id", b.QueryID, "error", err)
+		return
+	}
+	summary, err := runQueriesInTransaction(ctx, s.db, ids, params, runOptions{
+		Approve:    true,
+		Out:        io.Discard,
+		Stmts:      s.stmts,
+		RunID:      runID,
+		Heartbeat:  s.heartbeat,
+		Actor:      notifyActor(b.Channel),
+		Target:     s.target,
+		PostCommit: s.postCommit,
+	})
+	s.audit.Record(auditRecord{RunID: runID, Actor: notifyActor(b.Channel), Target: s.target, Queries: ids, Approve: true, Summary: summary}, err)
+	if err != nil {
+		slog.Error("notification query failed", "channel", b.Channel, "query_id", b.QueryID, "run_id", runID, "error", err)
+		return
+	}
+	slog.Info("notification query executed", "channel", b.Channel, "query_id", b.QueryID, "run_id", runID)
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Supported result formats.
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatTable    = "table"
+	formatTemplate = "template"
+	// formatCopyCSV is CSV written by Postgres through COPY TO STDOUT, for
+	// SELECT statements that can be exported that way.
+	formatCopyCSV = "copy-csv"
+)
+
+// Encodings of bytea values in results.
+const (
+	byteaBase64 = "base64"
+	byteaHex    = "hex"
+)
+
+// validateFormat checks that format names a supported result format.
+func validateFormat(format string) error {
+	switch format {
+	case formatText, formatJSON, formatCSV, formatTable, formatTemplate, formatCopyCSV:
+		return nil
+	}
+	return fmt.Errorf("unsupported output format: %s", format)
+}
+
+// formatExtension returns the file extension used for a result format.
+func formatExtension(format string) string {
+	if format == formatText || format == formatTable || format == formatTemplate {
+		return "txt"
+	}
+	if format == formatCopyCSV {
+		return formatCSV
+	}
+	return format
+}
+
+// resultFiles is the directory a run writes its result sets to with
+// --output-dir, <OutputDir>/<run ID>, and the files written to it so far.
+// Queries previewed in parallel share it.
+type resultFiles struct {
+	Dir string
+
+	mu      sync.Mutex
+	created bool
+	paths   []string
+}
+
+// create creates the file name in the run's directory, creating the
+// directory first. A directory that already exists is only written to with
+// force, so another run's results are never overwritten.
+func (r *resultFiles) create(name string, force bool) (*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.created {
+		if err := os.Mkdir(r.Dir, 0o755); err != nil {
+			if !os.IsExist(err) {
+				return nil, fmt.Errorf("failed to create output directory: %w", err)
+			}
+			if !force {
+				return nil, fmt.Errorf("output directory %s already exists; pass --force to overwrite its files", r.Dir)
+			}
+		}
+		r.created = true
+	}
+	path := filepath.Join(r.Dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	if !containsString(r.paths, path) {
+		r.paths = append(r.paths, path)
+	}
+	return f, nil
+}
+
+// written returns the paths of the files written so far, in order.
+func (r *resultFiles) written() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.paths...)
+}
+
+// writeResults renders a result set in the configured format, either to
+// opts.Out or, when OutputDir is set, to a file in the run's directory named
+// after the query ID, with a preview- prefix in dry runs. Columns the query
+// exports or asserts on are recorded in capture, which may be nil, before
+// the values of the columns in masks are masked. start is when the statement
+// began, for the duration reported in JSON output.
+func (opts runOptions) writeResults(rows resultRows, queryID, prefix, title string, masks map[string]string, capture *resultCapture, start time.Time) (int, error) {
+	return opts.writeOutput(queryID, prefix, func(out io.Writer) (int, error) {
+		return opts.writeResultSet(out, rows, queryID, prefix, title, masks, capture, start)
+	})
+}
+
+// writeOutput calls write with the destination of the result set of queryID,
+// opts.Out or a file in the run's output directory as writeResults describes,
+// and returns the number of rows it wrote.
+func (opts runOptions) writeOutput(queryID, prefix string, write func(io.Writer) (int, error)) (int, error) {
+	if opts.OutputDir == "" {
+		return write(opts.Out)
+	}
+
+	if strings.ContainsAny(queryID, `/\`) {
+		return 0, fmt.Errorf("query ID %q cannot be used as a file name", queryID)
+	}
+	name := queryID + "." + formatExtension(opts.Format)
+	if !opts.Approve {
+		name = "preview-" + name
+	}
+	f, err := opts.results.create(name, opts.Force)
+	if err != nil {
+		return 0, err
+	}
+	path := f.Name()
+	rowCount, err := write(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close output file: %w", cerr)
+	}
+	if err != nil {
+		return rowCount, err
+	}
+
+	fmt.Fprintf(opts.diagnostics(), "%s QueryID=%s Output=%s\n", prefix, queryID, path)
+	return rowCount, nil
+}
+
+// diagnostics returns the writer for human-readable progress of the run.
+func (opts runOptions) diagnostics() io.Writer {
+	if opts.Diag != nil {
+		return opts.Diag
+	}
+	return opts.Out
+}
+
+// byteaFormat returns the encoding of bytea values in results.
+func (opts runOptions) byteaFormat() string {
+	if opts.ByteaFormat == "" {
+		return byteaBase64
+	}
+	return opts.ByteaFormat
+}
+
+// defaultBinaryMaxBytes is how much of a bytea value text and table output
+// show unless --binary-max-bytes sets another limit.
+const defaultBinaryMaxBytes = 64
+
+// binaryMaxBytes returns how many bytes of a bytea value text and table
+// output show, 0 for no limit.
+func (opts runOptions) binaryMaxBytes() int {
+	switch {
+	case opts.BinaryMaxBytes == 0:
+		return defaultBinaryMaxBytes
+	case opts.BinaryMaxBytes < 0:
+		return 0
+	}
+	return opts.BinaryMaxBytes
+}
+
+// defaultJSONMaxBytes is how much of a json value text output shows unless
+// --json-max-bytes sets another limit.
+const defaultJSONMaxBytes = 64 << 10
+
+// jsonMaxBytes returns how many bytes of a json value text output shows, 0
+// for no limit.
+func (opts runOptions) jsonMaxBytes() int {
+	switch {
+	case opts.JSONMaxBytes == 0:
+		return defaultJSONMaxBytes
+	case opts.JSONMaxBytes < 0:
+		return 0
+	}
+	return opts.JSONMaxBytes
+}
+
+// writeResultSet renders rows to out in the run's format. NULL values are
+// shown as NullString in text, table and CSV output; when it is nil, text and
+// table show <NULL> and CSV an empty field. JSON always uses null. Table
+// columns are cut to MaxColWidth characters (0 for no limit). bytea values
+// are encoded as ByteaFormat, and json values are pretty-printed or nested
+// unless RawJSON is set. The template format writes each row through
+// Template. Non-NULL values of the columns in masks are hidden
+// by their masker. Only the first MaxResultRows rows are written (0 for no
+// limit), but every row is read, captured and counted. Output is buffered
+// and flushed once the result set is complete.
+func (opts runOptions) writeResultSet(out io.Writer, rows resultRows, queryID, prefix, title string, masks map[string]string, capture *resultCapture, start time.Time) (int, error) {
+	textNull, csvNull := "<NULL>", ""
+	if opts.NullString != nil {
+		textNull, csvNull = *opts.NullString, *opts.NullString
+	}
+	byteaFormat, maxRows := opts.byteaFormat(), opts.MaxResultRows
+	w := newResultWriter(out)
+	var rowCount int
+	var err error
+	switch opts.Format {
+	case formatJSON:
+		rowCount, err = writeJSONResults(w, rows, queryID, byteaFormat, opts.RawJSON, maxRows, masks, capture, start)
+	case formatCSV, formatCopyCSV:
+		rowCount, err = writeCSVResults(w, rows, csvNull, byteaFormat, maxRows, masks, capture)
+	case formatTemplate:
+		rowCount, err = writeTemplateResults(w, rows, opts.Template, queryID, textNull, byteaFormat, maxRows, masks, capture)
+	case formatTable:
+		rowCount, err = writeTableResults(w, rows, queryID, prefix, title, textNull, opts.MaxColWidth, byteaFormat, opts.binaryMaxBytes(), maxRows, masks, capture)
+	default:
+		rowCount, err = printQueryResults(w, rows, queryID, prefix, title, textNull, byteaFormat, opts.binaryMaxBytes(), opts.RawJSON, opts.jsonMaxBytes(), maxRows, masks, capture)
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return rowCount, err
+}
+
+// resultBufferSize is how much of a result set's output is buffered before
+// it is written.
+const resultBufferSize = 64 << 10
+
+// resultWriter buffers the output of a result set so it is written in large
+// chunks rather than a write per value. It keeps the first write error, such
+// as the reader of a pipe going away: writers then stop formatting rows but
+// keep reading them, so row counts, exports and expectations still cover
+// the whole result, and the error is returned by Flush.
+type resultWriter struct {
+	buf *bufio.Writer
+	err error
+	// scratch is reused to format numbers.
+	scratch []byte
+}
+
+func newResultWriter(out io.Writer) *resultWriter {
+	return &resultWriter{buf: bufio.NewWriterSize(out, resultBufferSize)}
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.buf.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *resultWriter) WriteString(s string) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.buf.WriteString(s)
+	w.err = err
+	return n, err
+}
+
+// writeInt writes n in decimal.
+func (w *resultWriter) writeInt(n int64) {
+	w.scratch = strconv.AppendInt(w.scratch[:0], n, 10)
+	w.Write(w.scratch)
+}
+
+// writeJSON writes v, a value returned by jsonValue, as JSON, formatting the
+// common scalar types without reflection.
+func (w *resultWriter) writeJSON(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		w.WriteString("null")
+	case bool:
+		w.WriteString(strconv.FormatBool(val))
+	case int64:
+		w.writeInt(val)
+	default:
+		data, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+	}
+	return nil
+}
+
+// failed reports whether a write has failed, after which rows are no longer
+// written.
+func (w *resultWriter) failed() bool {
+	return w.err != nil
+}
+
+// Flush writes the buffered output and returns the first write error.
+func (w *resultWriter) Flush() error {
+	if w.err == nil {
+		w.err = w.buf.Flush()
+	}
+	if w.err != nil {
+		return fmt.Errorf("failed to write results: %w", w.err)
+	}
+	return nil
+}
+
+// displayLocation is the time zone timestamptz values are shown in, set by
+// --tz.
+var displayLocation = time.UTC
+
+// formatTime renders a time value of a column of the given database type.
+// timestamptz values are converted to displayLocation and shown in RFC 3339
+// with their offset, while timestamp values, which have no zone, are shown
+// as stored and dates without a time.
+func formatTime(t time.Time, typeName string) string {
+	switch typeName {
+	case "DATE":
+		return t.Format(time.DateOnly)
+	case "TIMESTAMP":
+		return t.Format(time.DateTime)
+	case "TIMESTAMPTZ":
+		return t.In(displayLocation).Format(time.RFC3339)
+	}
+	return formatValue(t)
+}
+
+// jsonTime renders a time value of a column of the given database type for
+// JSON output, independently of --tz: timestamptz values in RFC 3339 UTC,
+// timestamp values without an offset and dates without a time.
+func jsonTime(t time.Time, typeName string) string {
+	switch typeName {
+	case "DATE":
+		return t.Format(time.DateOnly)
+	case "TIMESTAMP":
+		return t.Format("2006-01-02T15:04:05.999999")
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// formatValue converts a scanned column value into its display form.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "<NULL>"
+	}
+	switch val := v.(type) {
+	case []byte:
+		// Binary values that aren't text would garble a terminal, so show
+		// them in hex instead.
+		if !utf8.Valid(val) {
+			return `\x` + hex.EncodeToString(val)
+		}
+		return string(val)
+	case time.Time:
+		// Times of unknown type are points in time: show them like
+		// timestamptz values rather than in whatever zone the driver chose.
+		return val.In(displayLocation).Format(time.RFC3339)
+	case float64:
+		// Avoid exponents such as 1e+06 for values people read as amounts.
+		if math.Abs(val) < 1e21 {
+			return strconv.FormatFloat(val, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	default:
+		// Use default formatting for other types
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// byteaColumns reports which of the result's columns hold bytea values,
+// which both drivers return as raw bytes.
+func byteaColumns(rows *sql.Rows) ([]bool, error) {
+	return typedColumns(rows, "BYTEA")
+}
+
+// typedColumns reports which of the result's columns have one of the given
+// database types.
+func typedColumns(rows resultRows, typeNames ...string) ([]bool, error) {
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]bool, len(types))
+	for i, t := range types {
+		matches[i] = containsString(typeNames, t)
+	}
+	return matches, nil
+}
+
+// columnTypeNames returns the upper-case database type names of the result's
+// columns, such as INT4, JSONB or _TEXT for a text array.
+func columnTypeNames(rows resultRows) ([]string, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get column types: %v", err)
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = strings.ToUpper(t.DatabaseTypeName())
+	}
+	return names, nil
+}
+
+// formatBytea encodes a bytea value for output: as base64 or, with
+// byteaHex, in Postgres's \x hex form.
+func formatBytea(data []byte, format string) string {
+	if format == byteaHex {
+		return `\x` + hex.EncodeToString(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// cellValue returns the display form of a scanned value, encoding it as
+// byteaFormat when it comes from a bytea column. Only the first maxBytes
+// bytes of a bytea value are encoded (0 for no limit), followed by the
+// value's full length.
+func cellValue(v interface{}, typeName, byteaFormat string, maxBytes int) string {
+	if data, ok := v.([]byte); ok && typeName == "BYTEA" {
+		if maxBytes > 0 && len(data) > maxBytes {
+			return fmt.Sprintf("%s... (%d bytes)", formatBytea(data[:maxBytes], byteaFormat), len(data))
+		}
+		return formatBytea(data, byteaFormat)
+	}
+	return displayValue(v, typeName)
+}
+
+// displayValue returns the display form of a scanned value of a column of
+// the given database type: arrays as their comma-joined elements, hstore as
+// key=>value pairs, intervals as years, months, days and a time, and times as
+// formatTime renders them. Other
+// values, and values that can't be parsed as their type, such as masked
+// ones, fall back to formatValue.
+func displayValue(v interface{}, typeName string) string {
+	if t, ok := v.(time.Time); ok {
+		return formatTime(t, typeName)
+	}
+	if data, ok := v.([]byte); ok && typeName == "UUID" && len(data) == 16 {
+		// A driver returning a uuid's 16 bytes rather than its text.
+		return fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16])
+	}
+	if text, ok := pgText(v); ok {
+		switch {
+		case isArrayType(typeName):
+			if elems, err := parseArray(text); err == nil {
+				return formatArray(elems)
+			}
+		case typeName == "HSTORE":
+			if pairs, err := parseHstore(text); err == nil {
+				return formatHstore(pairs)
+			}
+		case typeName == "INTERVAL":
+			if s, ok := formatInterval(text); ok {
+				return s
+			}
+		}
+	}
+	return formatValue(v)
+}
+
+// formatJSONValue renders a json column value indented, with continuation
+// lines prefixed by indent so nested objects line up under the column name,
+// or as it is when raw is set. Values that aren't valid JSON are shown as
+// they are, and other values fall back to formatValue. Documents longer than
+// maxBytes (0 for no limit) are cut short with a note of their full size.
+func formatJSONValue(v interface{}, indent string, raw bool, maxBytes int) string {
+	data, ok := v.([]byte)
+	if !ok {
+		return formatValue(v)
+	}
+	s := string(data)
+	var buf bytes.Buffer
+	if !raw && json.Indent(&buf, data, indent, "  ") == nil {
+		s = buf.String()
+	}
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return s
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n%s… (truncated, document is %d bytes; see --json-max-bytes)", s[:cut], indent, len(data))
+}
+
+// writeBoundSQL prints a statement as sent to the database followed by its
+// arguments in placeholder order, with sensitive parameters redacted.
+func writeBoundSQL(out io.Writer, q QueryDefinition, label, stmtSQL string, args []interface{}) {
+	fmt.Fprintf(out, "[SQL] QueryID=%s\n%s\n", label, strings.TrimSpace(stmtSQL))
+	for i, arg := range args {
+		name := q.AllowedParams[i]
+		value := "[REDACTED]"
+		if !q.Params[name].redacted() {
+			value = formatArg(arg)
+		}
+		fmt.Fprintf(out, "  $%d %s = %s\n", i+1, name, value)
+	}
+	fmt.Fprintln(out)
+}
+
+// formatArg renders a bound argument, quoting strings so their boundaries and
+// the difference from NULL are visible.
+func formatArg(v interface{}) string {
+	if valuer, ok := v.(driver.Valuer); ok {
+		if dv, err := valuer.Value(); err == nil {
+			v = dv
+		}
+	}
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return strconv.Quote(val)
+	case []byte:
+		if !utf8.Valid(val) {
+			return `\x` + hex.EncodeToString(val)
+		}
+		return strconv.Quote(string(val))
+	}
+	return fmt.Sprintf("%v (%T)", v, v)
+}
+
+// scanRow prepares a destination slice for scanning a row with n columns.
+func scanRow(n int) (values []interface{}, scanArgs []interface{}) {
+	values = make([]interface{}, n)
+	scanArgs = make([]interface{}, n)
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	return values, scanArgs
+}
+
+// printQueryResults formats and prints the results of a SQL query to out,
+// showing NULL values as nullString and json values as formatJSONValue does.
+func printQueryResults(out *resultWriter, rows resultRows, queryID, prefix, title, nullString, byteaFormat string, binaryMaxBytes int, rawJSON bool, jsonMaxBytes, maxRows int, masks map[string]string, capture *resultCapture) (int, error) {
+	// Get column names
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get columns: %v", err)
+	}
+	mask := redactionMask(columns, masks)
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	out.WriteString(prefix + " QueryID=" + queryID + "\n" + title + "\n")
+
+	// Each column is printed on a line of its own after its label.
+	labels := make([]string, len(columns))
+	for i, col := range columns {
+		labels[i] = "  " + col + ": "
+	}
+	rule := strings.Repeat("-", 40) + "\n"
+	values, scanArgs := scanRow(len(columns))
+	rowCount := 0
+	for rows.Next() {
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return rowCount, fmt.Errorf("error scanning row: %v", err)
+		}
+		capture.row(columns, values)
+		redactRow(values, mask)
+		if (maxRows > 0 && rowCount >= maxRows) || out.failed() {
+			rowCount++
+			continue
+		}
+
+		out.WriteString("Row ")
+		out.writeInt(int64(rowCount + 1))
+		out.WriteString(":\n" + rule)
+		for i := range columns {
+			var value string
+			switch {
+			case values[i] == nil:
+				value = nullString
+			case isJSONType(types[i]):
+				value = formatJSONValue(values[i], "  ", rawJSON, jsonMaxBytes)
+			default:
+				value = cellValue(values[i], types[i], byteaFormat, binaryMaxBytes)
+			}
+			out.WriteString(labels[i])
+			out.WriteString(value)
+			out.WriteString("\n")
+		}
+		out.WriteString("\n")
+		rowCount++
+	}
+
+	if err = rows.Err(); err != nil {
+		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+	writeOmitted(out, rowCount, maxRows)
+
+	return rowCount, nil
+}
+
+// writeOmitted notes how many of a result set's rowCount rows were not
+// written because of --max-result-rows.
+func writeOmitted(out io.Writer, rowCount, maxRows int) {
+	if maxRows > 0 && rowCount > maxRows {
+		fmt.Fprintf(out, "(%d more rows not shown, limited by --max-result-rows)\n\n", rowCount-maxRows)
+	}
+}
+
+// writeJSONResults writes a result set as a single-line JSON object holding the
+// query ID, the column names, one object per row with columns in order, the
+// number of rows, whether rows were left out past maxRows, and the
+// milliseconds since the statement started. json values are nested unless
+// rawJSON is set, which keeps them as strings.
+func writeJSONResults(out *resultWriter, rows resultRows, queryID, byteaFormat string, rawJSON bool, maxRows int, masks map[string]string, capture *resultCapture, start time.Time) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get columns: %v", err)
+	}
+	mask := redactionMask(columns, masks)
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	header, err := json.Marshal(struct {
+		QueryID string   `json:"query_id"`
+		Columns []string `json:"columns"`
+	}{queryID, columns})
+	if err != nil {
+		return 0, err
+	}
+	// Reopen the header object so rows can be appended as they are scanned.
+	out.Write(header[:len(header)-1])
+	out.WriteString(`,"rows":[`)
+
+	// keys holds each column's encoded name, with the separator before it.
+	keys := make([]string, len(columns))
+	for i, col := range columns {
+		key, _ := json.Marshal(col)
+		keys[i] = string(key) + ":"
+		if i > 0 {
+			keys[i] = "," + keys[i]
+		}
+	}
+	values, scanArgs := scanRow(len(columns))
+	rowCount := 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return rowCount, fmt.Errorf("error scanning row: %v", err)
+		}
+		capture.row(columns, values)
+		redactRow(values, mask)
+		if (maxRows > 0 && rowCount >= maxRows) || out.failed() {
+			rowCount++
+			continue
+		}
+		if rowCount > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("{")
+		for i, col := range columns {
+			out.WriteString(keys[i])
+			value := values[i]
+			if data, ok := value.([]byte); ok && types[i] == "BYTEA" {
+				value = formatBytea(data, byteaFormat)
+			}
+			if err := out.writeJSON(jsonValue(value, types[i], rawJSON)); err != nil {
+				return rowCount, fmt.Errorf("failed to encode column %s: %v", col, err)
+			}
+		}
+		out.WriteString("}")
+		rowCount++
+	}
+	if err := rows.Err(); err != nil {
+		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	trailer, err := json.Marshal(struct {
+		RowCount  int        `json:"row_count"`
+		Truncated bool       `json:"truncated"`
+		Duration  durationMS `json:"duration_ms"`
+	}{rowCount, maxRows > 0 && rowCount > maxRows, durationMS(time.Since(start))})
+	if err != nil {
+		return rowCount, err
+	}
+	// Close the rows array and continue the object with the totals.
+	out.WriteString("],")
+	out.Write(trailer[1:])
+	out.WriteString("\n")
+	return rowCount, nil
+}
+
+// jsonValue converts a scanned value of a column of the given database type
+// into a value suitable for JSON encoding, keeping NULLs, numbers and
+// booleans as native JSON types. Values of json columns are embedded as
+// nested JSON rather than strings unless rawJSON is set, arrays become JSON
+// arrays, hstore values objects, numeric values exact JSON numbers, and times
+// are rendered by jsonTime.
+func jsonValue(v interface{}, typeName string, rawJSON bool) interface{} {
+	if text, ok := pgText(v); ok {
+		switch {
+		case isJSONType(typeName):
+			if !rawJSON && json.Valid([]byte(text)) {
+				return json.RawMessage(text)
+			}
+		case isArrayType(typeName):
+			if elems, err := parseArray(text); err == nil {
+				return jsonArray(elems, typeName[1:], rawJSON)
+			}
+		case typeName == "HSTORE":
+			if pairs, err := parseHstore(text); err == nil {
+				object := make(map[string]*string, len(pairs))
+				for _, pair := range pairs {
+					object[pair.Key] = pair.Value
+				}
+				return object
+			}
+		case typeName == "INTERVAL":
+			if s, ok := formatInterval(text); ok {
+				return s
+			}
+		case typeName == "NUMERIC":
+			if isJSONNumber(text) {
+				return json.Number(text)
+			}
+		}
+	}
+	switch val := v.(type) {
+	case nil, bool, int64, float64:
+		return val
+	case time.Time:
+		return jsonTime(val, typeName)
+	default:
+		return formatValue(val)
+	}
+}
+
+// jsonArray converts parsed array elements of the given element type into a
+// JSON array, with numbers, booleans and json elements as native JSON.
+func jsonArray(elems []interface{}, elemType string, rawJSON bool) []interface{} {
+	values := make([]interface{}, len(elems))
+	for i, e := range elems {
+		s, ok := e.(string)
+		switch {
+		case e == nil:
+		case !ok:
+			values[i] = jsonArray(e.([]interface{}), elemType, rawJSON)
+		case elemType == "BOOL" && (s == "t" || s == "f"):
+			values[i] = s == "t"
+		case numericTypes[elemType] && isJSONNumber(s):
+			values[i] = json.Number(s)
+		case isJSONType(elemType) && !rawJSON && json.Valid([]byte(s)):
+			values[i] = json.RawMessage(s)
+		default:
+			values[i] = s
+		}
+	}
+	return values
+}
+
+// numericTypes are the database types whose values are JSON numbers.
+var numericTypes = map[string]bool{"INT2": true, "INT4": true, "INT8": true, "FLOAT4": true, "FLOAT8": true, "NUMERIC": true, "OID": true}
+
+// isJSONNumber reports whether s is a number in JSON syntax, which excludes
+// values such as NaN and Infinity.
+func isJSONNumber(s string) bool {
+	if s == "" || (s[0] != '-' && (s[0] < '0' || s[0] > '9')) {
+		return false
+	}
+	return json.Valid([]byte(s))
+}
+
+// writeCSVResults writes a result set as CSV with a header row. NULL values
+// are written as nullString. Arrays and hstore values keep their Postgres
+// text form, which can be loaded back with COPY. Rows past maxRows are left
+// out without a note, so the output stays valid CSV.
+func writeCSVResults(out *resultWriter, rows resultRows, nullString, byteaFormat string, maxRows int, masks map[string]string, capture *resultCapture) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get columns: %v", err)
+	}
+	mask := redactionMask(columns, masks)
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return 0, err
+	}
+	for i, t := range types {
+		if isArrayType(t) || t == "HSTORE" {
+			types[i] = ""
+		}
+	}
+
+	w := csv.NewWriter(out)
+	if err := w.Write(columns); err != nil {
+		return 0, err
+	}
+
+	values, scanArgs := scanRow(len(columns))
+	record := make([]string, len(columns))
+	rowCount := 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return rowCount, fmt.Errorf("error scanning row: %v", err)
+		}
+		capture.row(columns, values)
+		redactRow(values, mask)
+		if (maxRows > 0 && rowCount >= maxRows) || out.failed() {
+			rowCount++
+			continue
+		}
+		for i, v := range values {
+			if v == nil {
+				record[i] = nullString
+			} else {
+				record[i] = cellValue(v, types[i], byteaFormat, 0)
+			}
+		}
+		// A failed write is kept by out, and the remaining rows are only
+		// counted.
+		w.Write(record)
+		rowCount++
+	}
+	if err := rows.Err(); err != nil {
+		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	// Write errors are kept by out and reported when it is flushed.
+	w.Flush()
+	return rowCount, nil
+}
+
+// writeTableResults prints a result set as an aligned table with a header
+// row, like psql. Rows are buffered to size the columns; values longer than
+// maxColWidth characters (0 for no limit) are cut short with an ellipsis,
+// and line breaks are shown as \n so each row stays on one line. Numbers are
+// right-aligned.
+func writeTableResults(out io.Writer, rows resultRows, queryID, prefix, title, nullString string, maxColWidth int, byteaFormat string, binaryMaxBytes, maxRows int, masks map[string]string, capture *resultCapture) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get columns: %v", err)
+	}
+	mask := redactionMask(columns, masks)
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	cell := func(s string) string {
+		s = strings.NewReplacer("\r\n", `\n`, "\n", `\n`, "\t", " ").Replace(s)
+		if r := []rune(s); maxColWidth > 0 && len(r) > maxColWidth {
+			if maxColWidth == 1 {
+				return "…"
+			}
+			return string(r[:maxColWidth-1]) + "…"
+		}
+		return s
+	}
+	widths := make([]int, len(columns))
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = cell(col)
+		widths[i] = utf8.RuneCountInString(header[i])
+	}
+	rightAlign := make([]bool, len(columns))
+
+	var table [][]string
+	values, scanArgs := scanRow(len(columns))
+	rowCount := 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return rowCount, fmt.Errorf("error scanning row: %v", err)
+		}
+		capture.row(columns, values)
+		redactRow(values, mask)
+		rowCount++
+		if maxRows > 0 && rowCount > maxRows {
+			continue
+		}
+		record := make([]string, len(columns))
+		for i, v := range values {
+			switch v.(type) {
+			case nil:
+				record[i] = cell(nullString)
+			case int64, float64:
+				record[i] = cell(formatValue(v))
+				rightAlign[i] = true
+			default:
+				record[i] = cell(cellValue(v, types[i], byteaFormat, binaryMaxBytes))
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(record[i]))
+		}
+		table = append(table, record)
+	}
+	if err := rows.Err(); err != nil {
+		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	pad := func(s string, width int, right bool) string {
+		fill := strings.Repeat(" ", width-utf8.RuneCountInString(s))
+		if right {
+			return fill + s
+		}
+		return s + fill
+	}
+	line := func(record []string, align []bool) {
+		parts := make([]string, len(record))
+		for i, s := range record {
+			parts[i] = pad(s, widths[i], align != nil && align[i])
+		}
+		fmt.Fprintf(out, " %s\n", strings.TrimRight(strings.Join(parts, " | "), " "))
+	}
+
+	fmt.Fprintf(out, "%s QueryID=%s\n", prefix, queryID)
+	fmt.Fprintln(out, title)
+	line(header, nil)
+	rules := make([]string, len(columns))
+	for i, w := range widths {
+		rules[i] = strings.Repeat("-", w+2)
+	}
+	fmt.Fprintln(out, strings.Join(rules, "+"))
+	for _, record := range table {
+		line(record, rightAlign)
+	}
+	fmt.Fprintln(out)
+	writeOmitted(out, rowCount, maxRows)
+	return rowCount, nil
+}
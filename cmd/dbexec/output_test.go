@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryFake returns the rows of a query answered with result by the fake
+// driver.
+func queryFake(tb testing.TB, result fakeResult) *sql.Rows {
+	tb.Helper()
+	db, _ := newFakeDB(tb, map[string]fakeResult{"SELECT": result})
+	rows, err := db.Query("SELECT")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { rows.Close() })
+	return rows
+}
+
+// render writes result as a run with opts would and returns the output.
+func render(t *testing.T, opts runOptions, result fakeResult) string {
+	t.Helper()
+	var out strings.Builder
+	if _, err := opts.writeResultSet(&out, queryFake(t, result), "q", "[EXECUTED]", "Results:", nil, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestJSONBRendering(t *testing.T) {
+	doc := fakeResult{
+		Columns: []string{"id", "doc"},
+		Types:   []string{"INT4", "JSONB"},
+		Rows:    [][]driver.Value{{int64(1), []byte(`{"name": "ada", "tags": ["x", "y"], "address": {"city": "London"}}`)}},
+	}
+
+	text := render(t, runOptions{}, doc)
+	want := `  doc: {
+    "name": "ada",
+    "tags": [
+      "x",
+      "y"
+    ],
+    "address": {
+      "city": "London"
+    }
+  }
+`
+	if !strings.Contains(text, want) {
+		t.Errorf("text output:\n%s\nwant it to contain:\n%s", text, want)
+	}
+
+	var result struct {
+		Rows []map[string]json.RawMessage `json:"rows"`
+	}
+	out := render(t, runOptions{Format: formatJSON}, doc)
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	var nested struct {
+		Address struct {
+			City string `json:"city"`
+		} `json:"address"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(result.Rows[0]["doc"], &nested); err != nil {
+		t.Fatalf("doc is not nested JSON: %s", result.Rows[0]["doc"])
+	}
+	if nested.Address.City != "London" || len(nested.Tags) != 2 {
+		t.Errorf("got doc %s", result.Rows[0]["doc"])
+	}
+
+	// With --raw-json, documents are shown as they are and kept as strings.
+	raw := `{"name": "ada", "tags": ["x", "y"], "address": {"city": "London"}}`
+	if text := render(t, runOptions{RawJSON: true}, doc); !strings.Contains(text, "  doc: "+raw+"\n") {
+		t.Errorf("raw text output:\n%s", text)
+	}
+	out = render(t, runOptions{Format: formatJSON, RawJSON: true}, doc)
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	var s string
+	if err := json.Unmarshal(result.Rows[0]["doc"], &s); err != nil || s != raw {
+		t.Errorf("raw doc = %s, want the string %q", result.Rows[0]["doc"], raw)
+	}
+}
+
+func TestPostgresTypesRendering(t *testing.T) {
+	values := fakeResult{
+		Columns: []string{"tags", "ids", "attrs", "age", "total"},
+		Types:   []string{"_TEXT", "_INT4", "HSTORE", "INTERVAL", "NUMERIC"},
+		Rows: [][]driver.Value{{
+			[]byte(`{a,"b c",NULL}`),
+			[]byte(`{1,2}`),
+			[]byte(`"a"=>"1", "b"=>NULL`),
+			[]byte(`1 year 2 mons 3 days 04:05:06`),
+			[]byte(`12345678901234567890.123`),
+		}},
+	}
+
+	text := render(t, runOptions{}, values)
+	for _, want := range []string{
+		"  tags: a, b c, NULL\n",
+		"  ids: 1, 2\n",
+		"  attrs: a=>1, b=>NULL\n",
+		"  age: 1 year 2 months 3 days 04:05:06\n",
+		"  total: 12345678901234567890.123\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text output doesn't contain %q:\n%s", want, text)
+		}
+	}
+
+	var result struct {
+		Rows json.RawMessage `json:"rows"`
+	}
+	out := render(t, runOptions{Format: formatJSON}, values)
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	// Numbers stay exact rather than going through float64.
+	want := `[{"tags":["a","b c",null],"ids":[1,2],"attrs":{"a":"1","b":null},"age":"1 year 2 months 3 days 04:05:06","total":12345678901234567890.123}]`
+	if got := string(result.Rows); got != want {
+		t.Errorf("JSON rows = %s, want %s", got, want)
+	}
+
+	// CSV keeps the text form of arrays and hstore values, so COPY can load
+	// them back.
+	csv := render(t, runOptions{Format: formatCSV}, values)
+	if want := `"{a,""b c"",NULL}","{1,2}","""a""=>""1"", ""b""=>NULL",1 year 2 months 3 days 04:05:06,12345678901234567890.123` + "\n"; !strings.HasSuffix(csv, want) {
+		t.Errorf("CSV output = %q, want it to end with %q", csv, want)
+	}
+}
+
+// generatedRows returns a result set of n rows, generated as they are read.
+func generatedRows(n int) fakeResult {
+	return fakeResult{
+		Columns: []string{"id", "name", "score"},
+		Types:   []string{"INT8", "TEXT", "FLOAT8"},
+		Generate: func(i int, dest []driver.Value) bool {
+			if i >= n {
+				return false
+			}
+			dest[0], dest[1], dest[2] = int64(i), "user", float64(i)/4
+			return true
+		},
+	}
+}
+
+// failingWriter accepts limit bytes and fails every write after that, as a
+// pipe whose reader went away does.
+type failingWriter struct{ limit int }
+
+var errReaderGone = errors.New("broken pipe")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errReaderGone
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestRowCountWhenOutputFails(t *testing.T) {
+	const n = 10000
+	for _, format := range []string{formatText, formatJSON, formatCSV, formatTable} {
+		opts := runOptions{Format: format}
+		count, err := opts.writeResultSet(&failingWriter{limit: 1000}, queryFake(t, generatedRows(n)), "q", "[EXECUTED]", "Results:", nil, nil, time.Now())
+		if !errors.Is(err, errReaderGone) {
+			t.Errorf("%s: got error %v, want %v", format, err, errReaderGone)
+		}
+		if count != n {
+			t.Errorf("%s: counted %d rows, want %d", format, count, n)
+		}
+	}
+}
+
+// BenchmarkWriteResults measures how fast a 1M-row result set is streamed
+// in each format. Tables are left out: they hold every row to size their
+// columns.
+func BenchmarkWriteResults(b *testing.B) {
+	const n = 1000000
+	for _, format := range []string{formatText, formatJSON, formatCSV} {
+		b.Run(format, func(b *testing.B) {
+			opts := runOptions{Format: format}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				count, err := opts.writeResultSet(io.Discard, queryFake(b, generatedRows(n)), "q", "[EXECUTED]", "Results:", nil, nil, time.Now())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if count != n {
+					b.Fatalf("counted %d rows, want %d", count, n)
+				}
+			}
+			b.ReportMetric(float64(n)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestTimeRendering(t *testing.T) {
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+	displayLocation = time.FixedZone("EDT", -4*60*60)
+
+	at := time.Date(2024, time.June, 1, 13, 30, 0, 0, time.UTC)
+	// The driver returns the timestamp in a zone of its own.
+	local := at.In(time.FixedZone("CEST", 2*60*60))
+	text := render(t, runOptions{}, fakeResult{
+		Columns: []string{"created_at", "stored_at", "day", "untyped"},
+		Types:   []string{"TIMESTAMPTZ", "TIMESTAMP", "DATE", "TEXT"},
+		Rows:    [][]driver.Value{{local, at, at, local}},
+	})
+	for _, want := range []string{
+		"  created_at: 2024-06-01T09:30:00-04:00\n",
+		"  stored_at: 2024-06-01 13:30:00\n",
+		"  day: 2024-06-01\n",
+		"  untyped: 2024-06-01T09:30:00-04:00\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text output doesn't contain %q:\n%s", want, text)
+		}
+	}
+
+	// Expectations don't depend on --tz. Times without an offset are read as
+	// the driver returned them, which for timestamp columns is as stored.
+	for _, tt := range []struct {
+		actual   time.Time
+		expected interface{}
+		want     bool
+	}{
+		{local, "2024-06-01T13:30:00Z", true},
+		{local, "2024-06-01T15:30:00+02:00", true},
+		{local, at, true},
+		{local, "2024-06-01T09:30:00Z", false},
+		{at, "2024-06-01 13:30:00", true},
+		{at, "2024-06-01 09:30:00", false},
+	} {
+		if got := valuesEqual(tt.actual, tt.expected); got != tt.want {
+			t.Errorf("valuesEqual(%s, %v) = %v, want %v", tt.actual, tt.expected, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkParallel fails unless ids can run concurrently: every query must be
+// independent of the others, so nothing it exports is needed by another
+// query and the order they finish in doesn't matter. Each query commits on
+// its own, so unless the run asked for that with perQuery every query must
+// also be read-only.
+func checkParallel(ids []string, perQuery bool) error {
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, id)
+		}
+		for _, stmtSQL := range qdef.SQL {
+			if !perQuery && !isRead(stmtSQL) {
+				return fmt.Errorf("--parallel runs each query in its own transaction, so queries that write need --tx=per-query, but %s writes", qdef.ID)
+			}
+		}
+	}
+	return checkIndependent(ids, "--parallel")
+}
+
+// checkIndependent fails if a query of ids exports results to later queries
+// or uses results exported by earlier ones, which option can't pass between
+// queries.
+func checkIndependent(ids []string, option string) error {
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, id)
+		}
+		if len(qdef.Exports) > 0 {
+			return fmt.Errorf("%s requires independent queries, but %s exports results to later queries", option, qdef.ID)
+		}
+		for _, name := range qdef.AllowedParams {
+			if strings.HasPrefix(name, exportPrefix) {
+				return fmt.Errorf("%s requires independent queries, but %s uses %s from an earlier query", option, qdef.ID, name)
+			}
+		}
+	}
+	return nil
+}
+
+// queryStatus is the outcome of one query of a --parallel run.
+type queryStatus struct {
+	QueryID string `json:"query_id"`
+	RunID   string `json:"run_id,omitempty"`
+	Outcome string `json:"outcome"`
+	Rows    int64  `json:"rows"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runQueriesInParallel calls run for each of ids, each query in its own
+// transaction on a separate connection with a run ID of its own, with at
+// most workers running at once. Queries start in order; with stopOnError the
+// first failure cancels the queries still running and none start after it.
+// Each query's output is spooled to a temporary file and written in the
+// order of ids once all of them have finished, so a failing query can't
+// interleave with another's results, followed by the outcome of each query.
+// It returns the summaries of the queries that ran, in order, and fails if
+// any query failed.
+func runQueriesInParallel(ctx context.Context, ids []string, workers int, stopOnError bool, opts runOptions, run func(context.Context, int, runOptions) (*runSummary, error)) ([]*runSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	runStart := time.Now()
+	if opts.OutputDir != "" {
+		// The queries write to the same run directory.
+		opts.results = &resultFiles{Dir: filepath.Join(opts.OutputDir, opts.RunID)}
+	}
+
+	type result struct {
+		out     *spoolFile
+		diag    bytes.Buffer
+		summary *runSummary
+		err     error
+		skipped bool
+	}
+	results := make([]result, len(ids))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i := range ids {
+		sem <- struct{}{}
+		if stopOnError && failed.Load() {
+			<-sem
+			results[i].skipped = true
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := &results[i]
+			fail := func() {
+				failed.Store(true)
+				if stopOnError {
+					cancel()
+				}
+			}
+			if res.out, res.err = newSpoolFile(); res.err != nil {
+				fail()
+				return
+			}
+			runOpts := opts
+			runOpts.RunID = newRunID()
+			runOpts.Out = res.out
+			runOpts.Diag = &res.diag
+			runOpts.OmitSummary = true
+			if opts.Heartbeat != nil {
+				// Spinners of concurrent statements would overwrite each
+				// other's line.
+				hb := *opts.Heartbeat
+				hb.TTY = false
+				runOpts.Heartbeat = &hb
+			}
+			runOpts.StepParams = nil
+			if i < len(opts.StepParams) {
+				runOpts.StepParams = opts.StepParams[i : i+1]
+			}
+			if res.summary, res.err = run(ctx, i, runOpts); res.err != nil {
+				fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	summary := &runSummary{RunID: opts.RunID, Reason: opts.Reason, Committed: opts.Approve}
+	var summaries []*runSummary
+	diag := opts.diagnostics()
+	var firstErr error
+	failures := 0
+	for i, id := range ids {
+		res := &results[i]
+		res.diag.WriteTo(diag)
+		if res.out != nil {
+			_, err := res.out.WriteTo(opts.Out)
+			res.out.Close()
+			if err != nil && res.err == nil {
+				res.err = fmt.Errorf("failed to write output: %w", err)
+			}
+		}
+		status := queryStatus{QueryID: strings.TrimSpace(id), Outcome: queryPreviewed}
+		if res.summary != nil {
+			status.RunID = res.summary.RunID
+			summaries = append(summaries, res.summary)
+			summary.Statements = append(summary.Statements, res.summary.Statements...)
+			for _, stmt := range res.summary.Statements {
+				status.Rows += stmt.Rows
+			}
+			if res.summary.Committed {
+				status.Outcome = queryCommitted
+			}
+		}
+		switch {
+		case res.skipped:
+			status.Outcome = queryNotRun
+		case res.err != nil:
+			status.Outcome = queryFailed
+			status.Error = res.err.Error()
+			failures++
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		}
+		if status.Outcome != queryCommitted {
+			summary.Committed = false
+		}
+		summary.Queries = append(summary.Queries, status)
+	}
+	summary.Elapsed = durationMS(time.Since(runStart))
+	if opts.results != nil {
+		summary.Outputs = opts.results.written()
+	}
+
+	for _, status := range summary.Queries {
+		line := fmt.Sprintf("[PARALLEL] Query=%s Outcome=%s Rows=%d", status.QueryID, status.Outcome, status.Rows)
+		if status.Error != "" {
+			line += " Error=" + status.Error
+		}
+		fmt.Fprintln(diag, line)
+	}
+	switch {
+	case firstErr != nil:
+	case opts.Approve:
+		fmt.Fprintln(diag, "All queries committed successfully.")
+	default:
+		fmt.Fprintln(diag, "Dry run completed. No changes applied.")
+	}
+	fmt.Fprintf(diag, "Total elapsed: %s (%d queries, %d at a time)\n", formatDuration(time.Since(runStart)), len(ids), workers)
+	writeOutputFiles(diag, summary.Outputs)
+	if opts.Format == formatJSON {
+		if err := summary.writeJSON(opts.Out); err != nil {
+			return summaries, fmt.Errorf("failed to write summary: %w", err)
+		}
+	}
+	if firstErr != nil {
+		return summaries, fmt.Errorf("%d of %d queries failed, first: %w", failures, len(ids), firstErr)
+	}
+	return summaries, nil
+}
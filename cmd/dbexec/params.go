@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported parameter types.
+const (
+	paramString  = "string"
+	paramInteger = "integer"
+	paramNumber  = "number"
+	paramBoolean = "boolean"
+	paramUUID    = "uuid"
+	paramBytea   = "bytea"
+)
+
+// textTransforms normalize a parameter's value before it is checked and
+// bound, in the order its transform lists them.
+var textTransforms = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// hashTransforms replace a string parameter's value, once it has been
+// checked, with the lowercase hex digest it is bound as.
+var hashTransforms = map[string]func(string) string{
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"md5": func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+}
+
+// paramTransforms lists the transforms applied to a parameter's value. In
+// YAML it is a single name or a list of names.
+type paramTransforms []string
+
+// UnmarshalYAML accepts a transform name or a sequence of them.
+func (t *paramTransforms) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = paramTransforms{value.Value}
+		return nil
+	}
+	var names []string
+	if err := value.Decode(&names); err != nil {
+		return fmt.Errorf("line %d: transform must be a name or a list of names", value.Line)
+	}
+	*t = names
+	return nil
+}
+
+// ParamDefinition declares the type and format of a query parameter.
+type ParamDefinition struct {
+	Type        string `yaml:"type" json:"type"`
+	Pattern     string `yaml:"pattern" json:"pattern,omitempty"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	// Nullable allows the parameter to be bound to SQL NULL.
+	Nullable bool `yaml:"nullable" json:"nullable,omitempty"`
+	// Optional lets the parameter be omitted. The query's statements are
+	// then templates including the clauses that use it only when it is
+	// supplied.
+	Optional bool `yaml:"optional" json:"optional,omitempty"`
+	// Sensitive redacts the parameter's value wherever dbexec prints it.
+	Sensitive bool `yaml:"sensitive" json:"sensitive,omitempty"`
+	// Secret is sensitive and, when dbexec asks for the parameter, read
+	// without echoing it.
+	Secret bool `yaml:"secret" json:"secret,omitempty"`
+	// Transform normalizes the value before it is checked (lower, upper,
+	// trim) or, last, replaces it with its digest (sha256, md5).
+	Transform paramTransforms `yaml:"transform" json:"transform,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// redacted reports whether the parameter's value must be kept out of output,
+// logs and errors.
+func (p ParamDefinition) redacted() bool {
+	return p.Sensitive || p.Secret
+}
+
+// secretDigest returns the hex-encoded SHA-256 hash recorded in place of the
+// value v of a secret or sensitive parameter in plan files and rollback
+// scripts. It is salted with the ID of the run the file belongs to, so equal
+// values don't hash alike across files.
+func secretDigest(runID, name string, v ParamValue) string {
+	value, _ := v.MarshalJSON()
+	sum := sha256.Sum256([]byte(runID + "\x00" + name + "\x00" + string(value)))
+	return hex.EncodeToString(sum[:])
+}
+
+// redactedParams returns the definitions of the parameters of the queries
+// ids whose values must be kept out of output, by name.
+func redactedParams(ids []string) map[string]ParamDefinition {
+	defs := map[string]ParamDefinition{}
+	for _, id := range ids {
+		for name, p := range queries[strings.TrimSpace(id)].Params {
+			if p.redacted() && !strings.HasPrefix(name, exportPrefix) {
+				defs[name] = p
+			}
+		}
+	}
+	return defs
+}
+
+// ParamValue is a supplied parameter value. Null marks SQL NULL, which is
+// distinct from the string "null".
+type ParamValue struct {
+	Value string
+	Null  bool
+}
+
+// String returns the value as written on the command line: null for NULL.
+func (v ParamValue) String() string {
+	if v.Null {
+		return "null"
+	}
+	return v.Value
+}
+
+// MarshalJSON encodes the value as a JSON string, or null for NULL.
+func (v ParamValue) MarshalJSON() ([]byte, error) {
+	if v.Null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(v.Value)
+}
+
+// Params holds the parameter values supplied for a run. Values may be given
+// as JSON strings, numbers, booleans or null; they are kept in their string
+// form and converted according to the parameter's declared type when bound.
+type Params map[string]ParamValue
+
+// UnmarshalJSON decodes a JSON object of scalar parameter values.
+func (p *Params) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	params := make(Params, len(raw))
+	for key, v := range raw {
+		switch val := v.(type) {
+		case nil:
+			params[key] = ParamValue{Null: true}
+		case string:
+			params[key] = ParamValue{Value: val}
+		case json.Number:
+			params[key] = ParamValue{Value: val.String()}
+		case bool:
+			params[key] = ParamValue{Value: strconv.FormatBool(val)}
+		default:
+			return fmt.Errorf("parameter %s must be a string, number, boolean or null", key)
+		}
+	}
+	*p = params
+	return nil
+}
+
+// UnmarshalYAML decodes a mapping of scalar parameter values, where a YAML
+// null (~ or an unquoted null) is SQL NULL.
+func (p *Params) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: params must be a mapping", value.Line)
+	}
+	params := make(Params, len(value.Content)/2)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, val := value.Content[i].Value, value.Content[i+1]
+		if val.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: parameter %s must be a scalar", val.Line, key)
+		}
+		if val.ShortTag() == "!!null" {
+			params[key] = ParamValue{Null: true}
+		} else {
+			params[key] = ParamValue{Value: val.Value}
+		}
+	}
+	*p = params
+	return nil
+}
+
+// compileParams validates a query's parameter declarations.
+func compileParams(q *QueryDefinition) error {
+	allowed := map[string]bool{}
+	for _, name := range q.AllowedParams {
+		allowed[name] = true
+	}
+
+	for name, p := range q.Params {
+		if !allowed[name] {
+			return fmt.Errorf("query %s: parameter %s is declared but not in allowed_params", q.ID, name)
+		}
+		if strings.HasPrefix(name, exportPrefix) {
+			return fmt.Errorf("query %s: exported parameter %s cannot be declared", q.ID, name)
+		}
+		if p.Type == "" {
+			p.Type = paramString
+		}
+		switch p.Type {
+		case paramString, paramInteger, paramNumber, paramBoolean, paramUUID, paramBytea:
+		default:
+			return fmt.Errorf("query %s: parameter %s has unsupported type %q", q.ID, name, p.Type)
+		}
+		if p.Pattern != "" {
+			// The value must match in full, as for identifier and schema
+			// patterns, so "active|inactive" doesn't let "inactive; x" in.
+			re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("query %s: parameter %s has invalid pattern: %w", q.ID, name, err)
+			}
+			p.re = re
+		}
+		if err := p.checkTransforms(); err != nil {
+			return fmt.Errorf("query %s: parameter %s: %v", q.ID, name, err)
+		}
+		q.Params[name] = p
+	}
+	return nil
+}
+
+// bindParams returns the positional arguments for a query, validating each
+// value against its declaration. Parameters prefixed with @ are bound to the
+// values exported by earlier queries.
+func (q QueryDefinition) bindParams(params Params, exported map[string]interface{}) ([]interface{}, error) {
+	args := []interface{}{}
+	for _, key := range q.AllowedParams {
+		if strings.HasPrefix(key, exportPrefix) {
+			arg, err := exportedValue(exported, key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", q.ID, err)
+			}
+			args = append(args, arg)
+			continue
+		}
+		val, ok := params[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errMissingParam, key)
+		}
+		if val.Null {
+			if !q.Params[key].Nullable {
+				return nil, fmt.Errorf("%w %s for %s: null is not allowed unless the parameter is declared nullable", errInvalidParam, key, q.ID)
+			}
+			args = append(args, nil)
+			continue
+		}
+		arg, err := q.Params[key].convert(val.Value)
+		if err != nil {
+			if q.Params[key].redacted() {
+				return nil, fmt.Errorf("%w %s for %s: value [REDACTED] is not a valid %s", errInvalidParam, key, q.ID, q.Params[key].Type)
+			}
+			return nil, fmt.Errorf("%w %s for %s: %v", errInvalidParam, key, q.ID, err)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// checkTransforms validates the parameter's transforms: known names, bytea
+// values left alone, and at most one hash, last and on a string parameter.
+func (p ParamDefinition) checkTransforms() error {
+	for i, t := range p.Transform {
+		switch {
+		case textTransforms[t] != nil:
+		case hashTransforms[t] != nil:
+			if i != len(p.Transform)-1 {
+				return fmt.Errorf("transform %s must be the last transform", t)
+			}
+			if p.Type != paramString {
+				return fmt.Errorf("transform %s needs a string parameter, not %s", t, p.Type)
+			}
+		default:
+			return fmt.Errorf("unknown transform %q (use lower, upper, trim, sha256 or md5)", t)
+		}
+		if p.Type == paramBytea {
+			return fmt.Errorf("bytea parameters cannot be transformed")
+		}
+	}
+	return nil
+}
+
+// convert checks val against the declaration and converts it to the value
+// bound to the statement. The parameter's text transforms are applied first,
+// so the pattern and type see the normalized value; a hash transform is
+// applied last. Undeclared parameters are bound as strings.
+func (p ParamDefinition) convert(val string) (interface{}, error) {
+	var hash func(string) string
+	for _, t := range p.Transform {
+		if hash = hashTransforms[t]; hash != nil {
+			break
+		}
+		val = textTransforms[t](val)
+	}
+	if p.re != nil && !p.re.MatchString(val) {
+		return nil, fmt.Errorf("value does not match pattern %s", p.Pattern)
+	}
+	switch p.Type {
+	case paramInteger:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", val)
+		}
+		return n, nil
+	case paramNumber:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", val)
+		}
+		return f, nil
+	case paramBoolean:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", val)
+		}
+		return b, nil
+	case paramUUID:
+		return parseUUID(val)
+	case paramBytea:
+		b, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("value is not valid base64")
+		}
+		return b, nil
+	}
+	if hash != nil {
+		return hash(val), nil
+	}
+	return val, nil
+}
+
+// parseUUID accepts a UUID in its canonical 8-4-4-4-12 form or as the 32 hex
+// digits of its 16 bytes, in either case, and returns the canonical
+// lowercase form.
+func parseUUID(val string) (string, error) {
+	digits := val
+	if len(val) == 36 {
+		if val[8] != '-' || val[13] != '-' || val[18] != '-' || val[23] != '-' {
+			return "", fmt.Errorf("%q is not a UUID", val)
+		}
+		digits = val[0:8] + val[9:13] + val[14:18] + val[19:23] + val[24:]
+	}
+	b, err := hex.DecodeString(digits)
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("%q is not a UUID", val)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// paramSchema returns a JSON Schema describing the parameters of a query.
+func (q QueryDefinition) paramSchema() map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, name := range q.AllowedParams {
+		if strings.HasPrefix(name, exportPrefix) {
+			continue
+		}
+		p := q.Params[name]
+		if !p.Optional {
+			required = append(required, name)
+		}
+		typ := paramString
+		if p.Type != "" {
+			typ = p.Type
+		}
+		prop := map[string]interface{}{"type": typ}
+		switch typ {
+		case paramUUID:
+			prop = map[string]interface{}{"type": paramString, "format": "uuid"}
+			typ = paramString
+		case paramBytea:
+			prop = map[string]interface{}{"type": paramString, "contentEncoding": "base64"}
+			typ = paramString
+		}
+		if p.Nullable {
+			prop["type"] = []string{typ, "null"}
+		}
+		if p.Pattern != "" {
+			// Anchored as compileParams anchors it.
+			prop["pattern"] = "^(?:" + p.Pattern + ")$"
+		}
+		if p.Description != "" {
+			prop["description"] = p.Description
+		}
+		properties[name] = prop
+	}
+	for _, name := range q.identifierParamNames() {
+		required = append(required, name)
+		properties[name] = q.IdentifierParams[name].schema()
+	}
+	if q.SchemaParam != "" {
+		required = append(required, q.SchemaParam)
+		properties[q.SchemaParam] = map[string]interface{}{"type": paramString, "pattern": "^(?:" + q.SchemaPattern + ")$"}
+	}
+
+	schema := map[string]interface{}{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      q.ID,
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	if q.Description != "" {
+		schema["description"] = q.Description
+	}
+	return schema
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestUUIDParam(t *testing.T) {
+	p := ParamDefinition{Type: paramUUID}
+	const canonical = "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f"
+	for _, val := range []string{
+		canonical,
+		"6F1C2D3E-4A5B-4C6D-8E7F-0A1B2C3D4E5F",
+		"6f1c2d3e4a5b4c6d8e7f0a1b2c3d4e5f",
+	} {
+		got, err := p.convert(val)
+		if err != nil {
+			t.Errorf("convert(%q): %v", val, err)
+		} else if got != canonical {
+			t.Errorf("convert(%q) = %v, want %s", val, got, canonical)
+		}
+	}
+
+	for _, val := range []string{
+		"",
+		"not-a-uuid",
+		"6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5",
+		"6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f0",
+		"6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5g",
+		"6f1c2d3e4-a5b-4c6d-8e7f-0a1b2c3d4e5f",
+		"6f1c2d3e_4a5b_4c6d_8e7f_0a1b2c3d4e5f",
+		"{6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f}",
+		"6f1c2d3e4a5b4c6d8e7f0a1b2c3d4e5",
+		"6f1c2d3e4a5b4c6d8e7f0a1b2c3d4e5f00",
+		" 6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5",
+	} {
+		if got, err := p.convert(val); err == nil {
+			t.Errorf("convert(%q) = %v, want an error", val, got)
+		}
+	}
+}
+
+func TestParamSchemaPatternMatchesValidation(t *testing.T) {
+	loadTestQueries(t, `
+- id: update_user_status
+  sql: UPDATE users SET status = $1 WHERE user_id = $2
+  allowed_params: [status, user_id]
+  params:
+    status:
+      pattern: active|inactive
+`)
+	q := queries["update_user_status"]
+	properties := q.paramSchema()["properties"].(map[string]interface{})
+	pattern := properties["status"].(map[string]interface{})["pattern"].(string)
+	schemaRe, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "inactive; x" and "reactivated" only match the pattern in part.
+	for _, val := range []string{"active", "inactive", "inactive; x", "reactivated", ""} {
+		_, err := q.Params["status"].convert(val)
+		if valid := err == nil; schemaRe.MatchString(val) != valid {
+			t.Errorf("%q: schema pattern %s matches = %v, but dbexec accepts it = %v", val, pattern, !valid, valid)
+		}
+	}
+}
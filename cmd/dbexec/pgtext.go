@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The parsers here read the text form both drivers return for Postgres
+// types that database/sql has no Go type for.
+
+// pgText returns a scanned value's text: drivers return it as bytes or a
+// string.
+func pgText(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case []byte:
+		return string(val), true
+	case string:
+		return val, true
+	}
+	return "", false
+}
+
+// isArrayType reports whether a database type name is an array type, which
+// Postgres names after its element type with a leading underscore.
+func isArrayType(typeName string) bool {
+	return len(typeName) > 1 && typeName[0] == '_'
+}
+
+// isJSONType reports whether a database type name is json or jsonb.
+func isJSONType(typeName string) bool {
+	return typeName == "JSON" || typeName == "JSONB"
+}
+
+// arrayParser reads the text form of an array.
+type arrayParser struct {
+	s   string
+	pos int
+}
+
+// parseArray parses the text form of a Postgres array, such as
+// {a,"b c",NULL,{1,2}}, into its elements: strings, nil for NULL, and
+// []interface{} for the inner arrays of multidimensional ones.
+func parseArray(s string) ([]interface{}, error) {
+	// Arrays with lower bounds other than 1 start with their dimensions,
+	// as in [0:1]={a,b}.
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "="); i > 0 {
+			s = s[i+1:]
+		}
+	}
+	p := &arrayParser{s: s}
+	elems, err := p.array()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("unexpected %q after array", s[p.pos:])
+	}
+	return elems, nil
+}
+
+func (p *arrayParser) array() ([]interface{}, error) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '{' {
+		return nil, fmt.Errorf("array must start with {")
+	}
+	p.pos++
+	elems := []interface{}{}
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return elems, nil
+	}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		switch p.s[p.pos] {
+		case '{':
+			inner, err := p.array()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, inner)
+		case '"':
+			s, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, s)
+		default:
+			end := p.pos
+			for end < len(p.s) && p.s[end] != ',' && p.s[end] != '}' {
+				end++
+			}
+			s := strings.TrimSpace(p.s[p.pos:end])
+			p.pos = end
+			if strings.EqualFold(s, "NULL") {
+				elems = append(elems, nil)
+			} else {
+				elems = append(elems, s)
+			}
+		}
+		p.skipSpaces()
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return elems, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q in array", p.s[p.pos])
+		}
+	}
+}
+
+// quoted reads a double-quoted string, in which a backslash escapes the
+// next character.
+func (p *arrayParser) quoted() (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; c {
+		case '\\':
+			p.pos++
+			if p.pos < len(p.s) {
+				b.WriteByte(p.s[p.pos])
+			}
+		case '"':
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string")
+}
+
+func (p *arrayParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// formatArray renders array elements for display, joined by commas, with
+// inner arrays in braces and NULL elements as NULL.
+func formatArray(elems []interface{}) string {
+	if len(elems) == 0 {
+		return "{}"
+	}
+	parts := make([]string, len(elems))
+	for i, e := range elems {
+		switch val := e.(type) {
+		case nil:
+			parts[i] = "NULL"
+		case []interface{}:
+			parts[i] = "{" + formatArray(val) + "}"
+		default:
+			parts[i] = val.(string)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// hstorePair is a key of an hstore value with its value, nil for NULL.
+type hstorePair struct {
+	Key   string
+	Value *string
+}
+
+// parseHstore parses the text form of an hstore value, such as
+// "a"=>"1", "b"=>NULL, keeping its pairs in order.
+func parseHstore(s string) ([]hstorePair, error) {
+	p := &arrayParser{s: s}
+	token := func() (string, error) {
+		if p.pos < len(p.s) && p.s[p.pos] == '"' {
+			return p.quoted()
+		}
+		start := p.pos
+		for p.pos < len(p.s) && !strings.ContainsRune(" ,=", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", fmt.Errorf("expected a key or value at %d", start)
+		}
+		return p.s[start:p.pos], nil
+	}
+
+	var pairs []hstorePair
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.s) {
+			return pairs, nil
+		}
+		quotedKey := p.s[p.pos] == '"'
+		key, err := token()
+		if err != nil {
+			return nil, err
+		}
+		if !quotedKey && strings.EqualFold(key, "NULL") {
+			return nil, fmt.Errorf("hstore keys cannot be NULL")
+		}
+		p.skipSpaces()
+		if !strings.HasPrefix(p.s[p.pos:], "=>") {
+			return nil, fmt.Errorf("expected => after key %q", key)
+		}
+		p.pos += 2
+		p.skipSpaces()
+		quotedValue := p.pos < len(p.s) && p.s[p.pos] == '"'
+		value, err := token()
+		if err != nil {
+			return nil, err
+		}
+		pair := hstorePair{Key: key, Value: &value}
+		if !quotedValue && strings.EqualFold(value, "NULL") {
+			pair.Value = nil
+		}
+		pairs = append(pairs, pair)
+		p.skipSpaces()
+		if p.pos < len(p.s) {
+			if p.s[p.pos] != ',' {
+				return nil, fmt.Errorf("unexpected %q in hstore", p.s[p.pos])
+			}
+			p.pos++
+		}
+	}
+}
+
+// formatHstore renders hstore pairs for display as key=>value, NULL values
+// as NULL.
+func formatHstore(pairs []hstorePair) string {
+	parts := make([]string, len(pairs))
+	for i, pair := range pairs {
+		value := "NULL"
+		if pair.Value != nil {
+			value = *pair.Value
+		}
+		parts[i] = pair.Key + "=>" + value
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatInterval renders the text form of an interval, in Postgres's default
+// style ("1 year 2 mons 3 days 04:05:06") or pgx's ("14 mon 3 day
+// 04:05:06"), as years, months, days and a time of day, such as
+// "2 days 03:00:00". Other interval styles aren't recognized.
+func formatInterval(s string) (string, bool) {
+	fields := strings.Fields(s)
+	var months, days int64
+	clock := ""
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			if clock != "" || !isClock(fields[i]) {
+				return "", false
+			}
+			clock = fields[i]
+			continue
+		}
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || i+1 == len(fields) {
+			return "", false
+		}
+		i++
+		switch strings.TrimSuffix(fields[i], "s") {
+		case "year":
+			months += 12 * n
+		case "mon":
+			months += n
+		case "day":
+			days += n
+		default:
+			return "", false
+		}
+	}
+
+	var parts []string
+	unit := func(n int64, name string) {
+		if n == 0 {
+			return
+		}
+		if n != 1 {
+			name += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, name))
+	}
+	unit(months/12, "year")
+	unit(months%12, "month")
+	unit(days, "day")
+	if clock != "" {
+		// Drop trailing zeros of fractional seconds.
+		if strings.Contains(clock, ".") {
+			clock = strings.TrimRight(strings.TrimRight(clock, "0"), ".")
+		}
+		if strings.Trim(clock, "-+0:.") != "" || len(parts) == 0 {
+			parts = append(parts, clock)
+		}
+	}
+	if len(parts) == 0 {
+		return "00:00:00", true
+	}
+	return strings.Join(parts, " "), true
+}
+
+// isClock reports whether s is the time part of an interval: an optionally
+// signed hours:minutes:seconds with optional fractional seconds.
+func isClock(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return false
+	}
+	if seconds, frac, ok := strings.Cut(parts[2], "."); ok {
+		parts = append(parts[:2], seconds, frac)
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// planFile is the artifact written by dbexec plan and executed by dbexec
+// apply. It pins the queries, their SQL and parameters, and the row counts
+// the preview saw, so that what is approved is what runs.
+type planFile struct {
+	RunID      string            `json:"run_id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Actor      string            `json:"actor"`
+	Runbook    string            `json:"runbook,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Queries    []string          `json:"queries"`
+	SQLHashes  map[string]string `json:"sql_sha256"`
+	Params     Params            `json:"params"`
+	StepParams []Params          `json:"step_params,omitempty"`
+	// SecretParams holds the secretDigest of the values of secret and
+	// sensitive parameters, which are left out of Params and asked for again
+	// by dbexec apply.
+	SecretParams map[string]string `json:"secret_params_sha256,omitempty"`
+	Preview      []statementResult `json:"preview"`
+}
+
+// sealSecrets moves the values of the plan's secret and sensitive parameters
+// out of Params, recording their digests in SecretParams instead.
+func (p *planFile) sealSecrets() {
+	defs := redactedParams(p.Queries)
+	sealed := Params{}
+	for name, v := range p.Params {
+		if _, ok := defs[name]; !ok {
+			sealed[name] = v
+			continue
+		}
+		if p.SecretParams == nil {
+			p.SecretParams = map[string]string{}
+		}
+		p.SecretParams[name] = secretDigest(p.RunID, name, v)
+	}
+	p.Params = sealed
+}
+
+// definitionHash returns the hex-encoded SHA-256 hash of the whole
+// definition of a query, as JSON. Listing the fields that matter would miss
+// the next one added, and nearly all of them change what or how a query
+// executes: its statements and guards, its parameters with their types,
+// transforms and patterns, the role and session parameters it runs with,
+// its database, backups and row limits.
+func definitionHash(q QueryDefinition) string {
+	data, _ := json.Marshal(q)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// tolerance is the allowed drift between planned and re-previewed row counts,
+// either an absolute number of rows or a percentage of the planned count.
+type tolerance struct {
+	value   float64
+	percent bool
+}
+
+func (t *tolerance) String() string {
+	if t.percent {
+		return strconv.FormatFloat(t.value, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(t.value, 'f', -1, 64)
+}
+
+func (t *tolerance) Set(v string) error {
+	num, percent := strings.CutSuffix(v, "%")
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("must be a number of rows or a percentage such as 5%%")
+	}
+	*t = tolerance{value: f, percent: percent}
+	return nil
+}
+
+// allows reports whether actual is within the tolerance of planned.
+func (t tolerance) allows(planned, actual int64) bool {
+	diff := float64(actual - planned)
+	if diff < 0 {
+		diff = -diff
+	}
+	if t.percent {
+		return diff <= float64(planned)*t.value/100
+	}
+	return diff <= t.value
+}
+
+// definitionDrift compares a plan with the loaded query definitions and
+// returns a line per difference.
+func definitionDrift(plan planFile) []string {
+	var diffs []string
+	for _, id := range plan.Queries {
+		qdef, ok := queries[id]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("- %s: query no longer defined", id))
+			continue
+		}
+		if hash := definitionHash(qdef); hash != plan.SQLHashes[id] {
+			diffs = append(diffs, fmt.Sprintf("- %s: definition changed (planned sql_sha256 %s, now %s)", id, plan.SQLHashes[id], hash))
+		}
+	}
+	return diffs
+}
+
+// previewDrift compares a plan's preview with a fresh one and returns a line
+// per difference.
+func previewDrift(plan planFile, preview []statementResult, tol tolerance) []string {
+	var diffs []string
+	if len(preview) != len(plan.Preview) {
+		return append(diffs, fmt.Sprintf("- preview has %d statements, planned %d", len(preview), len(plan.Preview)))
+	}
+	for i, planned := range plan.Preview {
+		actual := preview[i]
+		switch {
+		case actual.Statement != planned.Statement || actual.Mode != planned.Mode:
+			diffs = append(diffs, fmt.Sprintf("- statement %d: planned %s (%s), now %s (%s)", i, planned.Statement, planned.Mode, actual.Statement, actual.Mode))
+		case !tol.allows(planned.Rows, actual.Rows):
+			diffs = append(diffs, fmt.Sprintf("- %s: planned %d rows, now %d (tolerance %s)", planned.Statement, planned.Rows, actual.Rows, tol.String()))
+		}
+	}
+	return diffs
+}
+
+// runPlan implements the plan command: it previews the selected queries and
+// writes a plan file describing the preview.
+func runPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	queryIDs := fs.String("queries", "", "Comma-separated list of query IDs to plan")
+	tags := fs.String("tags", "", "Also plan every query carrying all of these comma-separated tags")
+	tagsAny := fs.Bool("tags-any", false, "With --tags, select queries carrying any of the tags")
+	runbook := fs.String("runbook", "", "Plan the named runbook's queries")
+	paramsJSON := fs.String("params", "{}", "JSON string of parameters for all queries")
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	outPath := fs.String("out", "plan.json", "Path of the plan file to write")
+	role := fs.String("role", os.Getenv("DBEXEC_ROLE"), "Role of the operator, checked against each query's required_role")
+	target := fs.String("target", os.Getenv("DBEXEC_TARGET"), "Connection profile from the targets file to plan against; apply uses the same one")
+	fs.StringVar(target, "env", *target, "Alias of --target")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	if err := loadQueries(); err != nil {
+		return err
+	}
+	ids, stepParams, err := selectRun(*queryIDs, *tags, *tagsAny, *runbook)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("you must provide --queries, --tags or --runbook")
+	}
+	var params Params
+	if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
+		return fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	plan := planFile{
+		RunID:      newRunID(),
+		CreatedAt:  time.Now().UTC(),
+		Actor:      cliActor(),
+		Runbook:    *runbook,
+		Target:     *target,
+		Queries:    ids,
+		SQLHashes:  map[string]string{},
+		Params:     params,
+		StepParams: stepParams,
+	}
+	for _, id := range ids {
+		qdef, ok := queries[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, id)
+		}
+		plan.SQLHashes[id] = definitionHash(qdef)
+	}
+
+	if err := announceTarget(os.Stderr, plan.Target, false, ""); err != nil {
+		return err
+	}
+	summary, err := plan.preview(*driver, *role, os.Stdout, os.Stderr, plan.RunID)
+	if err != nil {
+		return err
+	}
+	plan.Preview = summary.Statements
+	plan.sealSecrets()
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*outPath, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Plan %s written to %s\n", plan.RunID, *outPath)
+	return nil
+}
+
+// runApply implements the apply command: it re-previews a plan, aborts on
+// any drift, and with --approve executes it.
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	approve := fs.Bool("approve", false, "Execute the plan after it has been re-validated")
+	allowFullTable := fs.Bool("allow-full-table", false, "Permit executing queries with allow_full_table: true (UPDATE or DELETE without WHERE)")
+	allowDDL := fs.Bool("allow-ddl", false, "Permit executing queries with allow_ddl: true (TRUNCATE, ALTER, DROP, CREATE, ...)")
+	overrideWindow := fs.Bool("override-window", false, "Execute queries outside their allowed_windows (recorded in the audit log)")
+	approvalFile := fs.String("approval-file", "", "Signed approval of the plan from dbexec approve-plan (required for requires_approval queries)")
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	role := fs.String("role", os.Getenv("DBEXEC_ROLE"), "Role of the operator, checked against each query's required_role")
+	confirmEnv := fs.String("confirm-env", "", "Name of the plan's production target, confirming execution against it")
+	reason := fs.String("reason", "", "Why the plan is applied, such as a change ticket; required for requires_approval queries")
+	paramsJSON := fs.String("params", "{}", "JSON string of the plan's secret parameters, which it only holds digests of (asked for on a terminal)")
+	var tol tolerance
+	fs.Var(&tol, "tolerance", "Allowed drift of preview row counts: a number of rows or a percentage such as 5%")
+	postCommit := registerPostCommitFlags(fs)
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: dbexec apply [--approve] [--approval-file approval.sig] [--tolerance N|N%%] plan.json")
+	}
+	// Accept flags after the plan path, as in "dbexec apply plan.json --approve".
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if err := logs.setup(); err != nil {
+		return err
+	}
+	postCommitHooks, err := postCommit.hooks()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	var plan planFile
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if err := loadQueries(); err != nil {
+		return err
+	}
+
+	if err := announceTarget(os.Stderr, plan.Target, *approve, *confirmEnv); err != nil {
+		return fmt.Errorf("plan %s not applied: %w", plan.RunID, err)
+	}
+	if diffs := definitionDrift(plan); len(diffs) > 0 {
+		return fmt.Errorf("plan %s has drifted, not applying:\n%s", plan.RunID, strings.Join(diffs, "\n"))
+	}
+	if *approve {
+		if err := checkReason(plan.Queries, *reason); err != nil {
+			return fmt.Errorf("plan %s not applied: %w", plan.RunID, err)
+		}
+	}
+	if *approve || *approvalFile != "" {
+		if err := checkApproval(*approvalFile, plan); err != nil {
+			return fmt.Errorf("plan %s not applied: %w", plan.RunID, err)
+		}
+	}
+	if len(plan.SecretParams) > 0 {
+		var supplied Params
+		if err := json.Unmarshal([]byte(*paramsJSON), &supplied); err != nil {
+			return fmt.Errorf("failed to parse parameters: %w", err)
+		}
+		secrets, err := secretParams(os.Stdin, os.Stderr, plan.RunID, plan.SecretParams, redactedParams(plan.Queries), supplied)
+		if err != nil {
+			return fmt.Errorf("plan %s not applied: %w", plan.RunID, err)
+		}
+		plan.Params = plan.Params.withOverrides(secrets)
+	}
+	summary, err := plan.preview(*driver, *role, io.Discard, io.Discard, newRunID())
+	if err != nil {
+		return fmt.Errorf("re-preview failed: %w", err)
+	}
+	if diffs := previewDrift(plan, summary.Statements, tol); len(diffs) > 0 {
+		return fmt.Errorf("plan %s has drifted, not applying:\n%s", plan.RunID, strings.Join(diffs, "\n"))
+	}
+	fmt.Fprintf(os.Stderr, "Plan %s re-validated: definitions and preview row counts match.\n", plan.RunID)
+	if !*approve {
+		fmt.Fprintln(os.Stderr, "Pass --approve to execute it.")
+		return nil
+	}
+
+	_, err = plan.run(*driver, runOptions{Approve: true, Out: os.Stdout, Diag: os.Stderr, RunID: newRunID(), OverrideWindow: *overrideWindow, AllowDDL: *allowDDL, AllowFullTable: *allowFullTable, Role: *role, Reason: *reason, PostCommit: postCommitHooks, Approved: *approvalFile != ""})
+	return err
+}
+
+// preview runs the plan's queries as a dry run.
+func (p planFile) preview(driver, role string, out, diag io.Writer, runID string) (*runSummary, error) {
+	return p.run(driver, runOptions{Out: out, Diag: diag, RunID: runID, Role: role})
+}
+
+// run executes the plan's queries with opts and records the run in the audit
+// log.
+func (p planFile) run(driver string, opts runOptions) (*runSummary, error) {
+	db, err := openDatabase(driver, p.Target)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	audit, err := openAuditLog(os.Getenv("DBEXEC_AUDIT_LOG"), io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	defer audit.Close()
+
+	if opts.Approve {
+		if err := audit.checkRateLimits(p.Queries, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := contextFromEnvironment(context.Background())
+	opts.Format = formatText
+	opts.StepParams = p.StepParams
+	opts.Target = p.Target
+	opts.Locks = runLocks("", p.Runbook)
+	summary, err := runQueriesInTransaction(ctx, db, p.Queries, p.Params, opts)
+	audit.Record(auditRecord{RunID: opts.RunID, PlanRunID: p.RunID, Actor: cliActor(), Role: opts.Role, Target: p.Target, Runbook: p.Runbook, Queries: p.Queries, Approve: opts.Approve, Reason: opts.Reason, Summary: summary}, err)
+	return summary, err
+}
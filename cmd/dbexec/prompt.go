@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// paramPrompt describes a parameter to ask the operator for.
+type paramPrompt struct {
+	Name        string
+	Type        string
+	Description string
+	// Secret reads the value without echoing it.
+	Secret bool
+	// check validates a value before it is accepted.
+	check func(string) error
+}
+
+// missingParams lists the parameters the queries of a run need and neither
+// params nor the query's step params supply, in the order the queries use
+// them.
+func missingParams(ids []string, params Params, stepParams []Params) []paramPrompt {
+	var prompts []paramPrompt
+	seen := map[string]bool{}
+	for step, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok {
+			continue
+		}
+		supplied := params
+		if step < len(stepParams) {
+			supplied = params.withOverrides(stepParams[step])
+		}
+		missing := func(name string) bool {
+			if _, ok := supplied[name]; ok || seen[name] {
+				return false
+			}
+			seen[name] = true
+			return true
+		}
+
+		for _, name := range qdef.AllowedParams {
+			p := qdef.Params[name]
+			if strings.HasPrefix(name, exportPrefix) || p.Optional || !missing(name) {
+				continue
+			}
+			typ := p.Type
+			if typ == "" {
+				typ = paramString
+			}
+			prompts = append(prompts, paramPrompt{
+				Name:        name,
+				Type:        typ,
+				Description: p.Description,
+				Secret:      p.Secret,
+				check: func(v string) error {
+					_, err := p.convert(v)
+					return err
+				},
+			})
+		}
+		for _, name := range qdef.identifierParamNames() {
+			if !missing(name) {
+				continue
+			}
+			p := qdef.IdentifierParams[name]
+			prompts = append(prompts, paramPrompt{
+				Name:        name,
+				Type:        "identifier",
+				Description: p.String(),
+				check: func(v string) error {
+					if !p.allows(v) {
+						return fmt.Errorf("%s is not an identifier %s", v, p)
+					}
+					return nil
+				},
+			})
+		}
+		if qdef.SchemaParam != "" && missing(qdef.SchemaParam) {
+			re := qdef.schemaPattern
+			prompts = append(prompts, paramPrompt{
+				Name:        qdef.SchemaParam,
+				Type:        "schema",
+				Description: "matching " + qdef.SchemaPattern,
+				check: func(v string) error {
+					if !schemaName.MatchString(v) || !re.MatchString(v) {
+						return fmt.Errorf("%s is not an allowed schema", v)
+					}
+					return nil
+				},
+			})
+		}
+	}
+	return prompts
+}
+
+// promptParams asks for each parameter on out and reads its value from in,
+// which must be a terminal. Secret values are read without echo. An invalid
+// value is reported, without the value for secrets, and asked for again.
+func promptParams(in *os.File, out io.Writer, prompts []paramPrompt) (Params, error) {
+	params := Params{}
+	reader := bufio.NewReader(in)
+	for _, p := range prompts {
+		label := fmt.Sprintf("%s (%s)", p.Name, p.Type)
+		if p.Description != "" {
+			label += ": " + p.Description
+		}
+		for {
+			fmt.Fprintf(out, "%s: ", label)
+			var value string
+			if p.Secret {
+				b, err := term.ReadPassword(int(in.Fd()))
+				fmt.Fprintln(out)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read parameter %s: %w", p.Name, err)
+				}
+				value = string(b)
+			} else {
+				line, err := reader.ReadString('\n')
+				if err != nil && (err != io.EOF || line == "") {
+					return nil, fmt.Errorf("%w: %s", errMissingParam, p.Name)
+				}
+				value = strings.TrimRight(line, "\r\n")
+			}
+			if err := p.check(value); err != nil {
+				if p.Secret {
+					err = fmt.Errorf("invalid value")
+				}
+				fmt.Fprintf(out, "  %v, try again\n", err)
+				continue
+			}
+			params[p.Name] = ParamValue{Value: value}
+			break
+		}
+	}
+	return params, nil
+}
+
+// secretParams returns the values of the secret parameters that a plan file
+// or rollback script of run runID recorded as digests, by name, taken from
+// supplied or, when in is a terminal, asked for. defs holds their
+// definitions. A value not matching its digest is refused.
+func secretParams(in *os.File, out io.Writer, runID string, digests map[string]string, defs map[string]ParamDefinition, supplied Params) (Params, error) {
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := Params{}
+	var prompts []paramPrompt
+	for _, name := range names {
+		if v, ok := supplied[name]; ok {
+			params[name] = v
+			continue
+		}
+		p := defs[name]
+		prompts = append(prompts, paramPrompt{
+			Name:        name,
+			Type:        p.Type,
+			Description: p.Description,
+			Secret:      true,
+			check: func(v string) error {
+				if secretDigest(runID, name, ParamValue{Value: v}) != digests[name] {
+					return fmt.Errorf("value does not match the recorded one")
+				}
+				return nil
+			},
+		})
+	}
+	if len(prompts) > 0 {
+		if !isTerminal(in) {
+			return nil, fmt.Errorf("%w: %s (pass it with --params)", errMissingParam, prompts[0].Name)
+		}
+		prompted, err := promptParams(in, out, prompts)
+		if err != nil {
+			return nil, err
+		}
+		params = params.withOverrides(prompted)
+	}
+	for name, v := range params {
+		if secretDigest(runID, name, v) != digests[name] {
+			return nil, fmt.Errorf("%w %s: value [REDACTED] does not match the recorded one", errInvalidParam, name)
+		}
+	}
+	return params, nil
+}
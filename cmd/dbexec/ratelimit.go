@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimit caps how often a query may be executed: at most Count successful
+// approved runs in any Per period. Period is Per as written in the definition.
+type rateLimit struct {
+	Count  int
+	Per    time.Duration
+	Period string
+}
+
+// rateLimitUnits are the named periods accepted in a rate_limit besides Go
+// durations such as 12h.
+var rateLimitUnits = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// parseRateLimit parses a rate limit of the form "N/period", where period is
+// hour, day, week or a duration such as 12h.
+func parseRateLimit(spec string) (rateLimit, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate_limit %q must look like 1/day or 3/12h", spec)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n < 1 {
+		return rateLimit{}, fmt.Errorf("rate_limit %q: count must be a positive integer", spec)
+	}
+	period = strings.TrimSpace(period)
+	per, ok := rateLimitUnits[period]
+	if !ok {
+		if per, err = time.ParseDuration(period); err != nil || per <= 0 {
+			return rateLimit{}, fmt.Errorf("rate_limit %q: period must be hour, day, week or a duration such as 12h", spec)
+		}
+	}
+	return rateLimit{Count: n, Per: per, Period: period}, nil
+}
+
+// compileRateLimit parses a query's rate_limit.
+func compileRateLimit(q *QueryDefinition) error {
+	q.rateLimit = rateLimit{}
+	if q.RateLimit == "" {
+		return nil
+	}
+	limit, err := parseRateLimit(q.RateLimit)
+	if err != nil {
+		return fmt.Errorf("query %s: %w", q.ID, err)
+	}
+	q.rateLimit = limit
+	return nil
+}
+
+// checkRateLimits fails if any of ids with a rate_limit has already been
+// executed as often as its limit allows, according to the audit log. Without
+// an audit log file the limits can't be enforced and only a warning is
+// logged.
+func (a *auditLog) checkRateLimits(ids []string, now time.Time) error {
+	var limited []QueryDefinition
+	seen := map[string]bool{}
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if ok && qdef.rateLimit.Count > 0 && !seen[qdef.ID] {
+			seen[qdef.ID] = true
+			limited = append(limited, qdef)
+		}
+	}
+	if len(limited) == 0 {
+		return nil
+	}
+	if a.path == "" {
+		for _, qdef := range limited {
+			slog.Warn("rate_limit is not enforced because DBEXEC_AUDIT_LOG is not set", "query_id", qdef.ID, "rate_limit", qdef.RateLimit)
+		}
+		return nil
+	}
+
+	for _, qdef := range limited {
+		runs, err := a.recentRuns(qdef.ID, now.Add(-qdef.rateLimit.Per))
+		if err != nil {
+			return err
+		}
+		if len(runs) < qdef.rateLimit.Count {
+			continue
+		}
+		times := make([]string, len(runs))
+		for i, t := range runs {
+			times[i] = t.Format(time.RFC3339)
+		}
+		return fmt.Errorf("rate limit exceeded for %s: %d runs allowed per %s, already run at %s",
+			qdef.ID, qdef.rateLimit.Count, qdef.rateLimit.Period, strings.Join(times, ", "))
+	}
+	return nil
+}
+
+// recentRuns returns the times of the successful approved runs since since
+// that executed query id, read from the audit log file. Runs whose summary
+// shows the query was skipped are not counted.
+func (a *auditLog) recentRuns(id string, since time.Time) ([]time.Time, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer f.Close()
+
+	var runs []time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !rec.Approve || rec.Outcome != "success" || rec.Time.Before(since) || !rec.executed(id) {
+			continue
+		}
+		runs = append(runs, rec.Time)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return runs, nil
+}
+
+// executed reports whether the recorded run executed query id.
+func (rec auditRecord) executed(id string) bool {
+	if rec.Summary == nil {
+		return containsString(rec.Queries, id)
+	}
+	for _, st := range rec.Summary.Statements {
+		if st.QueryID == id && st.Mode == modeExecuted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// redactedValue replaces the values of a query's redact_columns in results.
+const redactedValue = "<REDACTED>"
+
+// Built-in maskers a query's mask_columns can select.
+const (
+	// maskRedact hides the whole value, as for redact_columns.
+	maskRedact = "redact"
+	// maskEmail keeps the first character and the domain of an email address.
+	maskEmail = "mask_email"
+	// maskLast4 keeps the last four characters, such as of a card number.
+	maskLast4 = "last4"
+	// maskFirst4 keeps the first four characters.
+	maskFirst4 = "first4"
+)
+
+// maskers implement the built-in maskers. Each takes a non-NULL value as
+// text; values without the shape a masker expects are fully redacted.
+var maskers = map[string]func(string) string{
+	maskRedact: func(string) string { return redactedValue },
+	maskEmail: func(s string) string {
+		at := strings.LastIndex(s, "@")
+		if at < 1 || at == len(s)-1 {
+			return redactedValue
+		}
+		first, _ := utf8.DecodeRuneInString(s)
+		return string(first) + "***" + s[at:]
+	},
+	maskLast4: func(s string) string {
+		r := []rune(s)
+		if len(r) <= 4 {
+			return redactedValue
+		}
+		return "****" + string(r[len(r)-4:])
+	},
+	maskFirst4: func(s string) string {
+		r := []rune(s)
+		if len(r) <= 4 {
+			return redactedValue
+		}
+		return string(r[:4]) + "****"
+	},
+}
+
+// validateRedactColumns checks a query's redact_columns and mask_columns.
+func validateRedactColumns(q QueryDefinition) error {
+	for _, column := range q.RedactColumns {
+		if strings.TrimSpace(column) == "" {
+			return fmt.Errorf("query %s: redact_columns cannot list an empty column name", q.ID)
+		}
+	}
+	var masked []string
+	for column, name := range q.MaskColumns {
+		if strings.TrimSpace(column) == "" {
+			return fmt.Errorf("query %s: mask_columns cannot have an empty column name", q.ID)
+		}
+		if _, ok := maskers[name]; !ok {
+			return fmt.Errorf("query %s: mask_columns: unknown masker %q for column %s (use %s)", q.ID, name, column, strings.Join(maskerNames(), ", "))
+		}
+		if matchesColumn(q.RedactColumns, column) {
+			return fmt.Errorf("query %s: column %s is in both redact_columns and mask_columns", q.ID, column)
+		}
+		if matchesColumn(masked, column) {
+			return fmt.Errorf("query %s: mask_columns lists column %s more than once", q.ID, column)
+		}
+		masked = append(masked, column)
+	}
+	return nil
+}
+
+// maskerNames returns the names of the built-in maskers, sorted.
+func maskerNames() []string {
+	names := make([]string, 0, len(maskers))
+	for name := range maskers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// masks returns the masker of each of q's redact_columns and mask_columns,
+// by column name.
+func (q QueryDefinition) masks() map[string]string {
+	if len(q.RedactColumns) == 0 && len(q.MaskColumns) == 0 {
+		return nil
+	}
+	masks := make(map[string]string, len(q.RedactColumns)+len(q.MaskColumns))
+	for _, column := range q.RedactColumns {
+		masks[column] = maskRedact
+	}
+	for column, name := range q.MaskColumns {
+		masks[column] = name
+	}
+	return masks
+}
+
+// matchesColumn reports whether column is one of columns, ignoring case.
+func matchesColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if strings.EqualFold(c, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// columnMasks returns the maskers of the columns to hide in the results of
+// q, by column name, or nil when the run shows them with --show-redacted.
+func (opts runOptions) columnMasks(q QueryDefinition) map[string]string {
+	if opts.ShowRedacted {
+		return nil
+	}
+	return q.masks()
+}
+
+// maskerFor returns the masker masks selects for column, matched
+// case-insensitively, or nil if the column isn't masked.
+func maskerFor(masks map[string]string, column string) func(string) string {
+	for c, name := range masks {
+		if strings.EqualFold(c, column) {
+			return maskers[name]
+		}
+	}
+	return nil
+}
+
+// redactionMask returns the masker of each of the result's columns, nil for
+// those shown as they are.
+func redactionMask(columns []string, masks map[string]string) []func(string) string {
+	if len(masks) == 0 {
+		return nil
+	}
+	mask := make([]func(string) string, len(columns))
+	for i, column := range columns {
+		mask[i] = maskerFor(masks, column)
+	}
+	return mask
+}
+
+// redactRow masks the values of a scanned row's masked columns, after they
+// have been captured for exports and expectations. NULLs are left alone.
+func redactRow(values []interface{}, mask []func(string) string) {
+	for i, masker := range mask {
+		if masker != nil && values[i] != nil {
+			values[i] = masker(formatValue(values[i]))
+		}
+	}
+}
+
+// confirmShowRedacted asks the operator on the terminal to confirm showing the
+// redacted and masked columns of the queries in ids. It fails without a terminal, so
+// redacted values can't end up in CI logs.
+func confirmShowRedacted(in *os.File, out io.Writer, ids []string) error {
+	var columns []string
+	var redacting []string
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok || len(qdef.masks()) == 0 {
+			continue
+		}
+		redacting = append(redacting, qdef.ID)
+		for column := range qdef.masks() {
+			if !matchesColumn(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	if len(redacting) == 0 {
+		return nil
+	}
+	if !isTerminal(in) {
+		return fmt.Errorf("--show-redacted must be confirmed on a terminal")
+	}
+	sort.Strings(columns)
+	fmt.Fprintf(out, "Show the redacted columns %s of %s? Type yes to confirm: ", strings.Join(columns, ", "), strings.Join(redacting, ", "))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("--show-redacted was not confirmed")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// queriesURL is set by --queries-url to load the catalog from an HTTP(S)
+// endpoint instead of QUERY_DEFINITIONS_PATH.
+var queriesURL string
+
+// defaultCatalogTimeout bounds fetching a catalog from a URL unless
+// DBEXEC_QUERIES_TIMEOUT sets another limit.
+const defaultCatalogTimeout = 10 * time.Second
+
+// maxCatalogSize is the largest catalog accepted from a URL.
+const maxCatalogSize = 10 << 20
+
+// isCatalogURL reports whether a catalog location is an HTTP(S) URL rather
+// than a file path.
+func isCatalogURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// catalogCacheDir returns the directory catalogs fetched from URLs are cached
+// in: DBEXEC_CACHE_DIR, or dbexec in the user's cache directory.
+func catalogCacheDir() (string, error) {
+	if dir := os.Getenv("DBEXEC_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory (set DBEXEC_CACHE_DIR): %w", err)
+	}
+	return filepath.Join(dir, "dbexec"), nil
+}
+
+// fetchCatalog downloads the catalog at url into the local cache and returns
+// the path of the cached copy. The copy's ETag is sent with If-None-Match so
+// an unchanged catalog isn't downloaded again. DBEXEC_QUERIES_AUTH_HEADER,
+// such as "Authorization: Bearer <token>", is added to the request, and
+// DBEXEC_QUERIES_TIMEOUT bounds it. A catalog that can't be fetched fails
+// the run rather than falling back to a copy that may be stale.
+func fetchCatalog(url string) (string, error) {
+	dir, err := catalogCacheDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(url))
+	path := filepath.Join(dir, "catalog-"+hex.EncodeToString(sum[:8])+".yaml")
+	etagPath := path + ".etag"
+
+	timeout := defaultCatalogTimeout
+	if v := os.Getenv("DBEXEC_QUERIES_TIMEOUT"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return "", fmt.Errorf("invalid DBEXEC_QUERIES_TIMEOUT %q: must be a positive duration such as 10s", v)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid catalog URL: %w", err)
+	}
+	if header := os.Getenv("DBEXEC_QUERIES_AUTH_HEADER"); header != "" {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return "", fmt.Errorf("DBEXEC_QUERIES_AUTH_HEADER must be a header such as \"Authorization: Bearer <token>\"")
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if etag, err := os.ReadFile(etagPath); err == nil {
+		if _, err := os.Stat(path); err == nil {
+			req.Header.Set("If-None-Match", strings.TrimSpace(string(etag)))
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch query catalog: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		slog.Debug("query catalog not modified", "url", url, "cache", path)
+		return path, nil
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("failed to fetch query catalog: %s returned %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch query catalog: %w", err)
+	}
+	if len(data) > maxCatalogSize {
+		return "", fmt.Errorf("query catalog at %s is larger than %d bytes", url, maxCatalogSize)
+	}
+	// Write the copy under a temporary name first so a concurrent run never
+	// reads a partial catalog.
+	tmp, err := os.CreateTemp(dir, "catalog-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to cache query catalog: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to cache query catalog: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to cache query catalog: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to cache query catalog: %w", err)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		err = os.WriteFile(etagPath, []byte(etag+"\n"), 0o600)
+	} else if err = os.Remove(etagPath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to cache query catalog: %w", err)
+	}
+	slog.Debug("query catalog fetched", "url", url, "cache", path, "etag", resp.Header.Get("ETag"))
+	return path, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// replHelp lists the commands of --repl.
+const replHelp = `Commands:
+  list              list the queries and runbooks
+  describe <id>     print the definition of a query
+  run <id>          ask for the query's parameters, preview it, then confirm to execute it
+  help              show this help
+  exit              leave (also quit or Ctrl-D)`
+
+// replSession is an interactive --repl session against one database.
+type replSession struct {
+	DB *sql.DB
+	// Opts are the options of every run; each preview and execution runs
+	// in its own transaction.
+	Opts runOptions
+	// Params are the parameters from --params, supplied to every run.
+	Params Params
+	Audit  *auditLog
+	// Format selects how describe prints definitions.
+	Format string
+}
+
+// run reads commands from in, which must be a terminal, until exit or the
+// end of input. A failing command is reported and the session goes on.
+func (s replSession) run(ctx context.Context, in *os.File) error {
+	diag := s.Opts.diagnostics()
+	reader := bufio.NewReader(in)
+	fmt.Fprintln(diag, "Type help for the list of commands.")
+	for {
+		fmt.Fprint(diag, "dbexec> ")
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			fmt.Fprintln(diag)
+			return nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		command, args := fields[0], fields[1:]
+		switch command {
+		case "exit", "quit":
+			return nil
+		case "help":
+			fmt.Fprintln(diag, replHelp)
+			continue
+		}
+		if err := s.command(ctx, in, reader, command, args); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// command runs one command other than help and exit.
+func (s replSession) command(ctx context.Context, in *os.File, reader *bufio.Reader, command string, args []string) error {
+	switch command {
+	case "list":
+		return writeQueryList(s.Opts.Out, args, false)
+	case "describe", "run":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <id>", command)
+		}
+		if _, ok := queries[args[0]]; !ok {
+			return fmt.Errorf("%w: %s", errUnknownQuery, args[0])
+		}
+		if command == "describe" {
+			return describeQuery(s.Opts.Out, args[0], s.Format)
+		}
+		return s.runQuery(ctx, in, reader, args[0])
+	}
+	return fmt.Errorf("unknown command %q; type help for the list of commands", command)
+}
+
+// runQuery asks for the parameters of the query id missing from the
+// session's, previews it and, unless it only reads, executes it in a new
+// transaction once the operator confirms.
+func (s replSession) runQuery(ctx context.Context, in *os.File, reader *bufio.Reader, id string) error {
+	diag := s.Opts.diagnostics()
+	ids := []string{id}
+	params := s.Params
+	if prompts := missingParams(ids, params, nil); len(prompts) > 0 {
+		prompted, err := promptParams(in, diag, prompts)
+		if err != nil {
+			return err
+		}
+		params = params.withOverrides(prompted)
+	}
+	if s.Opts.ShowRedacted {
+		if err := confirmShowRedacted(in, diag, ids); err != nil {
+			return err
+		}
+	}
+
+	opts := s.Opts
+	opts.Approve = false
+	if err := s.record(ctx, ids, params, opts); err != nil {
+		return err
+	}
+	if queries[id].readOnly() {
+		return nil
+	}
+	if err := checkReason(ids, opts.Reason); err != nil {
+		return err
+	}
+	if err := checkUnapproved(ids); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(diag, "Execute %s against %s? Type yes to confirm: ", id, targetLabel(opts.Target))
+	answer, _ := reader.ReadString('\n')
+	if strings.TrimSpace(answer) != "yes" {
+		fmt.Fprintf(diag, "%s was not executed.\n", id)
+		return nil
+	}
+	if err := checkWriteGate(); err != nil {
+		return err
+	}
+	if err := s.Audit.checkRateLimits(ids, time.Now()); err != nil {
+		return err
+	}
+	opts.Approve = true
+	return s.record(ctx, ids, params, opts)
+}
+
+// record runs ids in a transaction of their own and records the run in the
+// audit log.
+func (s replSession) record(ctx context.Context, ids []string, params Params, opts runOptions) error {
+	opts.RunID = newRunID()
+	summary, err := runQueriesInTransaction(ctx, s.DB, ids, params, opts)
+	s.Audit.Record(auditRecord{RunID: opts.RunID, Actor: cliActor(), Role: opts.Role, Target: opts.Target, Queries: ids, Approve: opts.Approve, ShowRedacted: opts.ShowRedacted, Reason: opts.Reason, Summary: summary}, err)
+	return err
+}
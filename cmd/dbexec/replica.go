@@ -0,0 +1,21 @@
+package main
+
+import "strings"
+
+// Endpoints a CLI run is routed to when a read replica is configured.
+const (
+	endpointPrimary = "primary"
+	endpointReplica = "replica"
+)
+
+// routeToReplica reports whether ids can run on a read replica: every query
+// only reads and none sets force_primary.
+func routeToReplica(ids []string) bool {
+	for _, id := range ids {
+		qdef, ok := queries[strings.TrimSpace(id)]
+		if !ok || qdef.ForcePrimary || !qdef.readOnly() {
+			return false
+		}
+	}
+	return true
+}
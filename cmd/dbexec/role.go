@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// exitPermissionDenied is the exit status of a run refused because the
+// caller's role doesn't match a query's required_role.
+const exitPermissionDenied = 4
+
+// permissionError reports a query the caller's role may not run.
+type permissionError struct {
+	QueryID  string
+	Role     string
+	Required string
+}
+
+func (e *permissionError) Error() string {
+	role := e.Role
+	if role == "" {
+		role = "no role"
+	}
+	return fmt.Sprintf("permission denied: %s requires role %s, but the run has %s (set --role or DBEXEC_ROLE)", e.QueryID, e.Required, role)
+}
+
+// checkRole returns a permissionError if q requires a role other than role.
+func (q QueryDefinition) checkRole(role string) error {
+	if q.RequiredRole == "" || q.RequiredRole == role {
+		return nil
+	}
+	return &permissionError{QueryID: q.ID, Role: role, Required: q.RequiredRole}
+}
+
+// databaseRoleName matches the database roles a query may switch to.
+var databaseRoleName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateDatabaseRole checks the name of the database role a query runs as.
+func validateDatabaseRole(q QueryDefinition) error {
+	if q.DatabaseRole != "" && !databaseRoleName.MatchString(q.DatabaseRole) {
+		return fmt.Errorf("query %s: invalid role name %q", q.ID, q.DatabaseRole)
+	}
+	return nil
+}
+
+// setRole switches the transaction to the database role, or back to the
+// role dbexec connected as when role is empty. The switch is local to the
+// transaction, as with SET LOCAL. SET ROLE can't take a bound parameter, so
+// the validated name is quoted instead.
+func (e txExecutor) setRole(ctx context.Context, role string) error {
+	stmt := "SET LOCAL ROLE NONE"
+	if role != "" {
+		stmt = "SET LOCAL ROLE " + pq.QuoteIdentifier(role)
+	}
+	_, err := e.tx.ExecContext(ctx, stmt)
+	return err
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// defaultRollbackDir is the directory rollback scripts are written to unless
+// --rollback-dir or DBEXEC_ROLLBACK_DIR names another.
+const defaultRollbackDir = "rollbacks"
+
+// oldValuePlaceholder matches a reference to a column's value before the
+// query ran in rollback_sql, written {{old:column}}.
+var oldValuePlaceholder = regexp.MustCompile(`\{\{\s*old:([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// rollbackScript is the file written by a committed run whose queries can be
+// undone, and replayed by dbexec rollback. Its statements are concrete: each
+// one is bound with the values the run's parameters and the rows it changed
+// had, and they are listed in the order they undo the run, last query first.
+type rollbackScript struct {
+	RollbackOf string    `json:"rollback_of"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Actor is who made the run, who can't approve rolling it back.
+	Actor      string              `json:"actor,omitempty"`
+	Target     string              `json:"target,omitempty"`
+	Queries    []string            `json:"queries"`
+	Statements []rollbackStatement `json:"statements"`
+	// Backups lists the backup tables of the run, which hold the rows its
+	// queries with backup: true changed as they were before.
+	Backups []string `json:"backups,omitempty"`
+}
+
+// rollbackStatement is a statement of a rollback script with its arguments,
+// encoded as text (nil for NULL), and the role and session parameters of the
+// query it undoes. Params holds the parameters its SQL and session
+// parameters were derived with beyond the bound values, which dbexec
+// rollback needs to check them against the catalog.
+type rollbackStatement struct {
+	QueryID       string            `json:"query_id"`
+	SQL           string            `json:"sql"`
+	Args          []*string         `json:"args"`
+	Role          string            `json:"role,omitempty"`
+	SessionParams map[string]string `json:"session_params,omitempty"`
+	Params        Params            `json:"params,omitempty"`
+	// SecretParams holds the secretDigest of the values of the secret and
+	// sensitive parameters rollback_sql binds, whose arguments are left
+	// null and filled in by dbexec rollback once it has asked for them.
+	SecretParams map[string]string `json:"secret_params_sha256,omitempty"`
+}
+
+// rollbackDir returns the directory rollback scripts are written to.
+func (opts runOptions) rollbackDir() string {
+	if opts.RollbackDir == "" {
+		return envOr("DBEXEC_ROLLBACK_DIR", defaultRollbackDir)
+	}
+	return opts.RollbackDir
+}
+
+// validateRollback checks a query's rollback_sql: the query must have exactly
+// one UPDATE statement, whose previous values can be read as for a preview,
+// and rollback_sql may only reference the query's parameters.
+func validateRollback(q QueryDefinition) error {
+	if q.RollbackSQL == "" {
+		return nil
+	}
+	updates := 0
+	for i, stmtSQL := range q.SQL {
+		switch statementKeyword(stmtSQL) {
+		case "SELECT":
+		case "UPDATE":
+			if _, err := previewQuery(stmtSQL); err != nil {
+				return fmt.Errorf("query %s: cannot read previous values: %v", q.statementLabel(i), err)
+			}
+			updates++
+		default:
+			return fmt.Errorf("query %s: rollback_sql can only undo UPDATE statements", q.ID)
+		}
+	}
+	if updates != 1 {
+		return fmt.Errorf("query %s: rollback_sql needs exactly one UPDATE statement", q.ID)
+	}
+	if len(q.rollbackColumns()) == 0 {
+		return fmt.Errorf("query %s: rollback_sql must restore previous values with {{old:column}}", q.ID)
+	}
+	if n := placeholderCount(q.RollbackSQL); n > len(q.AllowedParams) {
+		return fmt.Errorf("query %s: rollback_sql references $%d but only %d parameters are allowed", q.ID, n, len(q.AllowedParams))
+	}
+	return nil
+}
+
+// rollbackColumns lists the columns rollback_sql reads previous values of.
+func (q QueryDefinition) rollbackColumns() []string {
+	var columns []string
+	for _, m := range oldValuePlaceholder.FindAllStringSubmatch(q.RollbackSQL, -1) {
+		if !containsString(columns, m[1]) {
+			columns = append(columns, m[1])
+		}
+	}
+	return columns
+}
+
+// rollbackTemplate returns rollback_sql with each {{old:column}} replaced by
+// a placeholder numbered after the parameters rollback_sql references, in
+// the order of rollbackColumns.
+func (q QueryDefinition) rollbackTemplate() string {
+	columns := q.rollbackColumns()
+	highest := placeholderCount(q.RollbackSQL)
+	return oldValuePlaceholder.ReplaceAllStringFunc(q.RollbackSQL, func(m string) string {
+		column := oldValuePlaceholder.FindStringSubmatch(m)[1]
+		for i, c := range columns {
+			if c == column {
+				return "$" + strconv.Itoa(highest+i+1)
+			}
+		}
+		return m
+	})
+}
+
+// rollbackParams returns the parameters of params that shape the rollback
+// statements of q beyond their bound values: its identifier and schema
+// parameters and, when q has optional parameters, which parameters were
+// supplied, recorded as nulls since their values are bound.
+func (q QueryDefinition) rollbackParams(params Params) Params {
+	shape := Params{}
+	for name := range q.IdentifierParams {
+		if v, ok := params[name]; ok {
+			shape[name] = v
+		}
+	}
+	if v, ok := params[q.SchemaParam]; ok && q.SchemaParam != "" {
+		shape[q.SchemaParam] = v
+	}
+	if q.conditional() {
+		for _, name := range q.AllowedParams {
+			if _, ok := params[name]; ok && !strings.HasPrefix(name, exportPrefix) {
+				shape[name] = ParamValue{Null: true}
+			}
+		}
+	}
+	if len(shape) == 0 {
+		return nil
+	}
+	return shape
+}
+
+// rollbackStatements returns the statements undoing the changes of q, which
+// was bound with args from params in run runID, to the rows whose previous
+// values are in image, using rollbackTemplate. The values of secret and
+// sensitive parameters are only recorded by their digests.
+func (q QueryDefinition) rollbackStatements(runID string, params Params, args []interface{}, image [][]interface{}) ([]rollbackStatement, error) {
+	highest := placeholderCount(q.RollbackSQL)
+	stmtSQL := q.rollbackTemplate()
+
+	bound := append([]interface{}{}, args[:highest]...)
+	var secrets map[string]string
+	for i, arg := range bound {
+		name := q.AllowedParams[i]
+		if q.Params[name].redacted() && !strings.HasPrefix(name, exportPrefix) {
+			if secrets == nil {
+				secrets = map[string]string{}
+			}
+			secrets[name] = secretDigest(runID, name, params[name])
+			bound[i] = nil
+			continue
+		}
+		if b, ok := arg.([]byte); ok && q.Params[name].Type == paramBytea {
+			bound[i] = byteaText(b)
+		}
+	}
+	stmts := make([]rollbackStatement, 0, len(image))
+	for _, row := range image {
+		values := append(append([]interface{}{}, bound...), row...)
+		text := make([]*string, len(values))
+		for i, v := range values {
+			s, err := rollbackArg(v)
+			if err != nil {
+				return nil, fmt.Errorf("query %s: cannot record rollback argument: %w", q.ID, err)
+			}
+			text[i] = s
+		}
+		stmts = append(stmts, rollbackStatement{QueryID: q.ID, SQL: stmtSQL, Args: text, SecretParams: secrets})
+	}
+	return stmts, nil
+}
+
+// rollbackArg encodes a bound or scanned value as the text Postgres reads it
+// from, or nil for NULL.
+func rollbackArg(v interface{}) (*string, error) {
+	if valuer, ok := v.(driver.Valuer); ok {
+		var err error
+		if v, err = valuer.Value(); err != nil {
+			return nil, err
+		}
+	}
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case time.Time:
+		s = v.Format(time.RFC3339Nano)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	default:
+		s = fmt.Sprint(v)
+	}
+	return &s, nil
+}
+
+// byteaText returns the text form Postgres reads a bytea value from.
+func byteaText(b []byte) string {
+	return `\x` + hex.EncodeToString(b)
+}
+
+// preImage locks the rows an UPDATE statement is about to modify and returns
+// the values of columns they have before it runs, with bytea values in text
+// form.
+func (e txExecutor) preImage(ctx context.Context, stmtSQL string, args []interface{}, columns []string) ([][]interface{}, error) {
+	previewSQL, err := previewQuery(stmtSQL)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := e.tx.QueryContext(ctx, previewSQL+" FOR UPDATE", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	isBytea, err := byteaColumns(rows)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]int, len(columns))
+	for i, column := range columns {
+		index[i] = -1
+		for j, name := range names {
+			if name == column {
+				index[i] = j
+			}
+		}
+		if index[i] == -1 {
+			return nil, fmt.Errorf("rollback_sql reads column %s, which the updated table does not have", column)
+		}
+	}
+
+	var image [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		ptrs := make([]interface{}, len(names))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(columns))
+		for i, j := range index {
+			row[i] = values[j]
+			if b, ok := values[j].([]byte); ok && isBytea[j] {
+				row[i] = byteaText(b)
+			}
+		}
+		image = append(image, row)
+	}
+	return image, rows.Err()
+}
+
+// rollbackSession returns the session parameters a rollback statement runs
+// with: those of the query it undoes and the run's search_path, if set.
+func rollbackSession(params map[string]string, searchPath string) map[string]string {
+	if searchPath == "" {
+		return params
+	}
+	if _, ok := params["search_path"]; ok {
+		return params
+	}
+	session := map[string]string{"search_path": searchPath}
+	for name, value := range params {
+		session[name] = value
+	}
+	return session
+}
+
+// rollbackPath returns the path of the rollback script of a run in dir.
+func rollbackPath(dir, runID string) string {
+	return filepath.Join(dir, runID+".json")
+}
+
+// write writes the script to dir, creating it if needed, and returns its
+// path.
+func (s rollbackScript) write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create rollback directory: %w", err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := rollbackPath(dir, s.RollbackOf)
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write rollback script: %w", err)
+	}
+	return path, nil
+}
+
+// digest returns the hex-encoded SHA-256 hash of the parts of a rollback
+// script an approval covers: the run it undoes, its target and statements.
+func (s rollbackScript) digest() string {
+	data, _ := json.Marshal(struct {
+		RollbackOf string              `json:"rollback_of"`
+		Actor      string              `json:"actor,omitempty"`
+		Target     string              `json:"target,omitempty"`
+		Statements []rollbackStatement `json:"statements"`
+	}{s.RollbackOf, s.Actor, s.Target, s.Statements})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// queryIDs lists the queries the script's statements undo, in order. It
+// is derived from the statements rather than trusting the queries field.
+func (s rollbackScript) queryIDs() []string {
+	var ids []string
+	for _, stmt := range s.Statements {
+		if !containsString(ids, stmt.QueryID) {
+			ids = append(ids, stmt.QueryID)
+		}
+	}
+	return ids
+}
+
+// requiresApproval lists the queries undone by the script that the catalog
+// marks requires_approval.
+func (s rollbackScript) requiresApproval() []string {
+	var ids []string
+	for _, id := range s.queryIDs() {
+		if queries[id].RequiresApproval {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// verify checks a statement of a rollback script against the catalog. The
+// script is a file anyone with access to the rollback directory can edit, so
+// its SQL, role and session parameters must be exactly those the rollback_sql
+// of its query gives with the recorded parameters; only the bound values are
+// taken from the file. The only session parameter allowed beyond the
+// query's is a search_path of valid schemas, set by the run's --search-path.
+func (stmt rollbackStatement) verify() error {
+	shaped, err := stmt.query()
+	if err != nil {
+		return err
+	}
+	qdef := queries[stmt.QueryID]
+	if stmt.SQL != shaped.rollbackTemplate() {
+		return fmt.Errorf("rollback of %s does not match the query's rollback_sql", qdef.ID)
+	}
+	highest := placeholderCount(shaped.RollbackSQL)
+	if want := highest + len(shaped.rollbackColumns()); len(stmt.Args) != want {
+		return fmt.Errorf("rollback of %s has %d arguments, but its rollback_sql takes %d", qdef.ID, len(stmt.Args), want)
+	}
+	secrets := 0
+	for i, name := range shaped.AllowedParams[:highest] {
+		if !shaped.Params[name].redacted() || strings.HasPrefix(name, exportPrefix) {
+			continue
+		}
+		if _, ok := stmt.SecretParams[name]; !ok || stmt.Args[i] != nil {
+			return fmt.Errorf("rollback of %s records the value of secret parameter %s", qdef.ID, name)
+		}
+		secrets++
+	}
+	if secrets != len(stmt.SecretParams) {
+		return fmt.Errorf("rollback of %s records digests of parameters that aren't secret", qdef.ID)
+	}
+	if stmt.Role != qdef.DatabaseRole {
+		return fmt.Errorf("rollback of %s runs as role %q, but the query runs as %q", qdef.ID, stmt.Role, qdef.DatabaseRole)
+	}
+	session, err := qdef.sessionParamsFor(stmt.Params)
+	if err != nil {
+		return fmt.Errorf("rollback of %s: %w", qdef.ID, err)
+	}
+	for name, value := range stmt.SessionParams {
+		if want, ok := session[name]; ok && want == value {
+			continue
+		}
+		if _, ok := session[name]; !ok && name == "search_path" && validSearchPath(value) {
+			continue
+		}
+		return fmt.Errorf("rollback of %s sets session parameter %s, which the query doesn't", qdef.ID, name)
+	}
+	for name := range session {
+		if _, ok := stmt.SessionParams[name]; !ok {
+			return fmt.Errorf("rollback of %s doesn't set the query's session parameter %s", qdef.ID, name)
+		}
+	}
+	return nil
+}
+
+// query returns the query the statement undoes, with the conditions and
+// identifiers of its recorded parameters applied.
+func (stmt rollbackStatement) query() (QueryDefinition, error) {
+	qdef, ok := queries[stmt.QueryID]
+	if !ok {
+		return qdef, fmt.Errorf("%w: %s", errUnknownQuery, stmt.QueryID)
+	}
+	if qdef.RollbackSQL == "" {
+		return qdef, fmt.Errorf("query %s has no rollback_sql", qdef.ID)
+	}
+	shaped, err := qdef.withConditions(stmt.Params)
+	if err == nil {
+		shaped, err = shaped.withIdentifiers(stmt.Params)
+	}
+	if err != nil {
+		return qdef, fmt.Errorf("rollback of %s: %w", qdef.ID, err)
+	}
+	return shaped, nil
+}
+
+// withSecrets returns the statement with the arguments of its secret
+// parameters bound from params, which must match their digests.
+func (stmt rollbackStatement) withSecrets(runID string, params Params) (rollbackStatement, error) {
+	if len(stmt.SecretParams) == 0 {
+		return stmt, nil
+	}
+	shaped, err := stmt.query()
+	if err != nil {
+		return stmt, err
+	}
+	args := append([]*string{}, stmt.Args...)
+	for i, name := range shaped.AllowedParams[:placeholderCount(shaped.RollbackSQL)] {
+		digest, ok := stmt.SecretParams[name]
+		if !ok {
+			continue
+		}
+		v, ok := params[name]
+		if !ok {
+			return stmt, fmt.Errorf("%w: %s", errMissingParam, name)
+		}
+		if secretDigest(runID, name, v) != digest {
+			return stmt, fmt.Errorf("%w %s: value [REDACTED] does not match the recorded one", errInvalidParam, name)
+		}
+		if v.Null {
+			continue
+		}
+		arg, err := shaped.Params[name].convert(v.Value)
+		if err != nil {
+			return stmt, fmt.Errorf("%w %s for %s: value [REDACTED] is not a valid %s", errInvalidParam, name, shaped.ID, shaped.Params[name].Type)
+		}
+		if b, ok := arg.([]byte); ok && shaped.Params[name].Type == paramBytea {
+			arg = byteaText(b)
+		}
+		if args[i], err = rollbackArg(arg); err != nil {
+			return stmt, fmt.Errorf("query %s: cannot bind rollback argument: %w", shaped.ID, err)
+		}
+	}
+	stmt.Args = args
+	return stmt, nil
+}
+
+// secretParams returns the digests of the secret parameters the script's
+// statements record, by name.
+func (s rollbackScript) secretParams() (map[string]string, error) {
+	digests := map[string]string{}
+	for _, stmt := range s.Statements {
+		for name, digest := range stmt.SecretParams {
+			if d, ok := digests[name]; ok && d != digest {
+				return nil, fmt.Errorf("secret parameter %s has different values in the run's queries; roll them back one at a time", name)
+			}
+			digests[name] = digest
+		}
+	}
+	return digests, nil
+}
+
+// validSearchPath reports whether v is a search_path as parseSearchPath
+// returns it: a list of quoted schema names.
+func validSearchPath(v string) bool {
+	for _, part := range strings.Split(v, ", ") {
+		name := strings.TrimSuffix(strings.TrimPrefix(part, `"`), `"`)
+		if !schemaName.MatchString(name) || pq.QuoteIdentifier(name) != part {
+			return false
+		}
+	}
+	return true
+}
+
+// check verifies every statement of the script against the catalog and
+// that a run with role against the script's target may replay it: each
+// query's required_role and targets, a reason for queries marked
+// requires_approval, and allow_ddl for rollback_sql other than DML, as when
+// the queries themselves run. reason and allowDDL only matter with approve.
+func (s rollbackScript) check(role, reason string, approve, allowDDL bool) error {
+	for _, stmt := range s.Statements {
+		if err := stmt.verify(); err != nil {
+			return err
+		}
+	}
+	ids := s.queryIDs()
+	for _, id := range ids {
+		qdef := queries[id]
+		if err := qdef.checkRole(role); err != nil {
+			return err
+		}
+		if err := qdef.checkTarget(s.Target); err != nil {
+			return err
+		}
+		if approve && !dmlKeywords[statementType(qdef.RollbackSQL)] && !allowDDL {
+			return fmt.Errorf("rollback_sql of %s is not SELECT, INSERT, UPDATE or DELETE and requires --allow-ddl", qdef.ID)
+		}
+	}
+	if approve {
+		return checkReason(ids, reason)
+	}
+	return nil
+}
+
+// replay runs the script's statements in a transaction, committing it when
+// approve is set, and returns the summary of the run.
+func (s rollbackScript) replay(ctx context.Context, db *sql.DB, runID string, approve bool, out io.Writer) (summary *runSummary, err error) {
+	summary = &runSummary{RunID: runID, Target: s.Target}
+	runStart := time.Now()
+	defer func() { summary.Elapsed = durationMS(time.Since(runStart)) }()
+	if approve {
+		if err := checkWriteGate(); err != nil {
+			return summary, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return summary, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	exec := txExecutor{tx: tx}
+	activeRole := ""
+	mode := modePreview
+	if approve {
+		mode = modeExecuted
+	}
+
+	for i, stmt := range s.Statements {
+		label := fmt.Sprintf("%s:rollback[%d]", stmt.QueryID, i)
+		if stmt.Role != activeRole {
+			if err := exec.setRole(ctx, stmt.Role); err != nil {
+				return summary, statementError(ctx, "setting role failed", label, err)
+			}
+			activeRole = stmt.Role
+			summary.role = activeRole
+		}
+		restoreSession, err := exec.setSessionParams(ctx, stmt.SessionParams)
+		if err != nil {
+			return summary, statementError(ctx, "session parameters failed", label, err)
+		}
+		args := make([]interface{}, len(stmt.Args))
+		for j, arg := range stmt.Args {
+			if arg != nil {
+				args[j] = *arg
+			}
+		}
+		start := time.Now()
+		res, err := tx.ExecContext(ctx, stmt.SQL, args...)
+		if err != nil {
+			return summary, statementError(ctx, "rollback failed", label, err)
+		}
+		n, _ := res.RowsAffected()
+		elapsed := time.Since(start)
+		summary.add(stmt.QueryID, label, mode, n, elapsed)
+		fmt.Fprintf(out, "[ROLLBACK] QueryID=%s RowsAffected=%d Duration=%s\n", label, n, formatDuration(elapsed))
+		if err := restoreSession(ctx); err != nil {
+			return summary, statementError(ctx, "session parameters failed", label, err)
+		}
+	}
+
+	if !approve {
+		fmt.Fprintln(out, "Dry run completed. No changes applied.")
+		return summary, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return summary, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	tx = nil
+	summary.Committed = true
+	fmt.Fprintf(out, "Rollback of run %s committed.\n", s.RollbackOf)
+	return summary, nil
+}
+
+// runRollback implements the rollback command, replaying the rollback script
+// of a run. Like apply, it is a dry run without --approve, and undoing
+// queries marked requires_approval needs a signed approval of the script.
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	approve := fs.Bool("approve", false, "Commit the rollback; otherwise it is a dry run")
+	approvalFile := fs.String("approval-file", "", "Signed approval of the rollback script from dbexec approve-plan (required for requires_approval queries)")
+	paramsJSON := fs.String("params", "{}", "JSON string of the run's secret parameters, which the script only holds digests of (asked for on a terminal)")
+	dir := fs.String("rollback-dir", envOr("DBEXEC_ROLLBACK_DIR", defaultRollbackDir), "Directory holding the rollback scripts")
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	role := fs.String("role", os.Getenv("DBEXEC_ROLE"), "Role of the operator, checked against each query's required_role")
+	reason := fs.String("reason", "", "Why the run is rolled back, such as a ticket; required for requires_approval queries")
+	allowDDL := fs.Bool("allow-ddl", false, "Permit executing rollback_sql other than SELECT, INSERT, UPDATE or DELETE")
+	confirmEnv := fs.String("confirm-env", "", "Name of the run's production target, confirming execution against it")
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: dbexec rollback [--approve] [--approval-file approval.sig] run-id")
+	}
+	// Accept flags after the run ID, as in "dbexec rollback 3f2a9c0d --approve".
+	runID := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if err := logs.setup(); err != nil {
+		return err
+	}
+
+	script, err := readRollbackScript(rollbackPath(*dir, runID))
+	if err != nil {
+		return err
+	}
+	if err := loadQueries(); err != nil {
+		return err
+	}
+	if err := script.check(*role, *reason, *approve, *allowDDL); err != nil {
+		return fmt.Errorf("run %s not rolled back: %w", runID, err)
+	}
+	if err := announceTarget(os.Stderr, script.Target, *approve, *confirmEnv); err != nil {
+		return fmt.Errorf("run %s not rolled back: %w", runID, err)
+	}
+	for _, table := range script.Backups {
+		fmt.Fprintf(os.Stderr, "[BACKUP] Table=%s holds rows as they were before run %s\n", table, runID)
+	}
+	if len(script.Statements) == 0 {
+		fmt.Fprintf(os.Stderr, "Run %s has no rollback statements; restore its rows from the backup tables.\n", runID)
+		return nil
+	}
+	if *approve || *approvalFile != "" {
+		ids := script.requiresApproval()
+		if *approvalFile == "" && len(ids) > 0 {
+			return fmt.Errorf("run %s not rolled back: queries %s require approval: pass --approval-file from dbexec approve-plan %s", runID, strings.Join(ids, ","), rollbackPath(*dir, runID))
+		}
+		if *approvalFile != "" {
+			if err := checkApprovalFile(*approvalFile, script.RollbackOf, script.digest(), script.Actor); err != nil {
+				return fmt.Errorf("run %s not rolled back: %w", runID, err)
+			}
+		}
+	}
+	digests, err := script.secretParams()
+	if err != nil {
+		return fmt.Errorf("run %s not rolled back: %w", runID, err)
+	}
+	if len(digests) > 0 {
+		var supplied Params
+		if err := json.Unmarshal([]byte(*paramsJSON), &supplied); err != nil {
+			return fmt.Errorf("failed to parse parameters: %w", err)
+		}
+		secrets, err := secretParams(os.Stdin, os.Stderr, script.RollbackOf, digests, redactedParams(script.queryIDs()), supplied)
+		if err != nil {
+			return fmt.Errorf("run %s not rolled back: %w", runID, err)
+		}
+		for i, stmt := range script.Statements {
+			if script.Statements[i], err = stmt.withSecrets(script.RollbackOf, secrets); err != nil {
+				return fmt.Errorf("run %s not rolled back: %w", runID, err)
+			}
+		}
+	}
+
+	db, err := openDatabase(*driver, script.Target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	audit, err := openAuditLog(os.Getenv("DBEXEC_AUDIT_LOG"), io.Discard)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	ctx := contextFromEnvironment(context.Background())
+	rollbackRunID := newRunID()
+	summary, err := script.replay(ctx, db, rollbackRunID, *approve, os.Stderr)
+	audit.Record(auditRecord{RunID: rollbackRunID, RollbackOf: runID, Actor: cliActor(), Role: *role, Target: script.Target, Queries: script.queryIDs(), Approve: *approve, Reason: *reason, Summary: summary}, err)
+	if err == nil && !*approve {
+		fmt.Fprintln(os.Stderr, "Pass --approve to execute it.")
+	}
+	return err
+}
+
+// readRollbackScript reads the rollback script at path.
+func readRollbackScript(path string) (rollbackScript, error) {
+	var s rollbackScript
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("failed to read rollback script: %w", err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("failed to parse rollback script: %w", err)
+	}
+	return s, nil
+}
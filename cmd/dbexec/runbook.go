@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RunbookStep is one query of a runbook. Params fixes parameter values for
+// this step, overriding those supplied for the run.
+type RunbookStep struct {
+	Query  string `yaml:"query" json:"query"`
+	Params Params `yaml:"params" json:"params,omitempty"`
+}
+
+// UnmarshalYAML accepts either a bare query ID or a mapping with query and
+// params.
+func (s *RunbookStep) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = RunbookStep{Query: value.Value}
+		return nil
+	}
+	type plain RunbookStep
+	return value.Decode((*plain)(s))
+}
+
+// runbooks maps a runbook name to its ordered steps.
+var runbooks = map[string][]RunbookStep{}
+
+// runbookLocks maps the name of a runbook declaring a lock to the name of the
+// advisory lock its runs take.
+var runbookLocks = map[string]string{}
+
+// runbookDefinition is the long form of a runbook, a mapping with its steps
+// and the lock its runs take.
+type runbookDefinition struct {
+	Lock  string        `yaml:"lock"`
+	Steps []RunbookStep `yaml:"steps"`
+}
+
+// runbookOrder lists runbook names in the order they appear in the definitions file.
+var runbookOrder []string
+
+// definitionsFile is the layout of a definitions file that declares runbooks
+// alongside its queries. A file holding only a list of queries is also accepted.
+type definitionsFile struct {
+	Queries []QueryDefinition `yaml:"queries"`
+	// Runbooks is decoded by loadRunbooks to keep the file's order.
+	Runbooks yaml.Node `yaml:"runbooks"`
+}
+
+// loadRunbooks decodes a runbooks mapping, validates each runbook against the
+// loaded queries and stores it.
+func loadRunbooks(node *yaml.Node) error {
+	if node.Kind == 0 {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: runbooks must map runbook names to lists of steps", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name := node.Content[i].Value
+		var def runbookDefinition
+		var err error
+		if value := node.Content[i+1]; value.Kind == yaml.MappingNode {
+			err = value.Decode(&def)
+		} else {
+			err = value.Decode(&def.Steps)
+		}
+		if err != nil {
+			return fmt.Errorf("runbook %s: %w", name, err)
+		}
+		if def.Lock != "" && strings.TrimSpace(def.Lock) == "" {
+			return fmt.Errorf("runbook %s: lock cannot be blank", name)
+		}
+		if err := validateRunbook(name, def.Steps); err != nil {
+			return err
+		}
+		if _, exists := runbooks[name]; !exists {
+			runbookOrder = append(runbookOrder, name)
+		}
+		runbooks[name] = def.Steps
+		if def.Lock != "" {
+			runbookLocks[name] = def.Lock
+		} else {
+			delete(runbookLocks, name)
+		}
+	}
+	return nil
+}
+
+// validateRunbook checks that every step of a runbook names a known query,
+// only fixes parameters that query allows and only uses variables exported by
+// earlier steps.
+func validateRunbook(name string, steps []RunbookStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("runbook %s has no steps", name)
+	}
+	exported := map[string]bool{}
+	for i, step := range steps {
+		qdef, ok := queries[step.Query]
+		if !ok {
+			return fmt.Errorf("runbook %s: step %d references unknown query ID: %s", name, i, step.Query)
+		}
+		for param := range step.Params {
+			if !qdef.acceptsParam(param) || strings.HasPrefix(param, exportPrefix) {
+				return fmt.Errorf("runbook %s: step %d sets parameter %s, which query %s does not allow", name, i, param, qdef.ID)
+			}
+		}
+		for _, v := range qdef.exportedParams() {
+			if !exported[v] {
+				return fmt.Errorf("runbook %s: step %d uses %s%s, which no earlier step exports", name, i, exportPrefix, v)
+			}
+		}
+		for _, e := range qdef.Exports {
+			exported[e.As] = true
+		}
+	}
+	return nil
+}
+
+// allowsParam reports whether name is listed in the query's allowed_params.
+func (q QueryDefinition) allowsParam(name string) bool {
+	for _, p := range q.AllowedParams {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// expandRunbook returns the query IDs of a runbook's steps and the parameters
+// fixed for each of them.
+func expandRunbook(name string) ([]string, []Params, error) {
+	steps, ok := runbooks[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown runbook: %s", name)
+	}
+	ids := make([]string, len(steps))
+	stepParams := make([]Params, len(steps))
+	for i, step := range steps {
+		ids[i] = step.Query
+		stepParams[i] = step.Params
+	}
+	return ids, stepParams, nil
+}
+
+// withOverrides returns params with the values in overrides replacing or
+// adding to them. params itself is not modified.
+func (p Params) withOverrides(overrides Params) Params {
+	if len(overrides) == 0 {
+		return p
+	}
+	merged := make(Params, len(p)+len(overrides))
+	for k, v := range p {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// describeSteps renders a runbook's steps for the list command, e.g.
+// "lock_tenant -> set_status{status=offboarded}".
+func describeSteps(steps []RunbookStep) string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.Query
+		if len(step.Params) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(step.Params))
+		for k := range step.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for j, k := range keys {
+			keys[j] = k + "=" + step.Params[k].String()
+		}
+		names[i] += "{" + strings.Join(keys, ",") + "}"
+	}
+	return strings.Join(names, " -> ")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// parseSchedule parses a standard five-field cron spec such as "0 3 * * *",
+// or a descriptor such as @daily. Times are in the local time zone unless the
+// spec starts with CRON_TZ=.
+func parseSchedule(spec string) (cron.Schedule, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --schedule %q: %w", spec, err)
+	}
+	return sched, nil
+}
+
+// runScheduled calls run every time sched fires until ctx is done or dbexec
+// receives SIGINT or SIGTERM, which also cancels a run in progress so its
+// transaction is rolled back. Each run's outcome is logged; a failed run
+// doesn't stop the schedule.
+func runScheduled(ctx context.Context, sched cron.Schedule, run func(context.Context) error) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		next := sched.Next(time.Now())
+		slog.Info("waiting for next scheduled run", "at", next.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			slog.Info("schedule stopped")
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+
+		start := time.Now()
+		if err := run(ctx); err != nil {
+			slog.Error("scheduled run failed", "error", err, "exit_code", exitCode(err), "duration", time.Since(start))
+			continue
+		}
+		slog.Info("scheduled run succeeded", "duration", time.Since(start))
+	}
+}
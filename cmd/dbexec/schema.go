@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// schemaName matches the schema names a schema_param or --search-path may
+// select.
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// compileSchemaParam validates a query's schema_param and compiles its
+// schema_pattern allowlist, which must match the whole schema name.
+func compileSchemaParam(q *QueryDefinition) error {
+	if q.SchemaParam == "" {
+		if q.SchemaPattern != "" {
+			return fmt.Errorf("query %s: schema_pattern requires schema_param", q.ID)
+		}
+		return nil
+	}
+	if q.SchemaPattern == "" {
+		return fmt.Errorf("query %s: schema_param %s requires a schema_pattern allowlist", q.ID, q.SchemaParam)
+	}
+	if q.allowsParam(q.SchemaParam) {
+		return fmt.Errorf("query %s: schema parameter %s is also listed in allowed_params", q.ID, q.SchemaParam)
+	}
+	if _, ok := q.IdentifierParams[q.SchemaParam]; ok {
+		return fmt.Errorf("query %s: schema parameter %s is also an identifier parameter", q.ID, q.SchemaParam)
+	}
+	for name := range q.SessionParams {
+		if strings.EqualFold(name, "search_path") {
+			return fmt.Errorf("query %s: session_params cannot set search_path when schema_param is used", q.ID)
+		}
+	}
+	re, err := regexp.Compile("^(?:" + q.SchemaPattern + ")$")
+	if err != nil {
+		return fmt.Errorf("query %s: invalid schema_pattern: %w", q.ID, err)
+	}
+	q.schemaPattern = re
+	return nil
+}
+
+// sessionParamsFor returns the session parameters of the query run with
+// params: its session_params plus, with a schema_param, the search_path
+// selecting the schema given in params. The schema name must be a plain
+// lower-case identifier matching schema_pattern; it is quoted and bound as
+// the value of search_path, never put into the query's SQL.
+func (q QueryDefinition) sessionParamsFor(params Params) (map[string]string, error) {
+	if q.SchemaParam == "" {
+		return q.SessionParams, nil
+	}
+	val, ok := params[q.SchemaParam]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errMissingParam, q.SchemaParam)
+	}
+	if val.Null || !schemaName.MatchString(val.Value) || !q.schemaPattern.MatchString(val.Value) {
+		return nil, fmt.Errorf("%w %s for %s: %s is not an allowed schema", errInvalidParam, q.SchemaParam, q.ID, val)
+	}
+	sessionParams := make(map[string]string, len(q.SessionParams)+1)
+	for name, value := range q.SessionParams {
+		sessionParams[name] = value
+	}
+	sessionParams["search_path"] = pq.QuoteIdentifier(val.Value)
+	return sessionParams, nil
+}
+
+// parseSearchPath validates a comma-separated list of schemas given with
+// --search-path and returns it as a search_path value with each schema
+// quoted.
+func parseSearchPath(s string) (string, error) {
+	schemas := splitList(s)
+	if len(schemas) == 0 {
+		return "", fmt.Errorf("--search-path needs at least one schema")
+	}
+	for i, schema := range schemas {
+		if !schemaName.MatchString(schema) {
+			return "", fmt.Errorf("--search-path: invalid schema name %q", schema)
+		}
+		schemas[i] = pq.QuoteIdentifier(schema)
+	}
+	return strings.Join(schemas, ", "), nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"gopkg.in/yaml.v3"
+)
+
+// TokenDefinition grants a bearer token access to a set of queries in server mode.
+// Tokens are identified by the hex-encoded SHA-256 hash of the token value so
+// the config file never contains usable credentials.
+type TokenDefinition struct {
+	Name        string   `yaml:"name" json:"name"`
+	TokenSHA256 string   `yaml:"token_sha256" json:"token_sha256"`
+	Queries     []string `yaml:"queries" json:"queries"`
+	// Role is checked against the required_role of the queries the token runs.
+	Role string `yaml:"role" json:"role,omitempty"`
+}
+
+// tagPrefix marks an entry of a token's queries granting every query carrying
+// a tag, as in "tag:reports".
+const tagPrefix = "tag:"
+
+// allows reports whether the token may run the query with the given ID,
+// listed by ID or through one of its tags. Access to every query must be
+// granted explicitly with "*".
+func (t TokenDefinition) allows(id string) bool {
+	for _, q := range t.Queries {
+		if q == "*" || q == id {
+			return true
+		}
+		if tag, ok := strings.CutPrefix(q, tagPrefix); ok && containsString(queries[id].Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTokensFromYAML loads token definitions from a YAML file.
+func loadTokensFromYAML(path string) ([]TokenDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+
+	var list []TokenDefinition
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tokens: %w", err)
+	}
+
+	for i, t := range list {
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d has no name", i)
+		}
+		hash, err := hex.DecodeString(t.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("token %s: token_sha256 must be a hex-encoded SHA-256 hash", t.Name)
+		}
+		list[i].TokenSHA256 = strings.ToLower(t.TokenSHA256)
+	}
+	return list, nil
+}
+
+// server serves query runs over HTTP.
+type server struct {
+	db     *sql.DB
+	tokens []TokenDefinition
+	audit  *auditLog
+	stmts  *stmtCache
+	// heartbeat logs long-running statements; it never writes to responses.
+	heartbeat *heartbeat
+	// target is the connection profile db was opened with.
+	target string
+	// postCommit are the hooks fired after every committed run.
+	postCommit []PostCommitHook
+}
+
+// runRequest is the body of a POST /run request.
+type runRequest struct {
+	Queries []string `json:"queries"`
+	Params  Params   `json:"params"`
+	Approve bool     `json:"approve"`
+	// Reason is why the run is made, such as a change ticket, recorded in
+	// the audit log; required to execute requires_approval queries.
+	Reason string `json:"reason,omitempty"`
+}
+
+// runResponse is the body returned by POST /run.
+type runResponse struct {
+	RunID   string      `json:"run_id,omitempty"`
+	Output  string      `json:"output,omitempty"`
+	Summary *runSummary `json:"summary,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Denied  []string    `json:"denied,omitempty"`
+}
+
+// healthResponse is the body returned by GET /healthz and GET /readyz.
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readyTimeout bounds the database ping of GET /readyz, so a probe gets an
+// answer before the orchestrator's own timeout.
+const readyTimeout = 2 * time.Second
+
+// Limits on reading requests, so slow or stalled clients can't hold
+// connections open. Writing the response is bounded by --write-timeout, as it
+// waits for the run.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// serve runs dbexec as an HTTP service.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to listen on")
+	writeTimeout := fs.Duration("write-timeout", 10*time.Minute, "Time limit of each request, including its run, after its headers are read (0 for no limit)")
+	driver := fs.String("driver", driverPQ, "Database driver: postgres (lib/pq) or pgx")
+	connectRetries := fs.Int("connect-retries", 2, "Retry connecting to the database this many times at startup, with exponential backoff")
+	connectTimeout := fs.Duration("connect-timeout", 10*time.Second, "Time limit of each connection attempt (0 for no limit)")
+	pool := registerPoolFlags(fs)
+	heartbeatInterval := fs.Duration("heartbeat", 30*time.Second, "Log statements still running after this long, and again at this interval (0 disables)")
+	target := fs.String("target", os.Getenv("DBEXEC_TARGET"), "Connection profile from the targets file to serve (default DATABASE_URL)")
+	tokensPath := fs.String("tokens", os.Getenv("DBEXEC_TOKENS_PATH"), "Path to the YAML file containing bearer token definitions")
+	var onNotify notifyFlag
+	fs.Var(&onNotify, "on-notify", "Execute a query for every NOTIFY on a channel, as channel:query_id (repeatable)")
+	postCommit := registerPostCommitFlags(fs)
+	logs := registerLogFlags(fs)
+	fs.Parse(args)
+	if err := logs.setup(); err != nil {
+		return err
+	}
+	postCommitHooks, err := postCommit.hooks()
+	if err != nil {
+		return err
+	}
+
+	if *tokensPath == "" {
+		return fmt.Errorf("server mode requires --tokens or DBEXEC_TOKENS_PATH")
+	}
+	tokens, err := loadTokensFromYAML(*tokensPath)
+	if err != nil {
+		return err
+	}
+
+	if err := loadQueries(); err != nil {
+		return err
+	}
+	if err := checkNotifyBindings(onNotify); err != nil {
+		return err
+	}
+	db, err := openDatabase(*driver, *target)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pool.apply(db)
+	if err := preflight(context.Background(), db, *connectRetries, *connectTimeout, os.Stderr); err != nil {
+		return err
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	audit, err := openAuditLog(os.Getenv("DBEXEC_AUDIT_LOG"), os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	s := &server{
+		db:         db,
+		tokens:     tokens,
+		audit:      audit,
+		stmts:      stmts,
+		target:     *target,
+		heartbeat:  &heartbeat{W: os.Stderr, Interval: *heartbeatInterval},
+		postCommit: postCommitHooks,
+	}
+	if len(onNotify) > 0 {
+		// LISTEN needs a dedicated lib/pq connection whatever the driver.
+		dbURL, err := databaseURL(*target)
+		if err != nil {
+			return err
+		}
+		if err := s.listenForNotifications(context.Background(), dbURL, onNotify); err != nil {
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /run", s.handleRun)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	slog.Info("dbexec listening", "addr", *listen)
+	return srv.ListenAndServe()
+}
+
+// authenticate returns the token definition matching the request's bearer token.
+func (s *server) authenticate(r *http.Request) (TokenDefinition, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return TokenDefinition{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := []byte(hex.EncodeToString(sum[:]))
+
+	var match TokenDefinition
+	found := false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.TokenSHA256)) == 1 {
+			match, found = t, true
+		}
+	}
+	return match, found
+}
+
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, runResponse{Error: "invalid or missing bearer token"})
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, runResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if len(req.Queries) == 0 {
+		writeJSON(w, http.StatusBadRequest, runResponse{Error: "queries must not be empty"})
+		return
+	}
+
+	var denied []string
+	for _, id := range req.Queries {
+		if !token.allows(strings.TrimSpace(id)) {
+			denied = append(denied, id)
+		}
+	}
+	if len(denied) > 0 {
+		s.audit.Record(auditRecord{Actor: token.Name, Queries: req.Queries, Approve: req.Approve, Reason: req.Reason}, fmt.Errorf("denied queries: %s", strings.Join(denied, ",")))
+		writeJSON(w, http.StatusForbidden, runResponse{Error: "token is not allowed to run these queries", Denied: denied})
+		return
+	}
+
+	if req.Approve {
+		if err := checkReason(req.Queries, req.Reason); err != nil {
+			s.audit.Record(auditRecord{Actor: token.Name, Queries: req.Queries, Approve: req.Approve}, err)
+			writeJSON(w, http.StatusBadRequest, runResponse{Error: err.Error()})
+			return
+		}
+		if err := checkUnapproved(req.Queries); err != nil {
+			s.audit.Record(auditRecord{Actor: token.Name, Queries: req.Queries, Approve: req.Approve, Reason: req.Reason}, err)
+			writeJSON(w, http.StatusForbidden, runResponse{Error: err.Error()})
+			return
+		}
+		if err := s.audit.checkRateLimits(req.Queries, time.Now()); err != nil {
+			s.audit.Record(auditRecord{Actor: token.Name, Queries: req.Queries, Approve: req.Approve, Reason: req.Reason}, err)
+			writeJSON(w, http.StatusTooManyRequests, runResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	runID := newRunID()
+	var out bytes.Buffer
+	summary, err := runQueriesInTransaction(ctx, s.db, req.Queries, req.Params, runOptions{
+		Approve:    req.Approve,
+		Out:        &out,
+		Stmts:      s.stmts,
+		RunID:      runID,
+		Heartbeat:  s.heartbeat,
+		Role:       token.Role,
+		Actor:      token.Name,
+		Reason:     req.Reason,
+		Target:     s.target,
+		PostCommit: s.postCommit,
+	})
+	s.audit.Record(auditRecord{RunID: runID, Actor: token.Name, Role: token.Role, Target: s.target, Queries: req.Queries, Approve: req.Approve, Reason: req.Reason, Summary: summary}, err)
+	var permErr *permissionError
+	if errors.As(err, &permErr) {
+		writeJSON(w, http.StatusForbidden, runResponse{RunID: runID, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, runResponse{RunID: runID, Output: out.String(), Summary: summary, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, runResponse{RunID: runID, Output: out.String(), Summary: summary})
+}
+
+// handleHealthz answers the liveness probe: the process is serving requests.
+// It doesn't touch the database, so an outage doesn't get the instance
+// restarted.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReadyz answers the readiness probe by pinging the database, with 503
+// and the reason when it can't be reached.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := s.db.PingContext(ctx); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: fmt.Sprintf("database unreachable: %v", err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write response", "error", err)
+	}
+}
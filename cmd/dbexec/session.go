@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// sessionParamName matches the names of run-time parameters that can be set
+// with session_params, including custom ones such as app.tenant.
+var sessionParamName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// validateSessionParams checks the names of a query's session parameters.
+func validateSessionParams(q QueryDefinition) error {
+	for name := range q.SessionParams {
+		if !sessionParamName.MatchString(name) {
+			return fmt.Errorf("query %s: invalid session parameter name %q", q.ID, name)
+		}
+	}
+	return nil
+}
+
+// setSessionParams applies a query's session parameters for the rest of the
+// transaction, as SET LOCAL would, and returns a function restoring the values
+// they had before so later queries of the run are unaffected. Values are bound
+// with set_config so they are never interpolated into SQL.
+func (e txExecutor) setSessionParams(ctx context.Context, params map[string]string) (func(context.Context) error, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	previous := make(map[string]string, len(names))
+	restore := func(ctx context.Context) error {
+		for _, name := range names {
+			old, ok := previous[name]
+			if !ok {
+				continue
+			}
+			if _, err := e.tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", name, old); err != nil {
+				return fmt.Errorf("failed to restore session parameter %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		// A custom parameter that was never set reads as NULL and is restored
+		// as an empty string.
+		var old sql.NullString
+		if err := e.tx.QueryRowContext(ctx, "SELECT current_setting($1, true)", name).Scan(&old); err != nil {
+			return nil, fmt.Errorf("failed to read session parameter %s: %w", name, err)
+		}
+		if _, err := e.tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", name, params[name]); err != nil {
+			return nil, fmt.Errorf("failed to set session parameter %s: %w", name, err)
+		}
+		previous[name] = old.String
+	}
+	return restore, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// spoolFile holds the output of a run that can't be written yet, such as one
+// of several running at once, in a temporary file rather than in memory, so
+// memory stays flat however large its result sets are.
+type spoolFile struct {
+	f *os.File
+}
+
+// newSpoolFile creates an empty spool file in the temporary directory.
+func newSpoolFile() (*spoolFile, error) {
+	f, err := os.CreateTemp("", "dbexec-output-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return &spoolFile{f: f}, nil
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+	return s.f.Write(p)
+}
+
+// reader returns the output written so far, from its start.
+func (s *spoolFile) reader() (io.Reader, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read spool file: %w", err)
+	}
+	return s.f, nil
+}
+
+// WriteTo copies the output written so far to w.
+func (s *spoolFile) WriteTo(w io.Writer) (int64, error) {
+	r, err := s.reader()
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, r)
+}
+
+// Close closes and removes the file.
+func (s *spoolFile) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
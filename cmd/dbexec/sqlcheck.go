@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sqlTokenKind classifies a lexical token of a SQL statement.
+type sqlTokenKind int
+
+const (
+	tokenWord        sqlTokenKind = iota // keyword or unquoted identifier
+	tokenQuotedIdent                     // "identifier"
+	tokenString                          // 'literal', E'literal' or $tag$literal$tag$
+	tokenNumber                          // numeric literal
+	tokenParam                           // positional parameter such as $1
+	tokenPunct                           // any other single character
+)
+
+// sqlToken is a lexical token of a SQL statement. Depth is the parenthesis
+// nesting level the token appears at, and Pos its byte offset in the
+// statement.
+type sqlToken struct {
+	Kind  sqlTokenKind
+	Text  string
+	Depth int
+	Pos   int
+}
+
+// tokenizeSQL splits a SQL statement into tokens, skipping whitespace and
+// comments. It understands quoted identifiers, string literals and
+// dollar-quoted strings well enough to tell code from data; it is not a parser.
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 1
+		case strings.HasPrefix(sql[i:], "/*"):
+			// Postgres block comments nest.
+			nesting := 0
+			j := i
+			for j < len(sql) {
+				if strings.HasPrefix(sql[j:], "/*") {
+					nesting++
+					j += 2
+				} else if strings.HasPrefix(sql[j:], "*/") {
+					nesting--
+					j += 2
+					if nesting == 0 {
+						break
+					}
+				} else {
+					j++
+				}
+			}
+			i = j
+		case c == '\'':
+			end := scanQuoted(sql, i, '\'')
+			tokens = append(tokens, sqlToken{tokenString, sql[i:end], depth, i})
+			i = end
+		case c == '"':
+			end := scanQuoted(sql, i, '"')
+			tokens = append(tokens, sqlToken{tokenQuotedIdent, sql[i:end], depth, i})
+			i = end
+		case c == '$':
+			if tag, ok := dollarTag(sql[i:]); ok {
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end < 0 {
+					end = len(sql)
+				} else {
+					end = i + len(tag) + end + len(tag)
+				}
+				tokens = append(tokens, sqlToken{tokenString, sql[i:end], depth, i})
+				i = end
+				break
+			}
+			j := i + 1
+			for j < len(sql) && sql[j] >= '0' && sql[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				tokens = append(tokens, sqlToken{tokenParam, sql[i:j], depth, i})
+			} else {
+				tokens = append(tokens, sqlToken{tokenPunct, "$", depth, i})
+			}
+			i = j
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(sql) && isIdentPart(sql[j]) {
+				j++
+			}
+			// E'...' and similar prefixed string literals.
+			if j < len(sql) && sql[j] == '\'' && j == i+1 && strings.ContainsRune("eEbBxXnN", rune(c)) {
+				end := scanQuoted(sql, j, '\'')
+				tokens = append(tokens, sqlToken{tokenString, sql[i:end], depth, i})
+				i = end
+				break
+			}
+			tokens = append(tokens, sqlToken{tokenWord, sql[i:j], depth, i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(sql) && (sql[j] >= '0' && sql[j] <= '9' || sql[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, sqlToken{tokenNumber, sql[i:j], depth, i})
+			i = j
+		default:
+			if c == ')' && depth > 0 {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{tokenPunct, string(c), depth, i})
+			if c == '(' {
+				depth++
+			}
+			i++
+		}
+	}
+	return tokens
+}
+
+// scanQuoted returns the index just past the quoted section starting at
+// sql[start], treating a doubled quote character as an escaped quote.
+func scanQuoted(sql string, start int, quote byte) int {
+	i := start + 1
+	for i < len(sql) {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		if sql[i] == '\\' && quote == '\'' && i+1 < len(sql) {
+			// Backslash escapes only matter in E'' strings, but skipping them
+			// elsewhere is harmless for tokenizing purposes.
+			i += 2
+			continue
+		}
+		i++
+	}
+	return len(sql)
+}
+
+// dollarTag reports whether s starts with a dollar-quote opener such as $$ or
+// $body$ and returns it.
+func dollarTag(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '$' {
+		return "", false
+	}
+	if s[1] == '$' {
+		return "$$", true
+	}
+	if !isIdentStart(s[1]) {
+		return "", false
+	}
+	j := 2
+	for j < len(s) && isIdentPart(s[j]) && s[j] != '$' {
+		j++
+	}
+	if j < len(s) && s[j] == '$' {
+		return s[:j+1], true
+	}
+	return "", false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9' || c == '$'
+}
+
+// placeholderCount returns the highest positional parameter ($n) referenced
+// by a statement.
+func placeholderCount(sql string) int {
+	highest := 0
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind != tokenParam {
+			continue
+		}
+		if n, err := strconv.Atoi(t.Text[1:]); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// hasReturning reports whether a statement has a top-level RETURNING clause,
+// so it returns rows even though it isn't a SELECT.
+func hasReturning(sql string) bool {
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind == tokenWord && t.Depth == 0 && strings.EqualFold(t.Text, "RETURNING") {
+			return true
+		}
+	}
+	return false
+}
+
+// dmlKeywords are the statement types definitions may use by default. Any
+// other statement (TRUNCATE, ALTER, DROP, CREATE, GRANT, COPY, VACUUM, ...)
+// requires allow_ddl: true in the definition and --allow-ddl at run time.
+var dmlKeywords = map[string]bool{
+	"SELECT": true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+}
+
+// statementKeyword returns the leading SQL keyword of a statement, upper-cased,
+// ignoring leading whitespace, comments and opening parentheses.
+func statementKeyword(sql string) string {
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind == tokenWord {
+			return strings.ToUpper(t.Text)
+		}
+		if t.Text != "(" {
+			return ""
+		}
+	}
+	return ""
+}
+
+// statementType classifies a statement by the keyword of the statement it
+// executes. For a statement starting with WITH, that is the first top-level
+// keyword after the common table expressions, so a data-modifying CTE such as
+// "WITH x AS (...) DELETE ..." is classified as DELETE.
+func statementType(sql string) string {
+	keyword := statementKeyword(sql)
+	if keyword != "WITH" {
+		return keyword
+	}
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind != tokenWord || t.Depth > 0 {
+			continue
+		}
+		switch kw := strings.ToUpper(t.Text); kw {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE":
+			return kw
+		}
+	}
+	return keyword
+}
+
+// cteBodies returns the statements of the common table expressions of a
+// statement starting with WITH, and of those they hold in turn, so the
+// statements of a data-modifying CTE such as
+// "WITH d AS (DELETE FROM users RETURNING *) SELECT ..." can be checked like
+// the statement itself. Postgres only allows data-modifying CTEs at the top
+// level, so WITH clauses of subqueries aren't looked at.
+func cteBodies(sql string) []string {
+	if statementKeyword(sql) != "WITH" {
+		return nil
+	}
+	var bodies []string
+	tokens := tokenizeSQL(sql)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.Depth > 0 || t.Kind != tokenWord {
+			continue
+		}
+		switch strings.ToUpper(t.Text) {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE":
+			// The statement the CTEs are for.
+			return bodies
+		case "AS":
+		default:
+			continue
+		}
+		// AS [NOT] [MATERIALIZED] ( body )
+		j := i + 1
+		for j < len(tokens) && tokens[j].Kind == tokenWord && (strings.EqualFold(tokens[j].Text, "NOT") || strings.EqualFold(tokens[j].Text, "MATERIALIZED")) {
+			j++
+		}
+		if j == len(tokens) || tokens[j].Text != "(" {
+			continue
+		}
+		end := j + 1
+		for end < len(tokens) && !(tokens[end].Depth == 0 && tokens[end].Text == ")") {
+			end++
+		}
+		if end == len(tokens) {
+			break
+		}
+		body := sql[tokens[j].Pos+1 : tokens[end].Pos]
+		bodies = append(bodies, body)
+		bodies = append(bodies, cteBodies(body)...)
+		i = end
+	}
+	return bodies
+}
+
+// hasMultipleStatements reports whether sql holds more than one statement,
+// i.e. a top-level semicolon followed by anything but comments.
+func hasMultipleStatements(sql string) bool {
+	tokens := tokenizeSQL(sql)
+	for i, t := range tokens {
+		if t.Kind == tokenPunct && t.Text == ";" && t.Depth == 0 {
+			for _, rest := range tokens[i+1:] {
+				if rest.Text != ";" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// hasWhereClause reports whether a statement has a top-level WHERE clause
+// after the keyword of the statement it executes, so a WHERE inside a common
+// table expression, subquery, comment or string literal doesn't count.
+func hasWhereClause(sql string) bool {
+	keyword := statementType(sql)
+	seen := false
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind != tokenWord || t.Depth > 0 {
+			continue
+		}
+		word := strings.ToUpper(t.Text)
+		if !seen {
+			seen = word == keyword
+			continue
+		}
+		if word == "WHERE" {
+			return true
+		}
+	}
+	return false
+}
+
+// isFullTable reports whether a statement, or one of its common table
+// expressions, is an UPDATE or DELETE without a WHERE clause.
+func isFullTable(sql string) bool {
+	for _, stmtSQL := range append([]string{sql}, cteBodies(sql)...) {
+		switch statementType(stmtSQL) {
+		case "UPDATE", "DELETE":
+			if !hasWhereClause(stmtSQL) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiresFullTable reports whether any of the query's statements updates or
+// deletes every row of a table.
+func (q QueryDefinition) requiresFullTable() bool {
+	for _, stmtSQL := range q.SQL {
+		if isFullTable(stmtSQL) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresDDL reports whether any of the query's statements is of a type
+// outside dmlKeywords.
+func (q QueryDefinition) requiresDDL() bool {
+	for _, stmtSQL := range q.SQL {
+		if !dmlKeywords[statementType(stmtSQL)] {
+			return true
+		}
+	}
+	return false
+}
+
+// isRead reports whether a statement only reads: a SELECT that neither
+// writes its rows into a new table with SELECT INTO nor has a data-modifying
+// common table expression.
+func isRead(sql string) bool {
+	if statementType(sql) != "SELECT" {
+		return false
+	}
+	for _, body := range cteBodies(sql) {
+		if statementType(body) != "SELECT" {
+			return false
+		}
+	}
+	seen := false
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind != tokenWord || t.Depth > 0 {
+			continue
+		}
+		word := strings.ToUpper(t.Text)
+		if !seen {
+			seen = word == "SELECT"
+			continue
+		}
+		if word == "INTO" {
+			return false
+		}
+	}
+	return true
+}
+
+// readOnly reports whether every statement of the query only reads, as
+// isRead tells.
+func (q QueryDefinition) readOnly() bool {
+	for _, stmtSQL := range q.SQL {
+		if !isRead(stmtSQL) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateStatementType rejects definitions with a statement other than
+// SELECT, INSERT, UPDATE or DELETE, or with an UPDATE or DELETE lacking a
+// WHERE clause, unless the definition explicitly allows it. It also rejects
+// entries holding more than one statement, which would otherwise hide a
+// statement from these checks.
+func validateStatementType(q QueryDefinition) error {
+	if len(q.SQL) == 0 {
+		return fmt.Errorf("query %s: sql is empty", q.ID)
+	}
+	for i, stmtSQL := range q.SQL {
+		keyword := statementType(stmtSQL)
+		if keyword == "" {
+			return fmt.Errorf("query %s: sql is empty", q.statementLabel(i))
+		}
+		if hasMultipleStatements(stmtSQL) {
+			return fmt.Errorf("query %s: sql holds more than one statement; list them separately under statements", q.statementLabel(i))
+		}
+		if !dmlKeywords[keyword] && !q.AllowDDL {
+			return fmt.Errorf("query %s: %s statements are not allowed without allow_ddl: true", q.statementLabel(i), keyword)
+		}
+		if isFullTable(stmtSQL) && !q.AllowFullTable {
+			return fmt.Errorf("query %s: %s statement has no WHERE clause; set allow_full_table: true if it is meant to affect every row", q.statementLabel(i), keyword)
+		}
+	}
+	return nil
+}
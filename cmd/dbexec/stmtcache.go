@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// stmtCache holds prepared statements keyed by query ID and SQL text so
+// repeated runs in server mode reuse the prepared plan instead of re-parsing
+// the SQL. Keying on the text gives each identifier substitution its own
+// statement.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// newStmtCache returns an empty statement cache for db.
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// prepare returns the cached statement for key, preparing query on first use.
+func (c *stmtCache) prepare(ctx context.Context, key, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheKey := key + "\x00" + query
+	if stmt, ok := c.stmts[cacheKey]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare %s: %w", key, err)
+	}
+	c.stmts[cacheKey] = stmt
+	return stmt, nil
+}
+
+// Close closes all cached statements.
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for key, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.stmts, key)
+	}
+	return firstErr
+}
+
+// txExecutor runs statements inside a transaction, re-associating cached
+// prepared statements with the transaction when a cache is configured.
+type txExecutor struct {
+	tx *sql.Tx
+	// conn is the connection tx runs on, for driver-specific operations
+	// such as COPY.
+	conn  *sql.Conn
+	stmts *stmtCache
+}
+
+// QueryContext runs a query identified by key within the transaction.
+func (e txExecutor) QueryContext(ctx context.Context, key, query string, args ...interface{}) (*sql.Rows, error) {
+	if e.stmts == nil {
+		return e.tx.QueryContext(ctx, query, args...)
+	}
+	stmt, err := e.stmts.prepare(ctx, key, query)
+	if err != nil {
+		return nil, err
+	}
+	// The transaction-bound statement is closed when the transaction ends.
+	return e.tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+}
+
+// ExecContext runs a statement identified by key within the transaction.
+func (e txExecutor) ExecContext(ctx context.Context, key, query string, args ...interface{}) (sql.Result, error) {
+	if e.stmts == nil {
+		return e.tx.ExecContext(ctx, query, args...)
+	}
+	stmt, err := e.stmts.prepare(ctx, key, query)
+	if err != nil {
+		return nil, err
+	}
+	return e.tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+}
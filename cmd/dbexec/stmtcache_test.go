@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+const stmtCacheCatalog = `
+- id: user_count
+  sql: SELECT count(*) FROM pg_catalog.pg_class WHERE relkind = $1
+  allowed_params: [kind]
+`
+
+func TestStmtCachePreparesOnce(t *testing.T) {
+	loadTestQueries(t, stmtCacheCatalog)
+	db, fake := newFakeDB(t, nil)
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	var afterFirst int64
+	for i := 0; i < 5; i++ {
+		_, err := runQueriesInTransaction(context.Background(), db, []string{"user_count"}, Params{"kind": {Value: "r"}}, runOptions{Out: io.Discard, Stmts: stmts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			afterFirst = fake.prepares.Load()
+		}
+	}
+	// The statement is prepared once per connection it runs on.
+	if n := fake.prepares.Load(); n != afterFirst {
+		t.Errorf("prepared %d statements after 5 runs, %d after the first", n, afterFirst)
+	}
+}
+
+// BenchmarkStmtCache compares repeated runs of a query with and without the
+// statement cache on the database at DATABASE_URL.
+func BenchmarkStmtCache(b *testing.B) {
+	db := testPostgres(b)
+	loadTestQueries(b, stmtCacheCatalog)
+	params := Params{"kind": {Value: "r"}}
+
+	run := func(b *testing.B, stmts *stmtCache) {
+		for i := 0; i < b.N; i++ {
+			_, err := runQueriesInTransaction(context.Background(), db, []string{"user_count"}, params, runOptions{Out: io.Discard, Stmts: stmts})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("uncached", func(b *testing.B) { run(b, nil) })
+	b.Run("cached", func(b *testing.B) {
+		stmts := newStmtCache(db)
+		defer stmts.Close()
+		run(b, stmts)
+	})
+}
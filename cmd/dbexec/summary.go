@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Statement outcomes recorded in a run summary.
+const (
+	modeExecuted     = "executed"
+	modePreview      = "preview"
+	modeNotPreviewed = "not_previewed"
+	modeSkipped      = "skipped"
+)
+
+// durationMS is a duration encoded in JSON as fractional milliseconds.
+type durationMS time.Duration
+
+// MarshalJSON encodes the duration as milliseconds.
+func (d durationMS) MarshalJSON() ([]byte, error) {
+	return json.Marshal(float64(d) / float64(time.Millisecond))
+}
+
+// UnmarshalJSON decodes a duration encoded as milliseconds.
+func (d *durationMS) UnmarshalJSON(data []byte) error {
+	var ms float64
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return err
+	}
+	*d = durationMS(ms * float64(time.Millisecond))
+	return nil
+}
+
+// statementResult records the outcome of a single statement in a run.
+type statementResult struct {
+	QueryID   string     `json:"query_id"`
+	Statement string     `json:"statement"`
+	Mode      string     `json:"mode"`
+	Rows      int64      `json:"rows"`
+	Duration  durationMS `json:"duration_ms"`
+	// Plan is the EXPLAIN output when --explain is used.
+	Plan string `json:"plan,omitempty"`
+	// Role is the database role the statement ran as, if the query sets
+	// one.
+	Role string `json:"role,omitempty"`
+	// Backup is the table the rows were copied to before the statement
+	// modified them, for queries with backup: true.
+	Backup     string `json:"backup,omitempty"`
+	BackupRows int64  `json:"backup_rows,omitempty"`
+}
+
+// runSummary describes a completed or failed run.
+type runSummary struct {
+	RunID     string `json:"run_id"`
+	Target    string `json:"target,omitempty"`
+	Committed bool   `json:"committed"`
+	// Reason is the operator's --reason for the run.
+	Reason     string            `json:"reason,omitempty"`
+	Statements []statementResult `json:"statements"`
+	Elapsed    durationMS        `json:"elapsed_ms"`
+	CommitTime durationMS        `json:"commit_ms"`
+	// WindowOverrides lists the queries executed outside their allowed
+	// windows with --override-window.
+	WindowOverrides []string `json:"window_overrides,omitempty"`
+	// Rollback is the rollback script written for the run, if any of its
+	// queries can be undone.
+	Rollback string `json:"rollback,omitempty"`
+	// Outputs are the files the run's result sets were written to with
+	// --output-dir.
+	Outputs []string `json:"outputs,omitempty"`
+	// Queries is the outcome of each query of a --parallel run, which
+	// commits them separately.
+	Queries []queryStatus `json:"queries,omitempty"`
+
+	// role is the database role recorded for the statements added next.
+	role string
+}
+
+// add records a statement result and returns it for further annotation.
+func (s *runSummary) add(queryID, label, mode string, rows int64, elapsed time.Duration) *statementResult {
+	s.Statements = append(s.Statements, statementResult{
+		QueryID:   queryID,
+		Statement: label,
+		Mode:      mode,
+		Rows:      rows,
+		Duration:  durationMS(elapsed),
+		Role:      s.role,
+	})
+	return &s.Statements[len(s.Statements)-1]
+}
+
+// writeOutputFiles lists the files a run wrote its results to, if any.
+func writeOutputFiles(out io.Writer, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "Results written to:")
+	for _, path := range paths {
+		fmt.Fprintf(out, "  %s\n", path)
+	}
+}
+
+// writeJSON writes the summary as a single-line JSON object.
+func (s *runSummary) writeJSON(out io.Writer) error {
+	return json.NewEncoder(out).Encode(struct {
+		Summary *runSummary `json:"summary"`
+	}{s})
+}
+
+// runReport is the document written by --summary-json: the summaries of
+// every transaction of an invocation and the error that ended it, if any.
+type runReport struct {
+	DryRun bool `json:"dry_run"`
+	// Committed reports whether every transaction was committed.
+	Committed bool          `json:"committed"`
+	Error     string        `json:"error,omitempty"`
+	Runs      []*runSummary `json:"runs"`
+}
+
+// newRunReport builds the report of an invocation from its run summaries and
+// the error that ended it.
+func newRunReport(approve bool, runs []*runSummary, runErr error) runReport {
+	r := runReport{DryRun: !approve, Committed: approve && runErr == nil, Runs: runs}
+	for _, s := range runs {
+		if !s.Committed {
+			r.Committed = false
+		}
+	}
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	return r
+}
+
+// writeFile writes the report as indented JSON to path.
+func (r runReport) writeFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
+
+// formatDuration renders a duration with a precision suited to its size.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(10 * time.Microsecond).String()
+	default:
+		return d.Round(time.Millisecond).String()
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TargetDefinition is a named database connection profile. The connection
+// string is given directly with url or, to keep credentials out of the file,
+// read from the environment variable named by url_env. Executing against a
+// production target must be confirmed with --confirm-env.
+type TargetDefinition struct {
+	URL        string `yaml:"url" json:"url,omitempty"`
+	URLEnv     string `yaml:"url_env" json:"url_env,omitempty"`
+	Production bool   `yaml:"production" json:"production,omitempty"`
+}
+
+// loadTargetsFromYAML loads connection profiles from a YAML file mapping
+// target names to their definitions.
+func loadTargetsFromYAML(path string) (map[string]TargetDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %w", err)
+	}
+	var targets map[string]TargetDefinition
+	if err := yaml.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal targets: %w", err)
+	}
+	for name, t := range targets {
+		if (t.URL == "") == (t.URLEnv == "") {
+			return nil, fmt.Errorf("target %s: set exactly one of url and url_env", name)
+		}
+	}
+	return targets, nil
+}
+
+// databaseURL returns the connection string of the named target, read from
+// the targets file at DBEXEC_TARGETS_PATH (default targets.yaml). Without a
+// target, DATABASE_URL is used.
+func databaseURL(target string) (string, error) {
+	if target == "" {
+		dbURL := os.Getenv("DATABASE_URL")
+		if dbURL == "" {
+			return "", fmt.Errorf("DATABASE_URL is required")
+		}
+		return dbURL, nil
+	}
+
+	t, err := lookupTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if t.URLEnv != "" {
+		dbURL := os.Getenv(t.URLEnv)
+		if dbURL == "" {
+			return "", fmt.Errorf("target %s: %s is not set", target, t.URLEnv)
+		}
+		return dbURL, nil
+	}
+	return t.URL, nil
+}
+
+// lookupTarget returns the named target from the targets file at
+// DBEXEC_TARGETS_PATH (default targets.yaml).
+func lookupTarget(name string) (TargetDefinition, error) {
+	path := os.Getenv("DBEXEC_TARGETS_PATH")
+	if path == "" {
+		path = "targets.yaml"
+	}
+	targets, err := loadTargetsFromYAML(path)
+	if err != nil {
+		return TargetDefinition{}, err
+	}
+	t, ok := targets[name]
+	if !ok {
+		return TargetDefinition{}, fmt.Errorf("unknown target: %s", name)
+	}
+	return t, nil
+}
+
+// announceTarget prints the connection a run is about to use, so the
+// operator sees where it goes before anything runs. For a production target
+// that will be executed against, confirm must repeat the target's name.
+func announceTarget(w io.Writer, target string, approve bool, confirm string) error {
+	if target == "" {
+		fmt.Fprintln(w, "[TARGET] DATABASE_URL")
+		return nil
+	}
+	t, err := lookupTarget(target)
+	if err != nil {
+		return err
+	}
+	if !t.Production {
+		fmt.Fprintf(w, "[TARGET] %s\n", target)
+		return nil
+	}
+	fmt.Fprintf(w, "[TARGET] %s (PRODUCTION)\n", target)
+	if approve && !containsString(splitList(confirm), target) {
+		return fmt.Errorf("target %s is marked production: pass --confirm-env %s to execute against it", target, target)
+	}
+	return nil
+}
+
+// checkWriteGate fails an approved run in an environment that sets
+// DBEXEC_PREVIEW_ONLY, such as a CI job, unless DBEXEC_ALLOW_WRITE=1 is also
+// set, so a script passing --approve by mistake can't write to a protected
+// database.
+func checkWriteGate() error {
+	if os.Getenv("DBEXEC_PREVIEW_ONLY") == "" || os.Getenv("DBEXEC_ALLOW_WRITE") == "1" {
+		return nil
+	}
+	return fmt.Errorf("DBEXEC_PREVIEW_ONLY is set: executing with --approve also requires DBEXEC_ALLOW_WRITE=1")
+}
+
+// checkTarget fails if q declares targets and target isn't one of them, or
+// declares a database other than target.
+func (q QueryDefinition) checkTarget(target string) error {
+	if q.Database != "" && q.Database != target {
+		return fmt.Errorf("%s runs against database %s, not %s", q.ID, q.Database, targetLabel(target))
+	}
+	if len(q.Targets) == 0 || containsString(q.Targets, target) {
+		return nil
+	}
+	if target == "" {
+		return fmt.Errorf("%s may only run against targets %v; select one with --target", q.ID, q.Targets)
+	}
+	return fmt.Errorf("%s may only run against targets %v, not %s", q.ID, q.Targets, target)
+}
+
+// targetLabel names target in messages, where "" stands for DATABASE_URL.
+func targetLabel(target string) string {
+	if target == "" {
+		return "DATABASE_URL"
+	}
+	return target
+}
+
+// targetGroup is the part of a run that goes to one database.
+type targetGroup struct {
+	Target string
+	IDs    []string
+	// StepParams holds the step parameters of IDs, if the run has any.
+	StepParams []Params
+	DB         *sql.DB
+}
+
+// groupByDatabase splits ids by the database each query runs against: the
+// one it declares, or target. Groups are ordered by their first query and
+// keep the order of their queries.
+func groupByDatabase(ids []string, stepParams []Params, target string) []targetGroup {
+	var groups []targetGroup
+	index := map[string]int{}
+	for i, id := range ids {
+		database := target
+		if qdef, ok := queries[strings.TrimSpace(id)]; ok && qdef.Database != "" {
+			database = qdef.Database
+		}
+		g, ok := index[database]
+		if !ok {
+			g = len(groups)
+			index[database] = g
+			groups = append(groups, targetGroup{Target: database})
+		}
+		groups[g].IDs = append(groups[g].IDs, id)
+		if stepParams != nil {
+			groups[g].StepParams = append(groups[g].StepParams, stepParams[i])
+		}
+	}
+	return groups
+}
+
+// groupTargetNames lists the databases of groups.
+func groupTargetNames(groups []targetGroup) []string {
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = targetLabel(g.Target)
+	}
+	return names
+}
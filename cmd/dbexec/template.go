@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// parseRowTemplate parses the template of --output template, given inline
+// as text or in the file path. Referring to a column the result doesn't have
+// is an error rather than <no value>.
+func parseRowTemplate(text, path string) (*template.Template, error) {
+	if (text == "") == (path == "") {
+		return nil, fmt.Errorf("--output template needs exactly one of --template or --template-file")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template file: %w", err)
+		}
+		text = string(data)
+	}
+	// The functions are replaced with the result set's in writeTemplateResults.
+	tmpl, err := template.New("row").Option("missingkey=error").Funcs(rowTemplateFuncs("", new(int))).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// rowTemplateFuncs returns the functions row templates can call: queryID
+// returns the ID of the query, and rowNumber the number of the row being
+// written, counting from 1.
+func rowTemplateFuncs(queryID string, rowNumber *int) template.FuncMap {
+	return template.FuncMap{
+		"queryID":   func() string { return queryID },
+		"rowNumber": func() int { return *rowNumber },
+	}
+}
+
+// writeTemplateResults executes tmpl once per row, with the row's values by
+// column name, as text output shows them, ending each row's output with a
+// line break unless the template did. NULL values are nullString.
+func writeTemplateResults(out *resultWriter, rows resultRows, tmpl *template.Template, queryID, nullString, byteaFormat string, maxRows int, masks map[string]string, capture *resultCapture) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get columns: %v", err)
+	}
+	mask := redactionMask(columns, masks)
+	types, err := columnTypeNames(rows)
+	if err != nil {
+		return 0, err
+	}
+	rowNumber := 0
+	tmpl, err = tmpl.Clone()
+	if err != nil {
+		return 0, err
+	}
+	tmpl.Funcs(rowTemplateFuncs(queryID, &rowNumber))
+
+	values, scanArgs := scanRow(len(columns))
+	fields := make(map[string]interface{}, len(columns))
+	var buf bytes.Buffer
+	rowCount := 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return rowCount, fmt.Errorf("error scanning row: %v", err)
+		}
+		capture.row(columns, values)
+		redactRow(values, mask)
+		if (maxRows > 0 && rowCount >= maxRows) || out.failed() {
+			rowCount++
+			continue
+		}
+		for i, v := range values {
+			if v == nil {
+				fields[columns[i]] = nullString
+			} else {
+				fields[columns[i]] = cellValue(v, types[i], byteaFormat, 0)
+			}
+		}
+		rowNumber = rowCount + 1
+		buf.Reset()
+		if err := tmpl.Execute(&buf, fields); err != nil {
+			return rowCount, fmt.Errorf("query %s: row %d: %w", queryID, rowNumber, err)
+		}
+		if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		out.Write(buf.Bytes())
+		rowCount++
+	}
+	if err := rows.Err(); err != nil {
+		return rowCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+	return rowCount, nil
+}
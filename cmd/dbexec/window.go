@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // windows name their zone explicitly; don't depend on the host's zoneinfo
+)
+
+// maintenanceWindow is a recurring daily time range, such as
+// "Mon-Fri 22:00-02:00 UTC", during which a query may be executed. A range
+// whose end is before its start crosses midnight and belongs to the day it
+// starts on.
+type maintenanceWindow struct {
+	spec       string
+	days       [7]bool
+	start, end int // minutes after midnight; end is exclusive
+	loc        *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWindow parses a window of the form "[DAYS] HH:MM-HH:MM ZONE". DAYS is
+// a comma-separated list of weekdays or ranges such as Mon-Fri or Fri-Mon and
+// defaults to every day. ZONE is required and is an IANA zone name such as
+// UTC or Europe/Berlin.
+func parseWindow(spec string) (maintenanceWindow, error) {
+	w := maintenanceWindow{spec: spec}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 2:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 3:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, err
+		}
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("window %q must look like \"[Mon-Fri] 22:00-02:00 UTC\"", spec)
+	}
+
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("window %q: time range must be HH:MM-HH:MM", spec)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("window %q: %w", spec, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("window %q: %w", spec, err)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("window %q: start and end are the same time", spec)
+	}
+	if w.loc, err = time.LoadLocation(fields[1]); err != nil || fields[1] == "Local" {
+		return w, fmt.Errorf("window %q: unknown time zone %s", spec, fields[1])
+	}
+	return w, nil
+}
+
+// parseDays parses a comma-separated list of weekdays and weekday ranges.
+func (w *maintenanceWindow) parseDays(list string) error {
+	for _, item := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("window %q: unknown weekday %s", w.spec, from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("window %q: unknown weekday %s", w.spec, to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes after midnight. 24:00 is accepted as
+// the end of the day.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether t falls inside the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// The window crosses midnight: before the end it belongs to the day
+	// before.
+	if minute >= w.start {
+		return w.days[day]
+	}
+	return minute < w.end && w.days[(day+6)%7]
+}
+
+// compileWindows parses a query's allowed_windows.
+func compileWindows(q *QueryDefinition) error {
+	q.windows = nil
+	for _, spec := range q.AllowedWindows {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return fmt.Errorf("query %s: %w", q.ID, err)
+		}
+		q.windows = append(q.windows, w)
+	}
+	return nil
+}
+
+// inWindow reports whether the query may be executed at t: it has no
+// allowed_windows or t falls inside one of them.
+func (q QueryDefinition) inWindow(t time.Time) bool {
+	if len(q.windows) == 0 {
+		return true
+	}
+	for _, w := range q.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowAcrossMidnight(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time {
+		// January 9, 2026 is a Friday.
+		return time.Date(2026, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"Mon-Fri 22:00-02:00 UTC", utc(9, 21, 59), false},
+		{"Mon-Fri 22:00-02:00 UTC", utc(9, 22, 0), true},
+		{"Mon-Fri 22:00-02:00 UTC", utc(9, 23, 59), true},
+		// Saturday morning is still in Friday's window.
+		{"Mon-Fri 22:00-02:00 UTC", utc(10, 0, 0), true},
+		{"Mon-Fri 22:00-02:00 UTC", utc(10, 1, 59), true},
+		{"Mon-Fri 22:00-02:00 UTC", utc(10, 2, 0), false},
+		{"Mon-Fri 22:00-02:00 UTC", utc(10, 22, 30), false},
+		// Monday morning belongs to Sunday's window, which isn't allowed.
+		{"Mon-Fri 22:00-02:00 UTC", utc(12, 1, 0), false},
+		{"Mon-Fri 22:00-02:00 UTC", utc(13, 1, 0), true},
+		{"Sat 23:00-01:00 UTC", utc(11, 0, 30), true},
+		{"Sat 23:00-01:00 UTC", utc(11, 23, 30), false},
+		{"Fri-Mon 23:00-01:00 UTC", utc(13, 0, 30), true},
+		{"Fri-Mon 23:00-01:00 UTC", utc(14, 0, 30), false},
+		// 21:30 UTC is 22:30 in Berlin in winter, and 01:30 UTC is 02:30.
+		{"22:00-02:00 Europe/Berlin", utc(9, 21, 30), true},
+		{"22:00-02:00 Europe/Berlin", utc(10, 0, 59), true},
+		{"22:00-02:00 Europe/Berlin", utc(10, 1, 30), false},
+		{"00:00-24:00 UTC", utc(11, 23, 59), true},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		if got := w.contains(tt.at); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.spec, tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, spec := range []string{
+		"22:00-02:00",
+		"22:00-22:00 UTC",
+		"22:00-02:00 Local",
+		"22:00-02:00 Mars/Olympus",
+		"Mon-Fry 22:00-02:00 UTC",
+		"24:30-02:00 UTC",
+		"2200-0200 UTC",
+	} {
+		if _, err := parseWindow(spec); err == nil {
+			t.Errorf("parseWindow(%q) succeeded", spec)
+		}
+	}
+}